@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	appsKey = "apps"
+
+	appContextKey = "app"
+)
+
+var appNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+type App struct {
+	Name      string    `json:"name"`
+	Quota     *AppQuota `json:"quota,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// appKey prefixes every key that belongs to an app.
+func appKey(app string) string {
+	return "app:" + app
+}
+
+func validateAppName(name string) error {
+	if !appNamePattern.MatchString(name) {
+		return fmt.Errorf("app name must be 1-63 lowercase letters, digits, '-' or '_', starting with a letter or digit")
+	}
+	return nil
+}
+
+func fetchApp(ctx context.Context, name string) (*App, error) {
+	data, err := rdb.HGet(ctx, appsKey, name).Result()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("app not found")
+	} else if err != nil {
+		return nil, err
+	}
+
+	var app App
+	if err := json.Unmarshal([]byte(data), &app); err != nil {
+		return nil, err
+	}
+	return &app, nil
+}
+
+func listApps(ctx context.Context) ([]App, error) {
+	entries, err := rdb.HGetAll(ctx, appsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	apps := make([]App, 0, len(entries))
+	for name, data := range entries {
+		var app App
+		if err := json.Unmarshal([]byte(data), &app); err != nil {
+			log.WithError(err).Errorf("failed to unmarshal app %s", name)
+			continue
+		}
+		apps = append(apps, app)
+	}
+
+	sort.Slice(apps, func(i, j int) bool {
+		return apps[i].Name < apps[j].Name
+	})
+	return apps, nil
+}
+
+// ensureApp creates the app unless it exists already, and reports whether it
+// had to.
+func ensureApp(ctx context.Context, name string) (bool, error) {
+	data, err := json.Marshal(App{Name: name, CreatedAt: time.Now().UTC()})
+	if err != nil {
+		return false, err
+	}
+	return rdb.HSetNX(ctx, appsKey, name, data).Result()
+}
+
+// migrateLegacyMachines moves machine records from the flat machine:<id>
+// keys used before apps existed into the namespace of their app.
+func migrateLegacyMachines(ctx context.Context) error {
+	keys, err := rdb.Keys(ctx, "machine:*").Result()
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		machineID := strings.TrimPrefix(key, "machine:")
+
+		data, err := rdb.Get(ctx, key).Result()
+		if err != nil {
+			log.WithError(err).Errorf("failed to fetch machine info for key %s", key)
+			continue
+		}
+		var info MachineInfo
+		if err := json.Unmarshal([]byte(data), &info); err != nil {
+			log.WithError(err).Errorf("failed to unmarshal machine info for key %s", key)
+			continue
+		}
+
+		app := info.machineConfig().AppName
+		if _, err := ensureApp(ctx, app); err != nil {
+			return err
+		}
+		if err := registerMachine(ctx, machineID, app); err != nil {
+			return err
+		}
+		if err := rdb.Rename(ctx, key, machineKey(app, machineID)).Err(); err != nil {
+			return err
+		}
+		log.Infof("Moved machine %s into app %s", machineID, app)
+	}
+
+	return nil
+}
+
+func callerKey(c echo.Context) *APIKey {
+	key, _ := c.Get(apiKeyContextKey).(*APIKey)
+	return key
+}
+
+// authorizeApp scopes requests to the apps of the caller's key. Machines of
+// other apps, or that don't match the app in the path, are reported as not
+// found so their IDs don't leak.
+func authorizeApp(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		key := callerKey(c)
+		if key == nil {
+			return next(c)
+		}
+
+		ctx := c.Request().Context()
+		app := c.Param("app_name")
+
+		if machineID := c.Param("machine_id"); machineID != "" {
+			owner, err := machineApp(ctx, machineID)
+			if err != nil {
+				if strings.Contains(err.Error(), "machine not found") {
+					return c.JSON(http.StatusNotFound, map[string]string{"error": "Machine not found"})
+				}
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+			}
+			if (app != "" && owner != app) || !key.canAccessApp(owner) {
+				return c.JSON(http.StatusNotFound, map[string]string{"error": "Machine not found"})
+			}
+			c.Set(appContextKey, owner)
+		} else if app != "" {
+			if !key.canAccessApp(app) {
+				return c.JSON(http.StatusNotFound, map[string]string{"error": "App not found"})
+			}
+			if _, err := fetchApp(ctx, app); err != nil {
+				if strings.Contains(err.Error(), "app not found") {
+					return c.JSON(http.StatusNotFound, map[string]string{"error": "App not found"})
+				}
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+			}
+			c.Set(appContextKey, app)
+		}
+
+		return next(c)
+	}
+}
+
+func createApp(c echo.Context) error {
+	var app App
+	if err := c.Bind(&app); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	if err := validateAppName(app.Name); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if app.Quota != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "set quotas with PUT /apps/:app_name/quota"})
+	}
+
+	created, err := ensureApp(context.Background(), app.Name)
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to create app")
+	}
+	if !created {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "App already exists"})
+	}
+
+	stored, err := fetchApp(context.Background(), app.Name)
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to create app")
+	}
+	return c.JSON(http.StatusCreated, stored)
+}
+
+func getApps(c echo.Context) error {
+	apps, err := listApps(context.Background())
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to fetch apps")
+	}
+
+	key := callerKey(c)
+	visible := make([]App, 0, len(apps))
+	for _, app := range apps {
+		if key.canAccessApp(app.Name) {
+			visible = append(visible, app)
+		}
+	}
+	return c.JSON(http.StatusOK, visible)
+}
+
+func getApp(c echo.Context) error {
+	app, err := fetchApp(context.Background(), c.Param("app_name"))
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to fetch app")
+	}
+	return c.JSON(http.StatusOK, app)
+}
+
+// deleteApp only removes empty apps, machines and volumes have to be
+// deleted first.
+func deleteApp(c echo.Context) error {
+	name := c.Param("app_name")
+	ctx := context.Background()
+
+	machines, err := listMachineInfos(ctx, name)
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to delete app")
+	}
+	if len(machines) > 0 {
+		return c.JSON(http.StatusConflict, map[string]string{"error": fmt.Sprintf("App still has %d machines", len(machines))})
+	}
+
+	// Volumes outlive machines, their data goes only when they're deleted
+	volumes, err := listVolumes(ctx)
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to delete app")
+	}
+	appVolumes := 0
+	for _, volume := range volumes {
+		if volume.App == name {
+			appVolumes++
+		}
+	}
+	if appVolumes > 0 {
+		return c.JSON(http.StatusConflict, map[string]string{"error": fmt.Sprintf("App still has %d volumes", appVolumes)})
+	}
+
+	if err := rdb.HDel(ctx, appsKey, name).Err(); err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to delete app")
+	}
+	if err := rdb.Del(ctx, appUsageKey(name)).Err(); err != nil {
+		log.WithError(err).Errorf("failed to delete usage of app %s", name)
+	}
+	return c.JSON(http.StatusOK, "App deleted!")
+}
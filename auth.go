@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/xid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ScopeRead          = "read"
+	ScopeMachinesWrite = "machines:write"
+	ScopeRun           = "run"
+	ScopeAdmin         = "admin"
+
+	apiKeysKey   = "api-keys"
+	apiKeyPrefix = "qk_"
+
+	apiKeyContextKey = "api_key"
+)
+
+var validScopes = map[string]bool{
+	ScopeRead:          true,
+	ScopeMachinesWrite: true,
+	ScopeRun:           true,
+	ScopeAdmin:         true,
+}
+
+// APIKey is what's stored for a key. Only the SHA-256 of the secret part is
+// kept, the key itself is shown once when it's created. A key without apps
+// can reach every app.
+type APIKey struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Scopes    []string  `json:"scopes"`
+	Apps      []string  `json:"apps,omitempty"`
+	Hash      string    `json:"hash,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (key *APIKey) hasScope(scope string) bool {
+	for _, s := range key.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+func (key *APIKey) canAccessApp(app string) bool {
+	return len(key.Apps) == 0 || containsString(key.Apps, app)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+type CreateAPIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	Apps   []string `json:"apps,omitempty"`
+}
+
+type CreateAPIKeyResponse struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+func validateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return fmt.Errorf("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		if !validScopes[scope] {
+			return fmt.Errorf("unknown scope %q, expected read, machines:write, run or admin", scope)
+		}
+	}
+	return nil
+}
+
+func hashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIKey creates and stores a key. Keys look like qk_<id>_<secret>, the
+// ID makes lookups cheap without storing anything that can be used to log in.
+func newAPIKey(ctx context.Context, name string, scopes, apps []string) (*APIKey, string, error) {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	secretHex := hex.EncodeToString(secret)
+
+	key := &APIKey{
+		ID:        xid.New().String(),
+		Name:      name,
+		Scopes:    scopes,
+		Apps:      apps,
+		Hash:      hashAPIKeySecret(secretHex),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	data, err := json.Marshal(key)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := rdb.HSet(ctx, apiKeysKey, key.ID, data).Err(); err != nil {
+		return nil, "", err
+	}
+
+	return key, apiKeyPrefix + key.ID + "_" + secretHex, nil
+}
+
+func fetchAPIKey(ctx context.Context, keyID string) (*APIKey, error) {
+	data, err := rdb.HGet(ctx, apiKeysKey, keyID).Result()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("api key not found")
+	} else if err != nil {
+		return nil, err
+	}
+
+	var key APIKey
+	if err := json.Unmarshal([]byte(data), &key); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func listAPIKeys(ctx context.Context) ([]APIKey, error) {
+	entries, err := rdb.HGetAll(ctx, apiKeysKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]APIKey, 0, len(entries))
+	for id, data := range entries {
+		var key APIKey
+		if err := json.Unmarshal([]byte(data), &key); err != nil {
+			log.WithError(err).Errorf("failed to unmarshal api key %s", id)
+			continue
+		}
+		key.Hash = ""
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys, nil
+}
+
+// verifyAPIKey returns the stored key for a presented one, or nil if it
+// doesn't match any.
+func verifyAPIKey(ctx context.Context, presented string) (*APIKey, error) {
+	rest, ok := strings.CutPrefix(presented, apiKeyPrefix)
+	if !ok {
+		return nil, nil
+	}
+	keyID, secret, ok := strings.Cut(rest, "_")
+	if !ok {
+		return nil, nil
+	}
+
+	key, err := fetchAPIKey(ctx, keyID)
+	if err != nil {
+		if strings.Contains(err.Error(), "api key not found") {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashAPIKeySecret(secret)), []byte(key.Hash)) != 1 {
+		return nil, nil
+	}
+	return key, nil
+}
+
+// bootstrapAPIKey creates an admin key when there are none yet, so a fresh
+// install can be reached at all. The secret is printed to stdout once and
+// never again, it's kept out of the logs so it doesn't end up shipped along
+// with them.
+func bootstrapAPIKey(ctx context.Context) error {
+	count, err := rdb.HLen(ctx, apiKeysKey).Result()
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	key, secret, err := newAPIKey(ctx, "bootstrap", []string{ScopeAdmin}, nil)
+	if err != nil {
+		return err
+	}
+
+	log.Warnf("No API keys found, created admin key %s and printed its secret to stdout", key.ID)
+	fmt.Printf("Bootstrap admin API key: %s\nStore it now, it won't be shown again.\n", secret)
+	return nil
+}
+
+// authenticate resolves the API key of a request, sent either as a bearer
+// token or in X-API-Key. Scopes are checked per route by requireScope.
+func authenticate(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		presented := c.Request().Header.Get("X-API-Key")
+		if auth := c.Request().Header.Get(echo.HeaderAuthorization); auth != "" {
+			presented = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if presented == "" {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "API key required"})
+		}
+
+		key, err := verifyAPIKey(c.Request().Context(), presented)
+		if err != nil {
+			return handleError(c, err, http.StatusInternalServerError, "Failed to verify API key")
+		}
+		if key == nil {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid API key"})
+		}
+
+		c.Set(apiKeyContextKey, key)
+		return next(c)
+	}
+}
+
+func requireScope(scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			key, ok := c.Get(apiKeyContextKey).(*APIKey)
+			if !ok || !key.hasScope(scope) {
+				return c.JSON(http.StatusForbidden, map[string]string{"error": fmt.Sprintf("API key lacks the %s scope", scope)})
+			}
+			return next(c)
+		}
+	}
+}
+
+// requireUnscopedKey keeps keys limited to some apps away from routes that
+// see across all of them.
+func requireUnscopedKey(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		key, ok := c.Get(apiKeyContextKey).(*APIKey)
+		if !ok || len(key.Apps) > 0 {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "API key is limited to some apps and can't use this route"})
+		}
+		return next(c)
+	}
+}
+
+func createAPIKey(c echo.Context) error {
+	var req CreateAPIKeyRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	if err := validateScopes(req.Scopes); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	for _, app := range req.Apps {
+		if _, err := fetchApp(context.Background(), app); err != nil {
+			if strings.Contains(err.Error(), "app not found") {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("App %s not found", app)})
+			}
+			return handleError(c, err, http.StatusInternalServerError, "Failed to create API key")
+		}
+	}
+
+	key, secret, err := newAPIKey(context.Background(), req.Name, req.Scopes, req.Apps)
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to create API key")
+	}
+
+	key.Hash = ""
+	return c.JSON(http.StatusCreated, CreateAPIKeyResponse{APIKey: *key, Key: secret})
+}
+
+func getAPIKeys(c echo.Context) error {
+	keys, err := listAPIKeys(context.Background())
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to fetch API keys")
+	}
+	return c.JSON(http.StatusOK, keys)
+}
+
+func deleteAPIKey(c echo.Context) error {
+	keyID := c.Param("key_id")
+
+	if current, ok := c.Get(apiKeyContextKey).(*APIKey); ok && current.ID == keyID {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Can't delete the key used for this request"})
+	}
+
+	deleted, err := rdb.HDel(context.Background(), apiKeysKey, keyID).Result()
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to delete API key")
+	}
+	if deleted == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "API key not found"})
+	}
+
+	return c.JSON(http.StatusOK, "API key deleted!")
+}
+
+// whoami describes the key used for the request, the CLI uses it to check
+// credentials on login.
+func whoami(c echo.Context) error {
+	key := *c.Get(apiKeyContextKey).(*APIKey)
+	key.Hash = ""
+	return c.JSON(http.StatusOK, key)
+}
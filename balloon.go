@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	MemoryReclaimThresholdEnvVar = "MEMORY_RECLAIM_THRESHOLD_MB"
+	MemoryReclaimIdleEnvVar      = "MEMORY_RECLAIM_IDLE"
+
+	defaultMemoryReclaimThresholdMb = 1024
+	defaultMemoryReclaimIdle        = 5 * time.Minute
+
+	memoryReclaimInterval = 30 * time.Second
+
+	// reclaimMemory never squeezes a guest below this
+	minGuestMemoryMb = 128
+)
+
+// MemoryUpdateRequest sets the balloon either directly or through the memory
+// the guest should be left with.
+type MemoryUpdateRequest struct {
+	AmountMib *int64 `json:"amount_mib,omitempty"`
+	TargetMb  *int64 `json:"target_mb,omitempty"`
+}
+
+type MachineMemoryResponse struct {
+	MachineID    string `json:"machine_id"`
+	MemoryMb     int64  `json:"memory_mb"`
+	BalloonMib   int64  `json:"balloon_mib"`
+	ReclaimedMib int64  `json:"reclaimed_mib,omitempty"`
+	AvailableMb  int64  `json:"available_mb"`
+}
+
+func memoryResponse(machineID string, memoryMb, amountMib, reclaimedMib int64) MachineMemoryResponse {
+	return MachineMemoryResponse{
+		MachineID:    machineID,
+		MemoryMb:     memoryMb,
+		BalloonMib:   amountMib + reclaimedMib,
+		ReclaimedMib: reclaimedMib,
+		AvailableMb:  memoryMb - amountMib - reclaimedMib,
+	}
+}
+
+// updateMachineMemory inflates or deflates the balloon of a running machine.
+// The new amount is stored with the machine so a restart keeps it, and it
+// replaces whatever reclaimMemory had taken.
+func updateMachineMemory(c echo.Context) error {
+	machineID := c.Param("machine_id")
+	ctx := context.Background()
+
+	machineInfo, err := fetchMachineInfo(ctx, machineID)
+	if err != nil {
+		if strings.Contains(err.Error(), "machine not found") {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Machine not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+
+	var req MemoryUpdateRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	if (req.AmountMib == nil) == (req.TargetMb == nil) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Set exactly one of amount_mib and target_mb"})
+	}
+
+	machineConfig := machineInfo.machineConfig()
+	if machineConfig.Balloon == nil {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Machine was created without a balloon"})
+	}
+
+	memoryMb := machineConfig.MachineType.MemoryMb
+	amount := memoryMb - int64Value(req.TargetMb)
+	if req.AmountMib != nil {
+		amount = *req.AmountMib
+	}
+	balloon := *machineConfig.Balloon
+	balloon.AmountMib = amount
+	if err := validateBalloon(&balloon, memoryMb); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	vm, ok := fcManager.GetVM(machineID)
+	if !ok {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Machine is not running"})
+	}
+
+	vm.balloonMu.Lock()
+	defer vm.balloonMu.Unlock()
+
+	if err := vm.machine.UpdateBalloon(ctx, amount); err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to resize balloon")
+	}
+	vm.reclaimedMib = 0
+
+	err = updateMachineInfo(ctx, machineID, func(info *MachineInfo) {
+		if info.Config != nil && info.Config.Balloon != nil {
+			info.Config.Balloon.AmountMib = amount
+		}
+	})
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to store balloon size")
+	}
+
+	return c.JSON(http.StatusOK, memoryResponse(machineID, memoryMb, amount, 0))
+}
+
+func int64Value(v *int64) int64 {
+	if v == nil {
+		return 0
+	}
+	return *v
+}
+
+// reclaimMemory inflates the balloons of idle machines while the host's
+// available memory is below MEMORY_RECLAIM_THRESHOLD_MB, and gives the memory
+// back to machines that are busy again once there's room. Only machines
+// created with a balloon take part; deflate_on_oom decides whether a guest
+// can take memory back on its own.
+func reclaimMemory(ctx context.Context) {
+	thresholdMb := int64(defaultMemoryReclaimThresholdMb)
+	if value := os.Getenv(MemoryReclaimThresholdEnvVar); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			log.WithError(err).Warnf("ignoring %s", MemoryReclaimThresholdEnvVar)
+		} else {
+			thresholdMb = parsed
+		}
+	}
+	if thresholdMb <= 0 {
+		return
+	}
+
+	idle := defaultMemoryReclaimIdle
+	if value := os.Getenv(MemoryReclaimIdleEnvVar); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			log.WithError(err).Warnf("ignoring %s", MemoryReclaimIdleEnvVar)
+		} else {
+			idle = parsed
+		}
+	}
+
+	ticker := time.NewTicker(memoryReclaimInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		availableMb, err := hostMeminfoMb("MemAvailable")
+		if err != nil {
+			log.WithError(err).Error("failed to read available host memory")
+			continue
+		}
+
+		if availableMb < thresholdMb {
+			inflateIdleBalloons(ctx, thresholdMb-availableMb, idle)
+		} else {
+			deflateActiveBalloons(ctx, availableMb-thresholdMb, idle)
+		}
+	}
+}
+
+// inflateIdleBalloons takes up to neededMb from the machines idle the longest.
+func inflateIdleBalloons(ctx context.Context, neededMb int64, idle time.Duration) {
+	vms := fcManager.List()
+	sort.Slice(vms, func(i, j int) bool {
+		return vms[i].idleFor() > vms[j].idleFor()
+	})
+
+	for _, vm := range vms {
+		if neededMb <= 0 || vm.idleFor() < idle {
+			return
+		}
+
+		info, err := fetchMachineInfo(ctx, vm.vmmID)
+		if err != nil {
+			continue
+		}
+		machineConfig := info.machineConfig()
+		if machineConfig.Balloon == nil || MachineStatusType(info.Status) != StatusRunning {
+			continue
+		}
+
+		vm.balloonMu.Lock()
+		current := machineConfig.Balloon.AmountMib + vm.reclaimedMib
+		room := machineConfig.MachineType.MemoryMb - minGuestMemoryMb - current
+		take := neededMb
+		if room < take {
+			take = room
+		}
+		if take > 0 {
+			if err := vm.machine.UpdateBalloon(ctx, current+take); err != nil {
+				log.WithError(err).Errorf("failed to reclaim memory from machine %s", vm.vmmID)
+			} else {
+				vm.reclaimedMib += take
+				neededMb -= take
+				log.Infof("Reclaimed %d MiB from idle machine %s", take, vm.vmmID)
+			}
+		}
+		vm.balloonMu.Unlock()
+	}
+}
+
+// deflateActiveBalloons returns reclaimed memory to machines that are in use
+// again, as long as the host stays above the threshold.
+func deflateActiveBalloons(ctx context.Context, spareMb int64, idle time.Duration) {
+	for _, vm := range fcManager.List() {
+		if spareMb <= 0 {
+			return
+		}
+		if vm.idleFor() < idle {
+			spareMb -= restoreReclaimedMemory(ctx, vm, spareMb)
+		}
+	}
+}
+
+// restoreReclaimedMemory deflates the balloon of vm back towards its
+// configured amount, giving back at most limitMb, and returns what it gave.
+func restoreReclaimedMemory(ctx context.Context, vm *runningFirecracker, limitMb int64) int64 {
+	vm.balloonMu.Lock()
+	defer vm.balloonMu.Unlock()
+
+	if vm.reclaimedMib == 0 {
+		return 0
+	}
+	info, err := fetchMachineInfo(ctx, vm.vmmID)
+	if err != nil || info.machineConfig().Balloon == nil {
+		return 0
+	}
+
+	give := vm.reclaimedMib
+	if limitMb < give {
+		give = limitMb
+	}
+	amount := info.machineConfig().Balloon.AmountMib + vm.reclaimedMib - give
+	if err := vm.machine.UpdateBalloon(ctx, amount); err != nil {
+		log.WithError(err).Errorf("failed to return memory to machine %s", vm.vmmID)
+		return 0
+	}
+	vm.reclaimedMib -= give
+	log.Infof("Returned %d MiB to machine %s", give, vm.vmmID)
+	return give
+}
+
+// markActive records activity on a machine about to run code and hands back
+// everything reclaimMemory took from it, the run shouldn't wait for the next
+// reclaim round.
+func markActive(ctx context.Context, machineID string) {
+	vm, ok := fcManager.GetVM(machineID)
+	if !ok {
+		return
+	}
+	vm.touch()
+	restoreReclaimedMemory(ctx, vm, math.MaxInt64)
+}
+
+func getMachineMemory(c echo.Context) error {
+	machineID := c.Param("machine_id")
+
+	machineInfo, err := fetchMachineInfo(context.Background(), machineID)
+	if err != nil {
+		if strings.Contains(err.Error(), "machine not found") {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Machine not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+
+	machineConfig := machineInfo.machineConfig()
+	var amount, reclaimed int64
+	if machineConfig.Balloon != nil {
+		amount = machineConfig.Balloon.AmountMib
+	}
+	if vm, ok := fcManager.GetVM(machineID); ok {
+		vm.balloonMu.Lock()
+		reclaimed = vm.reclaimedMib
+		vm.balloonMu.Unlock()
+	}
+
+	return c.JSON(http.StatusOK, memoryResponse(machineID, machineConfig.MachineType.MemoryMb, amount, reclaimed))
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	CgroupRootEnvVar   = "CGROUP_ROOT"
+	CgroupParentEnvVar = "CGROUP_PARENT"
+
+	defaultCgroupRoot   = "/sys/fs/cgroup"
+	defaultCgroupParent = "quest"
+
+	cgroupCPUPeriodUs = 100000
+
+	// Headroom for what the VMM needs besides guest memory and vCPU threads
+	vmmMemoryOverheadMb = 64
+	vmmPidsOverhead     = 32
+
+	ioBytesPerVcpu = 64 * 1024 * 1024
+	ioOpsPerVcpu   = 2000
+)
+
+// cgroups is nil unless the host has a cgroup v2 hierarchy to put VMMs in.
+var cgroups *Cgroups
+
+// Cgroups places every VMM in a cgroup of its own below Parent. Under the
+// jailer with cgroup v2 the cgroup the jailer created is used instead, so its
+// NUMA placement is kept.
+type Cgroups struct {
+	Root   string
+	Parent string
+}
+
+type CgroupStats struct {
+	CPUUsageUs       uint64 `json:"cpu_usage_us"`
+	CPUThrottledUs   uint64 `json:"cpu_throttled_us"`
+	CPUThrottled     uint64 `json:"cpu_nr_throttled"`
+	MemoryBytes      uint64 `json:"memory_bytes"`
+	MemoryLimitBytes uint64 `json:"memory_limit_bytes,omitempty"`
+	OOMKills         uint64 `json:"oom_kills"`
+	Pids             uint64 `json:"pids"`
+	IOReadBytes      uint64 `json:"io_read_bytes"`
+	IOWriteBytes     uint64 `json:"io_write_bytes"`
+	IOReads          uint64 `json:"io_reads"`
+	IOWrites         uint64 `json:"io_writes"`
+}
+
+func loadCgroups() (*Cgroups, error) {
+	parent := envOrDefault(CgroupParentEnvVar, defaultCgroupParent)
+	if parent == "off" {
+		return nil, nil
+	}
+
+	root := envOrDefault(CgroupRootEnvVar, defaultCgroupRoot)
+	if _, err := os.Stat(filepath.Join(root, "cgroup.controllers")); err != nil {
+		log.Warnf("no cgroup v2 hierarchy at %s, VMMs run without resource controls", root)
+		return nil, nil
+	}
+
+	cg := &Cgroups{Root: root, Parent: parent}
+	if err := os.MkdirAll(filepath.Join(root, parent), 0755); err != nil {
+		return nil, err
+	}
+	dirs := []string{root, filepath.Join(root, parent)}
+	// The jailer creates each VMM's cgroup below one named after the binary
+	// and writes the limits it's given there before firecracker runs
+	if jailer != nil && jailer.CgroupVersion == "2" {
+		jailerDir := filepath.Join(root, filepath.Base(jailer.ExecFile))
+		if err := os.MkdirAll(jailerDir, 0755); err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, jailerDir)
+	}
+	for _, dir := range dirs {
+		if err := enableControllers(dir); err != nil {
+			return nil, err
+		}
+	}
+	return cg, nil
+}
+
+// enableControllers lets the children of dir use the controllers VMMs are
+// limited with, as far as dir has them.
+func enableControllers(dir string) error {
+	available, err := os.ReadFile(filepath.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		return err
+	}
+
+	var enable []string
+	for _, controller := range strings.Fields(string(available)) {
+		if containsString([]string{"cpu", "memory", "io", "pids"}, controller) {
+			enable = append(enable, "+"+controller)
+		}
+	}
+	if len(enable) == 0 {
+		return nil
+	}
+	return os.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte(strings.Join(enable, " ")), 0644)
+}
+
+func (cg *Cgroups) path(vmmID string) string {
+	if jailer != nil && jailer.CgroupVersion == "2" {
+		return filepath.Join(cg.Root, filepath.Base(jailer.ExecFile), vmmID)
+	}
+	return filepath.Join(cg.Root, cg.Parent, vmmID)
+}
+
+// limitsFor derives the cgroup limits of a VMM from its machine type.
+func limitsFor(machineType ApiMachineType) map[string]string {
+	return map[string]string{
+		"cpu.max":    fmt.Sprintf("%d %d", machineType.Cpus*cgroupCPUPeriodUs, cgroupCPUPeriodUs),
+		"memory.max": strconv.FormatInt((machineType.MemoryMb+vmmMemoryOverheadMb)*1024*1024, 10),
+		"pids.max":   strconv.FormatInt(machineType.Cpus+vmmPidsOverhead, 10),
+	}
+}
+
+// jailerArgs are the --cgroup args that have the jailer apply the limits of
+// a machine type, or none if the jailer doesn't place VMMs in cgroup v2.
+// io.max needs the device and is left to place.
+func (cg *Cgroups) jailerArgs(machineType ApiMachineType) []string {
+	if jailer == nil || jailer.CgroupVersion != "2" {
+		return nil
+	}
+
+	limits := limitsFor(machineType)
+	files := make([]string, 0, len(limits))
+	for file := range limits {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	var args []string
+	for _, file := range files {
+		args = append(args, "--cgroup", file+"="+limits[file])
+	}
+	return args
+}
+
+// placeHandler puts the VMM into its cgroup as soon as the process is up,
+// before the guest boots or a snapshot is loaded. A VMM that can't be
+// limited doesn't get to run.
+func placeHandler(vmmID string, machineType ApiMachineType) firecracker.Handler {
+	return firecracker.Handler{
+		Name: "quest.PlaceInCgroup",
+		Fn: func(ctx context.Context, m *firecracker.Machine) error {
+			pid, err := m.PID()
+			if err != nil {
+				return err
+			}
+			if err := cgroups.place(vmmID, machineType, pid); err != nil {
+				return fmt.Errorf("failed to apply resource limits: %v", err)
+			}
+			return nil
+		},
+	}
+}
+
+// place moves the VMM process into its cgroup and applies the limits of its
+// machine type. I/O is limited on the disk holding the rootfs copy. Under the
+// jailer the process is already there and the limits are rewritten as they
+// were.
+func (cg *Cgroups) place(vmmID string, machineType ApiMachineType, pid int) error {
+	dir := cg.path(vmmID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	for file, value := range limitsFor(machineType) {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(value), 0644); err != nil {
+			return fmt.Errorf("failed to set %s: %v", file, err)
+		}
+	}
+
+	device, err := blockDevice(getRootFSPath(vmmID))
+	if err != nil {
+		log.WithError(err).Warnf("not limiting I/O of machine %s", vmmID)
+	} else {
+		ioMax := fmt.Sprintf("%s rbps=%d wbps=%d riops=%d wiops=%d", device,
+			machineType.Cpus*ioBytesPerVcpu, machineType.Cpus*ioBytesPerVcpu,
+			machineType.Cpus*ioOpsPerVcpu, machineType.Cpus*ioOpsPerVcpu)
+		if err := os.WriteFile(filepath.Join(dir, "io.max"), []byte(ioMax), 0644); err != nil {
+			log.WithError(err).Warnf("not limiting I/O of machine %s", vmmID)
+		}
+	}
+
+	return os.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644)
+}
+
+// blockDevice returns the major:minor of the disk a file lives on. io.max
+// only takes whole disks, so partitions are resolved to their parent.
+func blockDevice(path string) (string, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return "", err
+	}
+	device := fmt.Sprintf("%d:%d", unix.Major(st.Dev), unix.Minor(st.Dev))
+
+	sysPath, err := filepath.EvalSymlinks(filepath.Join("/sys/dev/block", device))
+	if err != nil {
+		return "", fmt.Errorf("%s is not on a block device", path)
+	}
+	if _, err := os.Stat(filepath.Join(sysPath, "partition")); err == nil {
+		parent, err := os.ReadFile(filepath.Join(filepath.Dir(sysPath), "dev"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(parent)), nil
+	}
+	return device, nil
+}
+
+// remove deletes the cgroup of a VMM. The kernel only lets go of it once the
+// process has exited, which can take a moment after it was told to stop.
+func (cg *Cgroups) remove(vmmID string) error {
+	dir := cg.path(vmmID)
+	var err error
+	for i := 0; i < 20; i++ {
+		err = syscall.Rmdir(dir)
+		if err == nil || errors.Is(err, syscall.ENOENT) {
+			return nil
+		}
+		if !errors.Is(err, syscall.EBUSY) {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return err
+}
+
+func (cg *Cgroups) stats(vmmID string) (*CgroupStats, error) {
+	dir := cg.path(vmmID)
+	stats := &CgroupStats{}
+
+	cpu, err := readFlatKeyed(filepath.Join(dir, "cpu.stat"))
+	if err != nil {
+		return nil, err
+	}
+	stats.CPUUsageUs = cpu["usage_usec"]
+	stats.CPUThrottledUs = cpu["throttled_usec"]
+	stats.CPUThrottled = cpu["nr_throttled"]
+
+	stats.MemoryBytes, _ = readCgroupUint(filepath.Join(dir, "memory.current"))
+	stats.MemoryLimitBytes, _ = readCgroupUint(filepath.Join(dir, "memory.max"))
+	stats.Pids, _ = readCgroupUint(filepath.Join(dir, "pids.current"))
+	if events, err := readFlatKeyed(filepath.Join(dir, "memory.events")); err == nil {
+		stats.OOMKills = events["oom_kill"]
+	}
+
+	// io.stat has a line per device: "8:0 rbytes=.. wbytes=.. rios=.. wios=.."
+	if data, err := os.ReadFile(filepath.Join(dir, "io.stat")); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				continue
+			}
+			for _, field := range fields[1:] {
+				key, value, _ := strings.Cut(field, "=")
+				n, _ := strconv.ParseUint(value, 10, 64)
+				switch key {
+				case "rbytes":
+					stats.IOReadBytes += n
+				case "wbytes":
+					stats.IOWriteBytes += n
+				case "rios":
+					stats.IOReads += n
+				case "wios":
+					stats.IOWrites += n
+				}
+			}
+		}
+	}
+
+	return stats, nil
+}
+
+// readCgroupUint reads single value files. "max" reads as 0.
+func readCgroupUint(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	value := strings.TrimSpace(string(data))
+	if value == "max" {
+		return 0, nil
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
+
+// readFlatKeyed reads "key value" files like cpu.stat.
+func readFlatKeyed(path string) (map[string]uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]uint64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if value, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			values[fields[0]] = value
+		}
+	}
+	return values, scanner.Err()
+}
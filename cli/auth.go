@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	defaultAPIURL = "http://localhost:1323"
+
+	APIKeyEnvVar = "QUEST_API_KEY"
+	APIURLEnvVar = "QUEST_API_URL"
+)
+
+// Config is what `quest auth login` stores, in ~/.config/quest/config.json.
+type Config struct {
+	APIURL string `json:"api_url,omitempty"`
+	APIKey string `json:"api_key,omitempty"`
+}
+
+var authCmd = &cobra.Command{
+	Use:   "auth",
+	Short: "Manage credentials for the quest API",
+}
+
+var loginCmd = &cobra.Command{
+	Use:   "login",
+	Short: "Store an API key for the quest API",
+	Args:  cobra.NoArgs,
+	Run:   login,
+}
+
+var logoutCmd = &cobra.Command{
+	Use:   "logout",
+	Short: "Remove stored credentials",
+	Args:  cobra.NoArgs,
+	Run:   logout,
+}
+
+func configPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "quest", "config.json"), nil
+}
+
+// loadConfig reads the stored credentials. QUEST_API_URL and QUEST_API_KEY
+// take precedence over the file.
+func loadConfig() Config {
+	var config Config
+	if path, err := configPath(); err == nil {
+		if data, err := os.ReadFile(path); err == nil {
+			if err := json.Unmarshal(data, &config); err != nil {
+				fmt.Println("Error reading config file:", err)
+			}
+		}
+	}
+
+	if url := os.Getenv(APIURLEnvVar); url != "" {
+		config.APIURL = url
+	}
+	if key := os.Getenv(APIKeyEnvVar); key != "" {
+		config.APIKey = key
+	}
+	if config.APIURL == "" {
+		config.APIURL = defaultAPIURL
+	}
+	return config
+}
+
+func saveConfig(config Config) error {
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	// The key grants access to the API, keep it private
+	return os.WriteFile(path, data, 0600)
+}
+
+func login(cmd *cobra.Command, args []string) {
+	key, _ := cmd.Flags().GetString("key")
+	url, _ := cmd.Flags().GetString("url")
+
+	if key == "" {
+		fmt.Print("API key: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			fmt.Println("Error reading API key:", err)
+			return
+		}
+		key = strings.TrimSpace(line)
+	}
+	if url == "" {
+		url = loadConfig().APIURL
+	}
+
+	config := Config{APIURL: strings.TrimSuffix(url, "/"), APIKey: key}
+
+	req, err := http.NewRequest("GET", config.APIURL+"/auth/whoami", nil)
+	if err != nil {
+		fmt.Println("Error creating request:", err)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+config.APIKey)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Println("Error making request:", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf("Login failed: server answered %s\n", resp.Status)
+		return
+	}
+
+	var apiKey APIKey
+	if err := json.NewDecoder(resp.Body).Decode(&apiKey); err != nil {
+		fmt.Println("Error unmarshaling response:", err)
+		return
+	}
+
+	if err := saveConfig(config); err != nil {
+		fmt.Println("Error saving config:", err)
+		return
+	}
+
+	fmt.Printf("Logged in to %s as '%s' (scopes: %s)\n", config.APIURL, apiKey.Name, strings.Join(apiKey.Scopes, ", "))
+}
+
+func logout(cmd *cobra.Command, args []string) {
+	path, err := configPath()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		fmt.Println("Error removing config:", err)
+		return
+	}
+	fmt.Println("Logged out")
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 )
@@ -19,6 +23,18 @@ var stopCmd = &cobra.Command{
 	Args:  cobra.ExactArgs(1),
 	Run:   stopMachine,
 }
+var pauseCmd = &cobra.Command{
+	Use:   "pause [name]",
+	Short: "Freezes a running microVM",
+	Args:  cobra.ExactArgs(1),
+	Run:   pauseMachine,
+}
+var resumeCmd = &cobra.Command{
+	Use:   "resume [name]",
+	Short: "Resumes a paused microVM",
+	Args:  cobra.ExactArgs(1),
+	Run:   resumeMachine,
+}
 var statusCmd = &cobra.Command{
 	Use:   "status [name]",
 	Short: "Status and Specs of the microVM",
@@ -31,6 +47,20 @@ var listCmd = &cobra.Command{
 	Run:   listMachines,
 }
 
+var statsCmd = &cobra.Command{
+	Use:   "stats [name]",
+	Short: "Resource usage of a microVM",
+	Args:  cobra.ExactArgs(1),
+	Run:   getMachineStats,
+}
+
+var eventsCmd = &cobra.Command{
+	Use:   "events",
+	Short: "Lifecycle events of microVMs",
+	Args:  cobra.NoArgs,
+	Run:   streamEvents,
+}
+
 var deleteCmd = &cobra.Command{
 	Use:   "delete [name]",
 	Short: "Deletes a microvm",
@@ -119,6 +149,31 @@ func stopMachine(cmd *cobra.Command, args []string) {
 	prettyPrintOutput(stopMachineResponse)
 }
 
+func pauseMachine(cmd *cobra.Command, args []string) {
+	changeMachineState(args[0], "pause")
+}
+
+func resumeMachine(cmd *cobra.Command, args []string) {
+	changeMachineState(args[0], "resume")
+}
+
+func changeMachineState(machineID, action string) {
+	resp, err := makeRequest("POST", fmt.Sprintf("/machines/%s/%s", machineID, action), nil)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	var statusResponse MachineStatusResponse
+	if err := json.NewDecoder(resp.Body).Decode(&statusResponse); err != nil {
+		fmt.Println("Error unmarshaling response:", err)
+		return
+	}
+
+	prettyPrintOutput(statusResponse)
+}
+
 func listMachines(cmd *cobra.Command, args []string) {
 
 	resp, err := makeRequest("GET", "/machines", nil)
@@ -139,3 +194,89 @@ func listMachines(cmd *cobra.Command, args []string) {
 	}
 
 }
+
+func getMachineStats(cmd *cobra.Command, args []string) {
+	machineID := args[0]
+	watch, _ := cmd.Flags().GetBool("watch")
+	interval, _ := cmd.Flags().GetDuration("interval")
+
+	for {
+		resp, err := makeRequest("GET", fmt.Sprintf("/machines/%s/stats", machineID), nil)
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+
+		var machineStats MachineStats
+		err = json.NewDecoder(resp.Body).Decode(&machineStats)
+		resp.Body.Close()
+		if err != nil {
+			fmt.Println("Error unmarshaling response:", err)
+			return
+		}
+
+		if !watch {
+			prettyPrintOutput(machineStats)
+			return
+		}
+
+		// Clear the screen and redraw in place
+		fmt.Print("\033[H\033[2J")
+		fmt.Printf("Stats of '%s' every %s (Ctrl-C to quit):\n", machineID, interval)
+		prettyPrintOutput(machineStats)
+		time.Sleep(interval)
+	}
+}
+
+func streamEvents(cmd *cobra.Command, args []string) {
+	since, _ := cmd.Flags().GetString("since")
+	follow, _ := cmd.Flags().GetBool("follow")
+
+	query := url.Values{}
+	for _, name := range []string{"machine", "app", "type"} {
+		if value, _ := cmd.Flags().GetString(name); value != "" {
+			query.Set(name, value)
+		}
+	}
+	if since != "" {
+		query.Set("since", since)
+	}
+	// Without a starting point there is nothing to show but new events
+	query.Set("follow", fmt.Sprint(follow || since == ""))
+
+	resp, err := makeRequest("GET", "/events?"+query.Encode(), nil)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+
+		var event Event
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			fmt.Println("Error unmarshaling event:", err)
+			continue
+		}
+		printEvent(event)
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Println("Error reading events:", err)
+	}
+}
+
+func printEvent(event Event) {
+	details := ""
+	if len(event.Data) > 0 {
+		if data, err := json.Marshal(event.Data); err == nil {
+			details = string(data)
+		}
+	}
+	fmt.Printf("%s  %-18s %-20s %s\n", event.Time.Local().Format(time.RFC3339), event.Type, event.MachineID, details)
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"os"
+	"time"
 
 	"github.com/spf13/cobra"
 )
@@ -26,13 +29,23 @@ var initCmd = &cobra.Command{
 
 func createMachine(cmd *cobra.Command, args []string) {
 	machineID := args[0]
+
+	var body io.Reader
 	if len(args) > 1 {
 		configFile := args[1]
 		fmt.Printf("Starting machine '%s' with config file '%s'\n", machineID, configFile)
+
+		config, err := readMachineConfig(configFile)
+		if err != nil {
+			fmt.Println("Error reading config file:", err)
+			return
+		}
+		body = bytes.NewReader(config)
+	} else {
+		fmt.Printf("Starting machine '%s' with no config file\n", machineID)
 	}
-	fmt.Printf("Starting machine '%s' with no config file\n", machineID)
 
-	resp, err := makeRequest("POST", "/machines", nil)
+	resp, err := makeRequest("POST", "/machines", body)
 	if err != nil {
 		fmt.Println("Error:", err)
 		return
@@ -46,6 +59,49 @@ func createMachine(cmd *cobra.Command, args []string) {
 	}
 
 	prettyPrintOutput(createMachineResponse)
+
+	if wait, _ := cmd.Flags().GetBool("wait"); wait {
+		timeout, _ := cmd.Flags().GetDuration("wait-timeout")
+		waitForMachine(createMachineResponse.MachineID, StatusRunning, timeout)
+	}
+}
+
+// waitForMachine blocks until the server reports the machine in state, it
+// gives up after timeout or once the machine fails.
+func waitForMachine(machineID string, state MachineStatusType, timeout time.Duration) {
+	fmt.Printf("Waiting for '%s' to be %s...\n", machineID, state)
+
+	resp, err := makeRequest("GET", fmt.Sprintf("/machines/%s/wait?state=%s&timeout=%s", machineID, state, timeout), nil)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	var machineStatusResponse MachineStatusResponse
+	if err := json.NewDecoder(resp.Body).Decode(&machineStatusResponse); err != nil {
+		fmt.Println("Error unmarshaling response:", err)
+		return
+	}
+
+	prettyPrintOutput(machineStatusResponse)
+}
+
+// readMachineConfig loads a JSON machine config, e.g.
+//
+//	{"machine_type": {"cpus": 2, "memory_mb": 512}, "ports": [{"host_port": 8080, "guest_port": 80}]}
+func readMachineConfig(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config ApiMachineConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid machine config: %v", err)
+	}
+
+	return data, nil
 }
 
 func prettyPrintOutput(v interface{}) {
@@ -59,14 +115,23 @@ func prettyPrintOutput(v interface{}) {
 }
 
 func makeRequest(method, path string, body io.Reader) (*http.Response, error) {
-	req, err := http.NewRequest(method, "http://localhost:1323"+path, body)
+	return makeRequestWithType(method, path, "application/json", body)
+}
+
+func makeRequestWithType(method, path, contentType string, body io.Reader) (*http.Response, error) {
+	config := loadConfig()
+
+	req, err := http.NewRequest(method, config.APIURL+path, body)
 	if err != nil {
 		fmt.Println("Error creating request:", err)
 		return nil, fmt.Errorf("error creating request: %v", err)
 	}
 
 	if body != nil {
-		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Type", contentType)
+	}
+	if config.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+config.APIKey)
 	}
 
 	resp, err := http.DefaultClient.Do(req)
@@ -75,7 +140,7 @@ func makeRequest(method, path string, body io.Reader) (*http.Response, error) {
 		return nil, fmt.Errorf("error making request: %v", err)
 	}
 
-	if resp.StatusCode != http.StatusOK {
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
 		defer resp.Body.Close()
 		var errResp map[string]string
 		if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil {
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/spf13/cobra"
 )
@@ -14,7 +15,28 @@ func main() {
 		Long:  `CLI to manage firecracker microVMs`,
 	}
 
-	rootCmd.AddCommand(initCmd, startCmd, stopCmd, statusCmd, listCmd, deleteCmd)
+	initCmd.Flags().Bool("wait", false, "Wait until the machine is running")
+	initCmd.Flags().Duration("wait-timeout", 60*time.Second, "How long to wait for the machine")
+
+	statsCmd.Flags().BoolP("watch", "w", false, "Keep refreshing the stats")
+	statsCmd.Flags().Duration("interval", 2*time.Second, "Refresh interval when watching")
+
+	eventsCmd.Flags().String("since", "", "Show events since a duration ago (e.g. 10m) or an RFC 3339 time")
+	eventsCmd.Flags().BoolP("follow", "f", false, "Keep streaming new events")
+	eventsCmd.Flags().String("machine", "", "Only show events of this machine")
+	eventsCmd.Flags().String("app", "", "Only show events of this app")
+	eventsCmd.Flags().String("type", "", "Only show these event types, comma separated (e.g. machine.failed,run.*)")
+
+	loginCmd.Flags().String("key", "", "API key, read from stdin if not given")
+	loginCmd.Flags().String("url", "", "URL of the quest API (default "+defaultAPIURL+")")
+	authCmd.AddCommand(loginCmd, logoutCmd)
+
+	snapshotExportCmd.Flags().StringP("output", "o", "", "File to write the archive to (default <snapshot>.tar.gz)")
+	snapshotImportCmd.Flags().String("name", "", "Name for the imported snapshot (default the name it was exported with)")
+	snapshotImportCmd.Flags().String("app", "", "App to import the snapshot into (default the app it was exported from)")
+	snapshotCmd.AddCommand(snapshotExportCmd, snapshotImportCmd)
+
+	rootCmd.AddCommand(authCmd, initCmd, startCmd, stopCmd, pauseCmd, resumeCmd, statusCmd, listCmd, deleteCmd, statsCmd, eventsCmd, snapshotCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
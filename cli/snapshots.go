@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var snapshotCmd = &cobra.Command{
+	Use:   "snapshot",
+	Short: "Move machine snapshots between hosts",
+}
+
+var snapshotExportCmd = &cobra.Command{
+	Use:   "export [snapshot]",
+	Short: "Downloads a snapshot as a compressed archive",
+	Args:  cobra.ExactArgs(1),
+	Run:   exportSnapshot,
+}
+
+var snapshotImportCmd = &cobra.Command{
+	Use:   "import [file]",
+	Short: "Uploads an exported snapshot archive",
+	Args:  cobra.ExactArgs(1),
+	Run:   importSnapshot,
+}
+
+func exportSnapshot(cmd *cobra.Command, args []string) {
+	snapshotID := args[0]
+	output, _ := cmd.Flags().GetString("output")
+	if output == "" {
+		output = snapshotID + ".tar.gz"
+	}
+
+	resp, err := makeRequest("GET", fmt.Sprintf("/snapshots/%s/export", snapshotID), nil)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	f, err := os.Create(output)
+	if err != nil {
+		fmt.Println("Error creating file:", err)
+		return
+	}
+	written, err := io.Copy(f, resp.Body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// Don't leave a truncated archive behind to be imported later
+		os.Remove(output)
+		fmt.Println("Error downloading snapshot:", err)
+		return
+	}
+
+	fmt.Printf("Exported snapshot '%s' to %s (%d bytes)\n", snapshotID, output, written)
+}
+
+func importSnapshot(cmd *cobra.Command, args []string) {
+	query := url.Values{}
+	for _, name := range []string{"name", "app"} {
+		if value, _ := cmd.Flags().GetString(name); value != "" {
+			query.Set(name, value)
+		}
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		fmt.Println("Error opening archive:", err)
+		return
+	}
+	defer f.Close()
+
+	fmt.Printf("Importing snapshot from %s...\n", args[0])
+	resp, err := makeRequestWithType("POST", "/snapshots/import?"+query.Encode(), "application/gzip", f)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	var snapshot Snapshot
+	if err := json.NewDecoder(resp.Body).Decode(&snapshot); err != nil {
+		fmt.Println("Error unmarshaling response:", err)
+		return
+	}
+
+	prettyPrintOutput(snapshot)
+}
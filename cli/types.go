@@ -2,12 +2,59 @@ package main
 
 import (
 	"net"
+	"time"
 )
 
 type ApiMachineConfig struct {
 	AppName     string         `json:"app_name"`
 	Image       string         `json:"image"`
 	MachineType ApiMachineType `json:"machine_type"`
+	Ports       []PortMapping  `json:"ports,omitempty"`
+
+	RestartPolicy *RestartPolicy     `json:"restart_policy,omitempty"`
+	HealthCheck   *HealthCheckConfig `json:"health_check,omitempty"`
+	Balloon       *BalloonConfig     `json:"balloon,omitempty"`
+	Volumes       []VolumeMount      `json:"volumes,omitempty"`
+}
+
+type VolumeMount struct {
+	Volume    string `json:"volume"`
+	MountPath string `json:"mount_path"`
+	ReadOnly  bool   `json:"read_only,omitempty"`
+	VolumeID  string `json:"volume_id,omitempty"`
+}
+
+type BalloonConfig struct {
+	AmountMib            int64 `json:"amount_mib"`
+	DeflateOnOom         bool  `json:"deflate_on_oom"`
+	StatsIntervalSeconds int64 `json:"stats_interval_seconds,omitempty"`
+}
+
+type HealthCheckConfig struct {
+	Liveness    *ProbeConfig `json:"liveness,omitempty"`
+	Readiness   *ProbeConfig `json:"readiness,omitempty"`
+	AutoRestart bool         `json:"auto_restart,omitempty"`
+}
+
+type ProbeConfig struct {
+	Type             string `json:"type"`
+	Path             string `json:"path,omitempty"`
+	Port             int    `json:"port,omitempty"`
+	Command          string `json:"command,omitempty"`
+	IntervalSeconds  int    `json:"interval_seconds,omitempty"`
+	TimeoutSeconds   int    `json:"timeout_seconds,omitempty"`
+	FailureThreshold int    `json:"failure_threshold,omitempty"`
+}
+
+type RestartPolicy struct {
+	Policy     string `json:"policy"`
+	MaxRetries int    `json:"max_retries,omitempty"`
+}
+
+type PortMapping struct {
+	HostPort  int    `json:"host_port"`
+	GuestPort int    `json:"guest_port"`
+	Protocol  string `json:"protocol,omitempty"`
 }
 
 type ApiMachineType struct {
@@ -15,12 +62,15 @@ type ApiMachineType struct {
 	Cpus     int32  `json:"cpus"`
 	GpuKind  string `json:"gpu_kind"`
 	MemoryMb int32  `json:"memory_mb"`
+
+	DiskSizeMb int32 `json:"disk_size_mb,omitempty"`
 }
 
 type CreateMachineResponse struct {
 	MachineID     string            `json:"machine_id"`
 	IP            net.IP            `json:"ip,omitempty"`
 	Status        MachineStatusType `json:"status,omitempty"`
+	Ports         []PortMapping     `json:"ports,omitempty"`
 	MachineConfig ApiMachineConfig  `json:"machine_config"`
 }
 
@@ -35,7 +85,10 @@ const (
 	StatusPending   MachineStatusType = "pending"
 	StatusRunning   MachineStatusType = "running"
 	StatusStopped   MachineStatusType = "stopped"
+	StatusPaused    MachineStatusType = "paused"
+	StatusSuspended MachineStatusType = "suspended"
 	StatusFailed    MachineStatusType = "failed"
+	StatusUnhealthy MachineStatusType = "unhealthy"
 	StatusCompleted MachineStatusType = "completed"
 )
 
@@ -60,3 +113,44 @@ type DeleteMachineResponse struct{}
 type StopMachineResponse struct{}
 
 type StartMachineResponse struct{}
+
+type MachineStats struct {
+	MachineID   string                       `json:"machine_id"`
+	CollectedAt time.Time                    `json:"collected_at"`
+	Metrics     map[string]map[string]uint64 `json:"metrics"`
+	Balloon     map[string]interface{}       `json:"balloon,omitempty"`
+	Cgroup      map[string]uint64            `json:"cgroup,omitempty"`
+}
+
+type Event struct {
+	ID        string                 `json:"id"`
+	Type      string                 `json:"type"`
+	MachineID string                 `json:"machine_id,omitempty"`
+	App       string                 `json:"app,omitempty"`
+	Time      time.Time              `json:"time"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+}
+
+type APIKey struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Scopes    []string  `json:"scopes"`
+	Apps      []string  `json:"apps,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type Snapshot struct {
+	ID                 string         `json:"id"`
+	Name               string         `json:"name"`
+	App                string         `json:"app"`
+	MachineID          string         `json:"machine_id"`
+	Image              string         `json:"image"`
+	MachineType        ApiMachineType `json:"machine_type"`
+	SizeBytes          int64          `json:"size_bytes"`
+	CreatedAt          time.Time      `json:"created_at"`
+	Arch               string         `json:"arch"`
+	CPUModel           string         `json:"cpu_model"`
+	FirecrackerVersion string         `json:"firecracker_version"`
+	Kernel             string         `json:"kernel"`
+	KernelSHA256       string         `json:"kernel_sha256"`
+}
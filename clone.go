@@ -0,0 +1,568 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/xid"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	maxCloneCount = 16
+
+	cloneNetNSDir    = "/var/run/netns"
+	cloneNetNSPrefix = "quest-"
+	cloneVethPrefix  = "qveth"
+	cloneBridgeName  = "br0"
+	cloneUplinkName  = "uplink0"
+
+	guestReaddressTimeout = 10 * time.Second
+)
+
+// CloneNetwork is the network namespace a clone's VMM runs in. A restored
+// VMM opens the tap its snapshot was taken with, so each clone gets a
+// namespace with a tap of the source's name, bridged onto the host's bridge
+// through a veth pair.
+type CloneNetwork struct {
+	NetNS   string `json:"netns"`
+	TapName string `json:"tap_name"`
+	Veth    string `json:"veth"`
+}
+
+// GuestNetworkConfig is sent to the guest agent's /network endpoint, which
+// moves the guest interface over to the address and MAC of a clone's lease.
+type GuestNetworkConfig struct {
+	Interface string `json:"interface"`
+	Address   string `json:"address"`
+	MAC       string `json:"mac"`
+	Gateway   string `json:"gateway"`
+}
+
+type CloneMachinesResponse struct {
+	SourceID string                  `json:"source_id"`
+	Machines []CreateMachineResponse `json:"machines"`
+	// Error says why fewer clones than asked for were created
+	Error string `json:"error,omitempty"`
+}
+
+// cloneMachine creates count copies of a machine, each restored from the
+// same snapshot with a network identity of its own. Host port forwards stay
+// with the source.
+func cloneMachine(c echo.Context) error {
+	sourceID := c.Param("machine_id")
+	ctx := context.Background()
+
+	count := 1
+	if value := c.QueryParam("count"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxCloneCount {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("count must be between 1 and %d", maxCloneCount)})
+		}
+		count = n
+	}
+
+	sourceInfo, err := fetchMachineInfo(ctx, sourceID)
+	if err != nil {
+		if strings.Contains(err.Error(), "machine not found") {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Machine not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+
+	if networkMode() != NetworkModeTap {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Cloning needs tap networking"})
+	}
+	sourceConfig := sourceInfo.machineConfig()
+	// Clones would share the volumes' filesystems with the source
+	if len(sourceConfig.Volumes) > 0 {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Machines with volumes can't be cloned"})
+	}
+	// Outside a jail the vsock socket of a snapshot has an absolute path,
+	// which the source is still listening on
+	if jailer == nil && usesVsockProbe(&sourceConfig) {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Cloning machines with a vsock probe needs the jailer"})
+	}
+	switch MachineStatusType(sourceInfo.Status) {
+	case StatusRunning, StatusUnhealthy, StatusPaused, StatusSuspended:
+	default:
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Only running, paused or suspended machines can be cloned"})
+	}
+
+	// Not below the source's own snapshot directory, which goes away when
+	// the source is suspended or woken while clones are still restoring
+	capture, err := captureMachine(ctx, sourceID, snapshotDir("clone-"+xid.New().String()))
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to snapshot machine")
+	}
+	// VMMs restored from the capture keep their private mappings of the
+	// memory file after it is gone
+	defer capture.remove()
+
+	response := CloneMachinesResponse{SourceID: sourceID}
+	for i := 0; i < count; i++ {
+		machineConfig := sourceConfig
+		machineConfig.Ports = nil
+
+		vm, err := createClone(ctx, &machineConfig, capture)
+		if err != nil {
+			var admissionErr *AdmissionError
+			if len(response.Machines) == 0 {
+				if errors.As(err, &admissionErr) {
+					return c.JSON(admissionErr.StatusCode, map[string]string{"error": admissionErr.Reason})
+				}
+				return handleError(c, err, http.StatusInternalServerError, "Failed to clone machine")
+			}
+
+			log.WithError(err).Errorf("failed to clone machine %s", sourceID)
+			response.Error = "Failed to clone machine"
+			if errors.As(err, &admissionErr) {
+				response.Error = admissionErr.Reason
+			}
+			break
+		}
+
+		response.Machines = append(response.Machines, CreateMachineResponse{
+			MachineID:     vm.vmmID,
+			IP:            vm.ip,
+			MachineConfig: machineConfig,
+		})
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+// createClone registers a new machine and restores it from a capture of
+// another one.
+func createClone(ctx context.Context, machineConfig *ApiMachineConfig, capture *capturedMachine) (*runningFirecracker, error) {
+	reservation, err := admitMachine(ctx, machineConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	vmmID := xid.New().String()
+	if err := registerMachine(ctx, vmmID, machineConfig.AppName); err != nil {
+		release(ctx, machineChecks(machineConfig.AppName, AppQuota{}, *reservation))
+		return nil, err
+	}
+
+	err = updateMachineInfo(ctx, vmmID, func(info *MachineInfo) {
+		info.Status = string(StatusPending)
+		info.Config = machineConfig
+		info.Reservation = reservation
+		info.ClonedFrom = capture.sourceID
+	})
+	if err != nil {
+		log.WithError(err).Error("failed to store machine info in Redis")
+	}
+
+	data := map[string]interface{}{
+		"image":        machineConfig.Image,
+		"machine_type": machineConfig.MachineType,
+		"cloned_from":  capture.sourceID,
+	}
+	if machineConfig.FromSnapshot != "" {
+		data["from_snapshot"] = machineConfig.FromSnapshot
+	}
+	emitEvent(Event{
+		Type:      EventMachineCreated,
+		MachineID: vmmID,
+		App:       machineConfig.AppName,
+		Data:      data,
+	})
+
+	vm, err := restoreClone(ctx, vmmID, machineConfig, capture)
+	if err != nil {
+		log.WithError(err).Errorf("failed to restore clone %s of machine %s", vmmID, capture.sourceID)
+		updateMachineStatus(ctx, vmmID, StatusFailed)
+		releaseMachine(ctx, vmmID)
+		return nil, err
+	}
+
+	if err := initializeVM(ctx, vm, machineConfig); err != nil {
+		return nil, err
+	}
+
+	log.Infof("Cloned machine %s into %s", capture.sourceID, vmmID)
+	return vm, nil
+}
+
+func restoreClone(ctx context.Context, vmmID string, machineConfig *ApiMachineConfig, capture *capturedMachine) (*runningFirecracker, error) {
+	if err := cloneFile(capture.rootFS, getRootFSPath(vmmID)); err != nil {
+		return nil, fmt.Errorf("failed to copy rootfs: %v", err)
+	}
+
+	owner, err := tapOwner(ctx, vmmID)
+	if err != nil {
+		return nil, err
+	}
+	lease, err := ipam.Allocate(ctx, vmmID)
+	if err != nil {
+		return nil, err
+	}
+	network, err := setupCloneNetwork(vmmID, capture.tapName, lease, owner)
+	if err != nil {
+		if releaseErr := ipam.Release(ctx, vmmID); releaseErr != nil {
+			log.WithError(releaseErr).Errorf("failed to release lease for machine %s", vmmID)
+		}
+		return nil, err
+	}
+	teardown := func() {
+		teardownCloneNetwork(network)
+		if err := ipam.Release(ctx, vmmID); err != nil {
+			log.WithError(err).Errorf("failed to release lease for machine %s", vmmID)
+		}
+	}
+
+	err = updateMachineInfo(ctx, vmmID, func(info *MachineInfo) {
+		info.CloneNetwork = network
+	})
+	if err != nil {
+		teardown()
+		return nil, err
+	}
+
+	snapshot := *capture.snapshot
+	snapshot.NetNS = network.NetNS
+	vm, err := bootVM(ctx, vmmID, machineConfig, cloneInterface(lease, network), lease, &snapshot)
+	if err != nil {
+		teardown()
+		return nil, err
+	}
+
+	if err := readdressClone(ctx, network, capture.sourceIP, lease); err != nil {
+		vm.requestStop()
+		if stopErr := vm.stopVMM(); stopErr != nil {
+			log.WithError(stopErr).Errorf("failed to stop VMM for machine %s", vmmID)
+		}
+		vm.vmmCancel()
+		teardown()
+		return nil, fmt.Errorf("failed to give the clone its own address: %v", err)
+	}
+
+	return vm, nil
+}
+
+// cloneFile copies src to dst. Where the filesystem supports reflinks the
+// copy shares its blocks with src until either is written to, elsewhere holes
+// stay holes.
+func cloneFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if err := unix.IoctlFileClone(int(out.Fd()), int(in.Fd())); err == nil {
+		return nil
+	}
+	return copySparse(out, in)
+}
+
+func cloneInterface(lease *Lease, network *CloneNetwork) firecracker.NetworkInterface {
+	return firecracker.NetworkInterface{
+		StaticConfiguration: &firecracker.StaticNetworkConfiguration{
+			MacAddress:  lease.MAC,
+			HostDevName: network.TapName,
+			IPConfiguration: &firecracker.IPConfiguration{
+				IPAddr: net.IPNet{
+					IP:   lease.IP,
+					Mask: ipam.Subnet().Mask,
+				},
+				Gateway: ipam.Gateway(),
+				IfName:  guestIfName,
+			},
+		},
+	}
+}
+
+// cloneNetworkInterface is setupNetworkInterface for a clone restored into
+// its namespace again.
+func cloneNetworkInterface(ctx context.Context, machineID string, network *CloneNetwork) (firecracker.NetworkInterface, *Lease, error) {
+	lease, err := ipam.LeaseFor(ctx, machineID)
+	if err != nil {
+		return firecracker.NetworkInterface{}, nil, err
+	}
+	if lease == nil {
+		return firecracker.NetworkInterface{}, nil, fmt.Errorf("machine %s has no lease", machineID)
+	}
+	return cloneInterface(lease, network), lease, nil
+}
+
+// setupCloneNetwork creates the namespace of a clone: the tap, owned by the
+// uid the VMM runs as, a bridge and one end of a veth pair inside, the other
+// end on the host's bridge. The host end stays down until readdressClone
+// moved the guest off the source's address.
+func setupCloneNetwork(machineID, tap string, lease *Lease, owner uint32) (*CloneNetwork, error) {
+	hostBridge, err := netlink.LinkByName(bridgeName())
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up bridge %s: %v", bridgeName(), err)
+	}
+
+	name := cloneNetNSPrefix + machineID
+	network := &CloneNetwork{
+		NetNS:   filepath.Join(cloneNetNSDir, name),
+		TapName: tap,
+		Veth:    fmt.Sprintf("%s%08x", cloneVethPrefix, ipToUint32(lease.IP)),
+	}
+
+	if err := createNetNS(name); err != nil {
+		return nil, fmt.Errorf("failed to create network namespace: %v", err)
+	}
+
+	err = inNetNS(network.NetNS, func(host netns.NsHandle) error {
+		// The namespace only switches frames. Without IPv6 its bridge stays
+		// quiet while it borrows the host bridge's MAC. Hosts without IPv6
+		// don't have the files.
+		for _, conf := range []string{"all", "default"} {
+			os.WriteFile(filepath.Join("/proc/sys/net/ipv6/conf", conf, "disable_ipv6"), []byte("1"), 0644)
+		}
+
+		if lo, err := netlink.LinkByName("lo"); err == nil {
+			netlink.LinkSetUp(lo)
+		}
+
+		bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: cloneBridgeName}}
+		if err := netlink.LinkAdd(bridge); err != nil {
+			return err
+		}
+
+		attrs := netlink.NewLinkAttrs()
+		attrs.Name = tap
+		attrs.MasterIndex = bridge.Attrs().Index
+		tapLink := &netlink.Tuntap{LinkAttrs: attrs, Mode: netlink.TUNTAP_MODE_TAP, Owner: owner, Group: owner}
+		if err := netlink.LinkAdd(tapLink); err != nil {
+			return fmt.Errorf("failed to create tap %s: %v", tap, err)
+		}
+		for _, fd := range tapLink.Fds {
+			fd.Close()
+		}
+
+		veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: network.Veth}, PeerName: cloneUplinkName}
+		if err := netlink.LinkAdd(veth); err != nil {
+			return err
+		}
+		uplink, err := netlink.LinkByName(cloneUplinkName)
+		if err != nil {
+			return err
+		}
+		if err := netlink.LinkSetMaster(uplink, bridge); err != nil {
+			return err
+		}
+		for _, link := range []netlink.Link{tapLink, uplink, bridge} {
+			if err := netlink.LinkSetUp(link); err != nil {
+				return err
+			}
+		}
+
+		return netlink.LinkSetNsFd(veth, int(host))
+	})
+	if err != nil {
+		teardownCloneNetwork(network)
+		return nil, err
+	}
+
+	hostVeth, err := netlink.LinkByName(network.Veth)
+	if err == nil {
+		err = netlink.LinkSetMaster(hostVeth, hostBridge)
+	}
+	if err != nil {
+		teardownCloneNetwork(network)
+		return nil, err
+	}
+
+	return network, nil
+}
+
+// readdressClone tells the guest agent of a fresh clone to take on the
+// clone's lease. Until then the guest still uses the source's address, so
+// it's reached from inside the namespace, whose bridge stands in for the
+// gateway with the host bridge's MAC, which the guest has cached.
+func readdressClone(ctx context.Context, network *CloneNetwork, sourceIP net.IP, lease *Lease) error {
+	hostBridge, err := netlink.LinkByName(bridgeName())
+	if err != nil {
+		return err
+	}
+	gateway := &netlink.Addr{IPNet: &net.IPNet{IP: ipam.Gateway(), Mask: ipam.Subnet().Mask}}
+
+	err = inNetNS(network.NetNS, func(netns.NsHandle) error {
+		bridge, err := netlink.LinkByName(cloneBridgeName)
+		if err != nil {
+			return err
+		}
+		if err := netlink.LinkSetHardwareAddr(bridge, hostBridge.Attrs().HardwareAddr); err != nil {
+			return err
+		}
+		return netlink.AddrAdd(bridge, gateway)
+	})
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(GuestNetworkConfig{
+		Interface: guestIfName,
+		Address:   (&net.IPNet{IP: lease.IP, Mask: ipam.Subnet().Mask}).String(),
+		MAC:       lease.MAC,
+		Gateway:   ipam.Gateway().String(),
+	})
+	if err != nil {
+		return err
+	}
+
+	nsClient := &http.Client{
+		Timeout: guestReaddressTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, proto, addr string) (net.Conn, error) {
+				var conn net.Conn
+				err := inNetNS(network.NetNS, func(netns.NsHandle) error {
+					var err error
+					conn, err = (&net.Dialer{}).DialContext(ctx, proto, addr)
+					return err
+				})
+				return conn, err
+			},
+		},
+	}
+
+	url := fmt.Sprintf("http://%s:%d/network", sourceIP, AgentPort)
+	resp, err := nsClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("guest agent answered %s", resp.Status)
+	}
+
+	// Give the gateway back before the namespace joins the host's bridge
+	err = inNetNS(network.NetNS, func(netns.NsHandle) error {
+		bridge, err := netlink.LinkByName(cloneBridgeName)
+		if err != nil {
+			return err
+		}
+		if err := netlink.AddrDel(bridge, gateway); err != nil {
+			return err
+		}
+		uplink, err := netlink.LinkByName(cloneUplinkName)
+		if err != nil {
+			return err
+		}
+		return netlink.LinkSetHardwareAddr(bridge, uplink.Attrs().HardwareAddr)
+	})
+	if err != nil {
+		return err
+	}
+
+	hostVeth, err := netlink.LinkByName(network.Veth)
+	if err != nil {
+		return err
+	}
+	return netlink.LinkSetUp(hostVeth)
+}
+
+// teardownCloneNetwork deletes the namespace of a clone, and with it the tap
+// and the other end of the veth pair.
+func teardownCloneNetwork(network *CloneNetwork) {
+	if err := deleteTap(network.Veth); err != nil {
+		log.WithError(err).Errorf("failed to delete veth %s", network.Veth)
+	}
+	if err := netns.DeleteNamed(filepath.Base(network.NetNS)); err != nil && !os.IsNotExist(err) {
+		log.WithError(err).Errorf("failed to delete network namespace %s", network.NetNS)
+	}
+}
+
+// dropCloneNetwork switches a clone over to a plain tap, for when its VMM is
+// booted from scratch rather than restored.
+func dropCloneNetwork(ctx context.Context, machineID string) {
+	info, err := fetchMachineInfo(ctx, machineID)
+	if err != nil || info.CloneNetwork == nil {
+		return
+	}
+
+	teardownCloneNetwork(info.CloneNetwork)
+	err = updateMachineInfo(ctx, machineID, func(info *MachineInfo) {
+		info.CloneNetwork = nil
+	})
+	if err != nil {
+		log.WithError(err).Errorf("failed to clear clone network of machine %s", machineID)
+	}
+}
+
+// createNetNS adds a named network namespace like `ip netns add`.
+func createNetNS(name string) error {
+	runtime.LockOSThread()
+
+	host, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer host.Close()
+
+	// NewNamed moves the thread into the new namespace
+	created, err := netns.NewNamed(name)
+	if err == nil {
+		created.Close()
+	}
+	if setErr := netns.Set(host); setErr != nil {
+		return setErr
+	}
+	runtime.UnlockOSThread()
+	return err
+}
+
+// inNetNS runs fn on a thread inside the namespace at path. fn gets the
+// host's namespace to move links back out.
+func inNetNS(path string, fn func(host netns.NsHandle) error) error {
+	runtime.LockOSThread()
+
+	host, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer host.Close()
+
+	target, err := netns.GetFromPath(path)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer target.Close()
+
+	if err := netns.Set(target); err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer func() {
+		// A thread that can't get back stays locked and dies with the
+		// goroutine instead of running other code in the wrong namespace
+		if netns.Set(host) == nil {
+			runtime.UnlockOSThread()
+		}
+	}()
+
+	return fn(host)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+const maxDiskSizeMB = 1024 * 1024
+
+type DiskResizeRequest struct {
+	SizeMb int64 `json:"size_mb"`
+}
+
+type DiskResponse struct {
+	MachineID string `json:"machine_id"`
+	SizeMb    int64  `json:"size_mb"`
+}
+
+// validateDiskSize checks a machine type's disk_size_mb. Zero keeps the
+// rootfs at the size of the image.
+func validateDiskSize(diskSizeMb int64) error {
+	if diskSizeMb == 0 {
+		return nil
+	}
+	if diskSizeMb < 0 || diskSizeMb > maxDiskSizeMB {
+		return fmt.Errorf("disk_size_mb must be between 1 and %d", maxDiskSizeMB)
+	}
+
+	imageMb, err := imageSizeMB()
+	if err != nil {
+		return fmt.Errorf("failed to read the image size: %v", err)
+	}
+	if diskSizeMb < imageMb {
+		return fmt.Errorf("disk_size_mb must be at least the image's %d MiB", imageMb)
+	}
+	return nil
+}
+
+// growRootFS extends a rootfs file to sizeMb and its filesystem with it. The
+// file grows sparse, the new space costs nothing on the host until the guest
+// writes to it. Filesystems are never shrunk. The guest must not be running.
+func growRootFS(path string, sizeMb int64) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	size := sizeMb << 20
+	if info.Size() >= size {
+		return nil
+	}
+
+	if err := os.Truncate(path, size); err != nil {
+		return err
+	}
+
+	// resize2fs refuses to work offline on a filesystem that hasn't just
+	// been checked. e2fsck exits with 1 when it fixed something.
+	out, err := exec.Command("e2fsck", "-f", "-p", path).CombinedOutput()
+	var exitErr *exec.ExitError
+	if err != nil && !(errors.As(err, &exitErr) && exitErr.ExitCode() == 1) {
+		return fmt.Errorf("e2fsck failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	if out, err := exec.Command("resize2fs", path).CombinedOutput(); err != nil {
+		return fmt.Errorf("resize2fs failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// copySparse copies src to dst without writing out its holes, so a copy of a
+// mostly empty disk stays mostly empty.
+func copySparse(dst, src *os.File) error {
+	extents, size, err := dataExtents(src)
+	if err != nil {
+		return err
+	}
+	for _, extent := range extents {
+		if _, err := io.Copy(io.NewOffsetWriter(dst, extent.Offset), io.NewSectionReader(src, extent.Offset, extent.Length)); err != nil {
+			return err
+		}
+	}
+	return dst.Truncate(size)
+}
+
+// resizeMachineDisk grows the rootfs of a stopped machine. The new size
+// becomes the machine type's disk_size_mb and is kept across restarts.
+func resizeMachineDisk(c echo.Context) error {
+	machineID := c.Param("machine_id")
+	ctx := context.Background()
+
+	var req DiskResizeRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	if req.SizeMb <= 0 || req.SizeMb > maxDiskSizeMB {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("size_mb must be between 1 and %d", maxDiskSizeMB)})
+	}
+
+	unlock := lockMachine(machineID)
+	defer unlock()
+
+	machineInfo, err := fetchMachineInfo(ctx, machineID)
+	if err != nil {
+		if strings.Contains(err.Error(), "machine not found") {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Machine not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+	if MachineStatusType(machineInfo.Status) != StatusStopped {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Only stopped machines can have their disk resized"})
+	}
+	// Stopping asks the guest to shut down, the VMM may not have exited yet
+	if machineInfo.PID != 0 && isFirecrackerProcess(machineInfo.PID, machineInfo.SocketPath) {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Machine is still shutting down"})
+	}
+
+	path := getRootFSPath(machineID)
+	info, err := os.Stat(path)
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to read disk")
+	}
+	currentMb := (info.Size() + 1<<20 - 1) >> 20
+	if req.SizeMb < currentMb {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("Disks can only grow, it's %d MiB already", currentMb)})
+	}
+
+	// What the disk grows by counts against the app's disk quota. Machines
+	// from before quotas weren't counted at all and are admitted now.
+	machineConfig := machineInfo.machineConfig()
+	quota, err := appQuota(ctx, machineConfig.AppName)
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to fetch quota")
+	}
+	var reservation *Reservation
+	var checks []usageCheck
+	if machineInfo.Reservation == nil {
+		reservation = &Reservation{
+			Host:     currentHost(),
+			Vcpus:    machineConfig.MachineType.Cpus,
+			MemoryMb: machineConfig.MachineType.MemoryMb,
+			DiskMb:   req.SizeMb,
+		}
+		checks = machineChecks(machineConfig.AppName, quota, *reservation)
+	} else if req.SizeMb > machineInfo.Reservation.DiskMb {
+		grown := *machineInfo.Reservation
+		// Reservations from before hosts were recorded were all made here
+		if grown.Host == "" {
+			grown.Host = currentHost()
+		}
+		checks = diskChecks(machineConfig.AppName, quota, grown.Host, req.SizeMb-grown.DiskMb)
+		grown.DiskMb = req.SizeMb
+		reservation = &grown
+	}
+	if len(checks) > 0 {
+		if err := reserve(ctx, checks); err != nil {
+			var admissionErr *AdmissionError
+			if errors.As(err, &admissionErr) {
+				return c.JSON(admissionErr.StatusCode, map[string]string{"error": admissionErr.Reason})
+			}
+			return handleError(c, err, http.StatusInternalServerError, "Failed to reserve disk")
+		}
+	}
+
+	if err := growRootFS(path, req.SizeMb); err != nil {
+		release(ctx, checks)
+		return handleError(c, err, http.StatusInternalServerError, "Failed to resize disk")
+	}
+
+	err = updateMachineInfo(ctx, machineID, func(info *MachineInfo) {
+		if info.Config == nil {
+			machineConfig := info.machineConfig()
+			info.Config = &machineConfig
+		}
+		info.Config.MachineType.DiskSizeMb = req.SizeMb
+		if reservation != nil {
+			info.Reservation = reservation
+		}
+	})
+	if err != nil {
+		release(ctx, checks)
+		return handleError(c, err, http.StatusInternalServerError, "Failed to store disk size")
+	}
+
+	return c.JSON(http.StatusOK, DiskResponse{MachineID: machineID, SizeMb: req.SizeMb})
+}
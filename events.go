@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	EventMachineCreated   = "machine.created"
+	EventMachineBooted    = "machine.booted"
+	EventMachineHealthy   = "machine.healthy"
+	EventMachineUnhealthy = "machine.unhealthy"
+	EventMachineStopped   = "machine.stopped"
+	EventMachineFailed    = "machine.failed"
+	EventMachineDeleted   = "machine.deleted"
+	EventMachineExited    = "machine.exited"
+	EventMachineRestarted = "machine.restarted"
+	EventMachinePaused    = "machine.paused"
+	EventMachineResumed   = "machine.resumed"
+	EventMachineSuspended = "machine.suspended"
+	EventMachineWoken     = "machine.woken"
+	EventRunStarted       = "run.started"
+	EventRunFinished      = "run.finished"
+
+	EventsRetentionEnvVar = "EVENTS_RETENTION"
+
+	eventsKey               = "events"
+	defaultEventsRetention  = 24 * time.Hour
+	eventsReplayBatch       = 100
+	eventsKeepaliveInterval = 15 * time.Second
+)
+
+// statusEvents are the events recorded when a machine's status changes to
+// the given one. Pending is covered by created and restarted.
+var statusEvents = map[MachineStatusType]string{
+	StatusRunning:   EventMachineHealthy,
+	StatusUnhealthy: EventMachineUnhealthy,
+	StatusStopped:   EventMachineStopped,
+	StatusFailed:    EventMachineFailed,
+	StatusPaused:    EventMachinePaused,
+	StatusSuspended: EventMachineSuspended,
+}
+
+type Event struct {
+	ID        string                 `json:"id"`
+	Type      string                 `json:"type"`
+	MachineID string                 `json:"machine_id,omitempty"`
+	App       string                 `json:"app,omitempty"`
+	Time      time.Time              `json:"time"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+}
+
+// EventFilter selects events by machine, app and type. Empty fields match
+// everything; a type ending in "*" matches by prefix, e.g. "run.*". Apps
+// limits events to the apps a caller can see.
+type EventFilter struct {
+	MachineID string
+	App       string
+	Apps      []string
+	Types     []string
+}
+
+func (filter EventFilter) matches(event *Event) bool {
+	if filter.MachineID != "" && filter.MachineID != event.MachineID {
+		return false
+	}
+	if filter.App != "" && filter.App != event.App {
+		return false
+	}
+	if len(filter.Apps) > 0 && !containsString(filter.Apps, event.App) {
+		return false
+	}
+	if len(filter.Types) == 0 {
+		return true
+	}
+	for _, t := range filter.Types {
+		if t == event.Type || (strings.HasSuffix(t, "*") && strings.HasPrefix(event.Type, strings.TrimSuffix(t, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+func eventsRetention() time.Duration {
+	if value := os.Getenv(EventsRetentionEnvVar); value != "" {
+		if retention, err := time.ParseDuration(value); err == nil && retention > 0 {
+			return retention
+		}
+		log.Warnf("invalid %s %q, using %s", EventsRetentionEnvVar, value, defaultEventsRetention)
+	}
+	return defaultEventsRetention
+}
+
+// emitEvent appends an event to the event stream and hands it to the
+// webhooks. The stream ID doubles as the event ID, and entries older than the
+// retention window are trimmed as new ones come in.
+func emitEvent(event Event) {
+	event.Time = time.Now().UTC()
+
+	log.WithFields(log.Fields(event.Data)).WithFields(log.Fields{
+		"event":      event.Type,
+		"machine_id": event.MachineID,
+	}).Info("machine event")
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.WithError(err).Errorf("failed to marshal %s event", event.Type)
+		return
+	}
+
+	minID := fmt.Sprintf("%d-0", event.Time.Add(-eventsRetention()).UnixMilli())
+	id, err := rdb.XAdd(context.Background(), &redis.XAddArgs{
+		Stream: eventsKey,
+		MinID:  minID,
+		Approx: true,
+		Values: map[string]interface{}{"event": data},
+	}).Result()
+	if err != nil {
+		log.WithError(err).Errorf("failed to record %s event of machine %s", event.Type, event.MachineID)
+	}
+	event.ID = id
+
+	dispatchWebhooks(event)
+}
+
+// emitStatusEvent records a status transition of a machine, if it's one
+// clients care about.
+func emitStatusEvent(machineID, previous string, info *MachineInfo) {
+	eventType, ok := statusEvents[MachineStatusType(info.Status)]
+	if !ok {
+		return
+	}
+	if MachineStatusType(info.Status) == StatusRunning {
+		switch MachineStatusType(previous) {
+		case StatusPaused:
+			eventType = EventMachineResumed
+		case StatusSuspended:
+			eventType = EventMachineWoken
+		}
+	}
+
+	data := map[string]interface{}{
+		"status":          info.Status,
+		"previous_status": previous,
+	}
+	if info.IP != "" {
+		data["ip"] = info.IP
+	}
+
+	emitEvent(Event{
+		Type:      eventType,
+		MachineID: machineID,
+		App:       info.machineConfig().AppName,
+		Data:      data,
+	})
+}
+
+func decodeEvent(message redis.XMessage) (*Event, error) {
+	raw, ok := message.Values["event"].(string)
+	if !ok {
+		return nil, fmt.Errorf("event %s has no payload", message.ID)
+	}
+
+	var event Event
+	if err := json.Unmarshal([]byte(raw), &event); err != nil {
+		return nil, err
+	}
+	event.ID = message.ID
+	return &event, nil
+}
+
+// parseSince accepts either a duration back from now ("10m") or an RFC 3339
+// timestamp.
+func parseSince(value string) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid since %q, expected a duration like 10m or an RFC 3339 timestamp", value)
+}
+
+func writeSSE(c echo.Context, event *Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(c.Response(), "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data); err != nil {
+		return err
+	}
+	c.Response().Flush()
+	return nil
+}
+
+// streamEvents serves the event stream as server-sent events. Stored events
+// from ?since (or after the Last-Event-ID of a reconnecting client) are
+// replayed first, then new ones are streamed until the client goes away,
+// unless ?follow=false.
+func streamEvents(c echo.Context) error {
+	filter := EventFilter{
+		MachineID: c.QueryParam("machine"),
+		App:       c.QueryParam("app"),
+		Apps:      callerKey(c).Apps,
+	}
+	if types := c.QueryParam("type"); types != "" {
+		filter.Types = strings.Split(types, ",")
+	}
+
+	follow := true
+	if value := c.QueryParam("follow"); value != "" {
+		var err error
+		if follow, err = strconv.ParseBool(value); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "follow must be true or false"})
+		}
+	}
+
+	lastID := ""
+	if id := c.Request().Header.Get("Last-Event-ID"); id != "" {
+		lastID = "(" + id
+	} else if since := c.QueryParam("since"); since != "" {
+		t, err := parseSince(since)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		lastID = strconv.FormatInt(t.UnixMilli(), 10)
+	}
+
+	ctx := c.Request().Context()
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set(echo.HeaderCacheControl, "no-cache")
+	res.Header().Set(echo.HeaderConnection, "keep-alive")
+	res.WriteHeader(http.StatusOK)
+	res.Flush()
+
+	if lastID != "" {
+		for {
+			messages, err := rdb.XRangeN(ctx, eventsKey, lastID, "+", eventsReplayBatch).Result()
+			if err != nil {
+				log.WithError(err).Error("failed to read stored events")
+				return nil
+			}
+			for _, message := range messages {
+				lastID = "(" + message.ID
+				event, err := decodeEvent(message)
+				if err != nil {
+					log.WithError(err).Warnf("skipping unreadable event %s", message.ID)
+					continue
+				}
+				if filter.matches(event) {
+					if err := writeSSE(c, event); err != nil {
+						return nil
+					}
+				}
+			}
+			if len(messages) < eventsReplayBatch {
+				break
+			}
+		}
+		// XREAD continues after an ID, it doesn't take the exclusive form
+		lastID = strings.TrimPrefix(lastID, "(")
+	}
+
+	if !follow {
+		return nil
+	}
+
+	if lastID == "" {
+		// Start at the current end of the stream. "$" would skip whatever is
+		// added while a keepalive is being written.
+		latest, err := rdb.XRevRangeN(ctx, eventsKey, "+", "-", 1).Result()
+		if err != nil {
+			log.WithError(err).Error("failed to read stored events")
+			return nil
+		}
+		lastID = "0-0"
+		if len(latest) > 0 {
+			lastID = latest[0].ID
+		}
+	}
+
+	for ctx.Err() == nil {
+		streams, err := rdb.XRead(ctx, &redis.XReadArgs{
+			Streams: []string{eventsKey, lastID},
+			Block:   eventsKeepaliveInterval,
+		}).Result()
+		if err == redis.Nil {
+			if _, err := fmt.Fprint(res, ": keepalive\n\n"); err != nil {
+				return nil
+			}
+			res.Flush()
+			continue
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				log.WithError(err).Error("failed to read events")
+			}
+			return nil
+		}
+
+		for _, stream := range streams {
+			for _, message := range stream.Messages {
+				lastID = message.ID
+				event, err := decodeEvent(message)
+				if err != nil {
+					log.WithError(err).Warnf("skipping unreadable event %s", message.ID)
+					continue
+				}
+				if filter.matches(event) {
+					if err := writeSSE(c, event); err != nil {
+						return nil
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
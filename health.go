@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ProbeHTTP  = "http"
+	ProbeTCP   = "tcp"
+	ProbeVsock = "vsock"
+	ProbeExec  = "exec"
+
+	ProbeLiveness  = "liveness"
+	ProbeReadiness = "readiness"
+
+	AgentPort = 8081
+
+	healthHistoryLength = 100
+	vsockGuestCID       = 3
+)
+
+type HealthCheckResult struct {
+	Time       time.Time `json:"time"`
+	Probe      string    `json:"probe"`
+	Type       string    `json:"type"`
+	Healthy    bool      `json:"healthy"`
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"duration_ms"`
+}
+
+type ProbeStatus struct {
+	Config              ProbeConfig        `json:"config"`
+	ConsecutiveFailures int                `json:"consecutive_failures"`
+	LastResult          *HealthCheckResult `json:"last_result,omitempty"`
+}
+
+type MachineHealthResponse struct {
+	MachineID string              `json:"machine_id"`
+	Status    MachineStatusType   `json:"status"`
+	Liveness  ProbeStatus         `json:"liveness"`
+	Readiness ProbeStatus         `json:"readiness"`
+	History   []HealthCheckResult `json:"history"`
+}
+
+func healthKey(machineID string) string {
+	return "health:" + machineID
+}
+
+func defaultReadinessProbe() ProbeConfig {
+	return ProbeConfig{
+		Type:             ProbeHTTP,
+		Path:             "/health",
+		Port:             AgentPort,
+		IntervalSeconds:  int(HealthCheckInterval / time.Second),
+		TimeoutSeconds:   2,
+		FailureThreshold: 3,
+	}
+}
+
+func defaultLivenessProbe() ProbeConfig {
+	probe := defaultReadinessProbe()
+	probe.IntervalSeconds = 10
+	return probe
+}
+
+// probesFor fills in the defaults for anything the machine config leaves out.
+func probesFor(machineConfig *ApiMachineConfig) (liveness, readiness ProbeConfig) {
+	liveness, readiness = defaultLivenessProbe(), defaultReadinessProbe()
+	if hc := machineConfig.HealthCheck; hc != nil {
+		if hc.Liveness != nil {
+			liveness = withProbeDefaults(*hc.Liveness)
+		}
+		if hc.Readiness != nil {
+			readiness = withProbeDefaults(*hc.Readiness)
+		}
+	}
+	return liveness, readiness
+}
+
+func withProbeDefaults(probe ProbeConfig) ProbeConfig {
+	defaults := defaultReadinessProbe()
+	if probe.Type == "" {
+		probe.Type = defaults.Type
+	}
+	if probe.Type == ProbeHTTP && probe.Path == "" {
+		probe.Path = defaults.Path
+	}
+	if probe.Port == 0 && probe.Type != ProbeExec {
+		probe.Port = defaults.Port
+	}
+	if probe.IntervalSeconds <= 0 {
+		probe.IntervalSeconds = defaults.IntervalSeconds
+	}
+	if probe.TimeoutSeconds <= 0 {
+		probe.TimeoutSeconds = defaults.TimeoutSeconds
+	}
+	if probe.FailureThreshold <= 0 {
+		probe.FailureThreshold = defaults.FailureThreshold
+	}
+	return probe
+}
+
+func validateHealthCheck(hc *HealthCheckConfig) error {
+	if hc == nil {
+		return nil
+	}
+
+	for name, probe := range map[string]*ProbeConfig{ProbeLiveness: hc.Liveness, ProbeReadiness: hc.Readiness} {
+		if probe == nil {
+			continue
+		}
+		switch probe.Type {
+		case "", ProbeHTTP, ProbeTCP, ProbeVsock:
+		case ProbeExec:
+			if probe.Command == "" {
+				return fmt.Errorf("%s probe of type exec needs a command", name)
+			}
+		default:
+			return fmt.Errorf("unsupported %s probe type %q, expected http, tcp, vsock or exec", name, probe.Type)
+		}
+		if probe.Port < 0 || probe.Port > 65535 {
+			return fmt.Errorf("invalid %s probe port %d", name, probe.Port)
+		}
+	}
+	return nil
+}
+
+func usesVsockProbe(machineConfig *ApiMachineConfig) bool {
+	liveness, readiness := probesFor(machineConfig)
+	return liveness.Type == ProbeVsock || readiness.Type == ProbeVsock
+}
+
+// monitorMachineHealth waits for the machine to become ready and then keeps
+// probing it for as long as this VMM is the one managed for the machine.
+func monitorMachineHealth(vm *runningFirecracker, machineConfig *ApiMachineConfig) {
+	ctx := vm.vmmCtx
+	liveness, readiness := probesFor(machineConfig)
+
+	if !waitUntilReady(vm, readiness) {
+		log.Errorf("Machine %s failed to become healthy after retries", vm.vmmID)
+		updateMachineStatus(ctx, vm.vmmID, StatusFailed)
+		return
+	}
+
+	log.Infof("Machine %s is healthy", vm.vmmID)
+	updateMachineStatus(ctx, vm.vmmID, StatusRunning, vm.ip)
+	if !vm.startedAt.IsZero() {
+		observeSince(machineReadyDuration.WithLabelValues(imageLabel(machineConfig.Image), machineTypeLabel(machineConfig.MachineType)), vm.startedAt)
+	}
+
+	livenessTicker := time.NewTicker(time.Duration(liveness.IntervalSeconds) * time.Second)
+	defer livenessTicker.Stop()
+	readinessTicker := time.NewTicker(time.Duration(readiness.IntervalSeconds) * time.Second)
+	defer readinessTicker.Stop()
+
+	// Either probe can mark the machine unhealthy, it's running again only
+	// once neither is over its threshold
+	livenessFailures, readinessFailures := 0, 0
+	unhealthy := false
+	checkRecovered := func() {
+		if unhealthy && livenessFailures < liveness.FailureThreshold && readinessFailures < readiness.FailureThreshold {
+			log.Infof("Machine %s is healthy again", vm.vmmID)
+			updateMachineStatus(ctx, vm.vmmID, StatusRunning)
+			unhealthy = false
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-livenessTicker.C:
+			if !fcManager.IsCurrent(vm) || vm.stopRequested() {
+				return
+			}
+			if !shouldProbe(vm) {
+				continue
+			}
+
+			if runProbe(vm, ProbeLiveness, liveness) {
+				livenessFailures = 0
+				checkRecovered()
+				continue
+			}
+
+			livenessFailures++
+			if livenessFailures != liveness.FailureThreshold {
+				continue
+			}
+
+			log.Warnf("Machine %s failed %d liveness probes in a row", vm.vmmID, livenessFailures)
+			if machineConfig.HealthCheck != nil && machineConfig.HealthCheck.AutoRestart {
+				restartUnhealthyVM(vm, machineConfig)
+				return
+			}
+			updateMachineStatus(ctx, vm.vmmID, StatusUnhealthy)
+			unhealthy = true
+		case <-readinessTicker.C:
+			if !shouldProbe(vm) {
+				continue
+			}
+
+			if runProbe(vm, ProbeReadiness, readiness) {
+				readinessFailures = 0
+				checkRecovered()
+				continue
+			}
+
+			readinessFailures++
+			if readinessFailures == readiness.FailureThreshold {
+				log.Warnf("Machine %s failed %d readiness probes in a row", vm.vmmID, readinessFailures)
+				updateMachineStatus(ctx, vm.vmmID, StatusUnhealthy)
+				unhealthy = true
+			}
+		}
+	}
+}
+
+// waitUntilReady polls the readiness probe right after boot, giving the guest
+// HealthCheckMaxRetries attempts to come up.
+func waitUntilReady(vm *runningFirecracker, readiness ProbeConfig) bool {
+	for i := 0; i < HealthCheckMaxRetries; i++ {
+		if vm.vmmCtx.Err() != nil || vm.stopRequested() {
+			return false
+		}
+		if runProbe(vm, ProbeReadiness, readiness) {
+			return true
+		}
+
+		log.Warnf("Machine %s is not ready, retrying...", vm.vmmID)
+		time.Sleep(HealthCheckInterval)
+	}
+	return false
+}
+
+// shouldProbe reports whether vm is still the managed VMM for its machine and
+// in a state where probes make sense.
+func shouldProbe(vm *runningFirecracker) bool {
+	if !fcManager.IsCurrent(vm) || vm.stopRequested() {
+		return false
+	}
+
+	info, err := fetchMachineInfo(vm.vmmCtx, vm.vmmID)
+	if err != nil {
+		return false
+	}
+	status := MachineStatusType(info.Status)
+	return status == StatusRunning || status == StatusUnhealthy
+}
+
+func restartUnhealthyVM(vm *runningFirecracker, machineConfig *ApiMachineConfig) {
+	ctx := context.Background()
+	log.Warnf("Restarting unhealthy machine %s", vm.vmmID)
+
+	// Unmanage first so the supervisor leaves the exit to us
+	fcManager.RemoveVM(vm.vmmID)
+	vm.requestStop()
+	if err := vm.stopVMM(); err != nil {
+		log.WithError(err).Errorf("failed to stop VMM for machine %s", vm.vmmID)
+	}
+	waitForExit(vm)
+	vm.vmmCancel()
+	if forwarder := vm.forwarder.Swap(nil); forwarder != nil {
+		forwarder.Close()
+	}
+
+	if err := restartVM(ctx, vm.vmmID, machineConfig); err != nil {
+		log.WithError(err).Errorf("failed to restart machine %s", vm.vmmID)
+		updateMachineStatus(ctx, vm.vmmID, StatusFailed)
+		return
+	}
+
+	var restartCount int
+	err := updateMachineInfo(ctx, vm.vmmID, func(info *MachineInfo) {
+		info.RestartCount++
+		restartCount = info.RestartCount
+	})
+	if err != nil {
+		log.WithError(err).Errorf("failed to record restart of machine %s", vm.vmmID)
+	}
+
+	emitEvent(Event{
+		Type:      EventMachineRestarted,
+		MachineID: vm.vmmID,
+		App:       machineConfig.AppName,
+		Data: map[string]interface{}{
+			"restart_count": restartCount,
+			"reason":        "liveness probe failed",
+		},
+	})
+}
+
+// runProbe runs a single probe against the machine and records the result.
+func runProbe(vm *runningFirecracker, probeName string, probe ProbeConfig) bool {
+	timeout := time.Duration(probe.TimeoutSeconds) * time.Second
+	start := time.Now()
+
+	var err error
+	switch probe.Type {
+	case ProbeTCP:
+		err = probeTCP(vm.ip, probe.Port, timeout)
+	case ProbeVsock:
+		err = probeVsock(getVsockPath(vm.vmmID), probe.Port, timeout)
+	case ProbeExec:
+		err = probeExec(vm.ip, probe.Command, timeout)
+	default:
+		err = probeHTTP(vm.ip, probe.Port, probe.Path, timeout)
+	}
+
+	result := HealthCheckResult{
+		Time:       start.UTC(),
+		Probe:      probeName,
+		Type:       probe.Type,
+		Healthy:    err == nil,
+		DurationMs: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		result.Error = err.Error()
+		log.Debugf("%s probe of machine %s failed: %v", probeName, vm.vmmID, err)
+	}
+
+	recordHealthResult(context.Background(), vm.vmmID, result)
+	return result.Healthy
+}
+
+func recordHealthResult(ctx context.Context, machineID string, result HealthCheckResult) {
+	data, err := json.Marshal(result)
+	if err != nil {
+		log.WithError(err).Error("failed to marshal health check result")
+		return
+	}
+
+	pipe := rdb.TxPipeline()
+	pipe.LPush(ctx, healthKey(machineID), data)
+	pipe.LTrim(ctx, healthKey(machineID), 0, healthHistoryLength-1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.WithError(err).Errorf("failed to record health of machine %s", machineID)
+	}
+}
+
+func probeHTTP(ip net.IP, port int, path string, timeout time.Duration) error {
+	httpClient := &http.Client{Timeout: timeout}
+	url := fmt.Sprintf("http://%s%s", net.JoinHostPort(ip.String(), strconv.Itoa(port)), path)
+
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func probeTCP(ip net.IP, port int, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)), timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// probeVsock connects to a guest vsock port through firecracker's host side
+// unix socket, which expects a "CONNECT <port>" handshake.
+func probeVsock(socketPath string, port int, timeout time.Duration) error {
+	conn, err := net.DialTimeout("unix", socketPath, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := fmt.Fprintf(conn, "CONNECT %d\n", port); err != nil {
+		return err
+	}
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "OK ") {
+		return fmt.Errorf("unexpected vsock handshake reply %q", strings.TrimSpace(line))
+	}
+	return nil
+}
+
+// probeExec runs a shell command in the guest through the agent.
+func probeExec(ip net.IP, command string, timeout time.Duration) error {
+	data, err := json.Marshal(CodeRunRequest{
+		Code:     command,
+		Language: "bash",
+	})
+	if err != nil {
+		return err
+	}
+
+	httpClient := &http.Client{Timeout: timeout}
+	url := fmt.Sprintf("http://%s/run", net.JoinHostPort(ip.String(), strconv.Itoa(AgentPort)))
+	resp, err := httpClient.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result CodeRunResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	if result.Error != "" {
+		return fmt.Errorf("command failed: %s", result.Error)
+	}
+	return nil
+}
+
+func getMachineHealth(c echo.Context) error {
+	machineID := c.Param("machine_id")
+	ctx := context.Background()
+
+	machineInfo, err := fetchMachineInfo(ctx, machineID)
+	if err != nil {
+		if strings.Contains(err.Error(), "machine not found") {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Machine not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+
+	entries, err := rdb.LRange(ctx, healthKey(machineID), 0, -1).Result()
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to fetch health history")
+	}
+
+	machineConfig := machineInfo.machineConfig()
+	liveness, readiness := probesFor(&machineConfig)
+	resp := MachineHealthResponse{
+		MachineID: machineID,
+		Status:    MachineStatusType(machineInfo.Status),
+		Liveness:  ProbeStatus{Config: liveness},
+		Readiness: ProbeStatus{Config: readiness},
+		History:   make([]HealthCheckResult, 0, len(entries)),
+	}
+
+	// History is newest first, so failures count up until the first success
+	counting := map[string]bool{ProbeLiveness: true, ProbeReadiness: true}
+	for _, entry := range entries {
+		var result HealthCheckResult
+		if err := json.Unmarshal([]byte(entry), &result); err != nil {
+			log.WithError(err).Errorf("failed to unmarshal health result of machine %s", machineID)
+			continue
+		}
+		resp.History = append(resp.History, result)
+
+		status := &resp.Liveness
+		if result.Probe == ProbeReadiness {
+			status = &resp.Readiness
+		}
+		if status.LastResult == nil {
+			status.LastResult = &resp.History[len(resp.History)-1]
+		}
+		if counting[result.Probe] {
+			if result.Healthy {
+				counting[result.Probe] = false
+			} else {
+				status.ConsecutiveFailures++
+			}
+		}
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	IPAMSubnetEnvVar  = "IPAM_SUBNET"
+	IPAMGatewayEnvVar = "IPAM_GATEWAY"
+
+	defaultIPAMSubnet = "172.16.0.0/24"
+
+	ipamLeasesKey = "ipam:leases"
+)
+
+var ipam *IPAM
+
+type Lease struct {
+	MachineID string    `json:"machine_id"`
+	IP        net.IP    `json:"ip"`
+	MAC       string    `json:"mac"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// IPAM hands out addresses from a single subnet. Leases are kept in Redis,
+// keyed by IP, so every server talking to the same store sees the same table.
+type IPAM struct {
+	subnet  *net.IPNet
+	gateway net.IP
+}
+
+func NewIPAM(subnet, gateway string) (*IPAM, error) {
+	if subnet == "" {
+		subnet = defaultIPAMSubnet
+	}
+
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subnet %q: %v", subnet, err)
+	}
+	if ipNet.IP.To4() == nil {
+		return nil, fmt.Errorf("subnet %q is not an IPv4 subnet", subnet)
+	}
+
+	var gw net.IP
+	if gateway == "" {
+		gw = ipAdd(ipNet.IP, 1)
+	} else {
+		gw = net.ParseIP(gateway).To4()
+		if gw == nil || !ipNet.Contains(gw) {
+			return nil, fmt.Errorf("gateway %q is not an address in %s", gateway, ipNet)
+		}
+	}
+
+	return &IPAM{subnet: ipNet, gateway: gw}, nil
+}
+
+func (ipam *IPAM) Subnet() *net.IPNet {
+	return ipam.subnet
+}
+
+func (ipam *IPAM) Gateway() net.IP {
+	return ipam.gateway
+}
+
+// Allocate leases the first free address in the subnet to machineID.
+// Allocating twice for the same machine returns the existing lease.
+func (ipam *IPAM) Allocate(ctx context.Context, machineID string) (*Lease, error) {
+	if lease, err := ipam.LeaseFor(ctx, machineID); err != nil {
+		return nil, err
+	} else if lease != nil {
+		return lease, nil
+	}
+
+	ones, bits := ipam.subnet.Mask.Size()
+	size := uint32(1) << uint(bits-ones)
+
+	// Skip the network and broadcast addresses.
+	for i := uint32(1); i < size-1; i++ {
+		ip := ipAdd(ipam.subnet.IP, i)
+		if ip.Equal(ipam.gateway) {
+			continue
+		}
+
+		lease, ok, err := ipam.claim(ctx, machineID, ip, macForIP(ip))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return lease, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no free addresses left in %s", ipam.subnet)
+}
+
+// Reserve records an address that was assigned outside of the allocator,
+// e.g. by a CNI plugin, so that the lease table matches what the VM got.
+func (ipam *IPAM) Reserve(ctx context.Context, machineID string, ip net.IP, mac string) (*Lease, error) {
+	if !ipam.subnet.Contains(ip) {
+		log.Warnf("Reserving %s for machine %s outside of the managed subnet %s", ip, machineID, ipam.subnet)
+	}
+	if mac == "" {
+		mac = macForIP(ip)
+	}
+
+	lease, ok, err := ipam.claim(ctx, machineID, ip, mac)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return lease, nil
+	}
+
+	existing, err := ipam.lookup(ctx, ip)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil && existing.MachineID == machineID {
+		return existing, nil
+	}
+	return nil, fmt.Errorf("address %s is already leased to another machine", ip)
+}
+
+// Release drops every lease held by machineID.
+func (ipam *IPAM) Release(ctx context.Context, machineID string) error {
+	leases, err := ipam.Leases(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, lease := range leases {
+		if lease.MachineID != machineID {
+			continue
+		}
+		if err := rdb.HDel(ctx, ipamLeasesKey, lease.IP.String()).Err(); err != nil {
+			return err
+		}
+		log.WithField("ip", lease.IP).Infof("Released lease for machine %s", machineID)
+	}
+
+	return nil
+}
+
+func (ipam *IPAM) LeaseFor(ctx context.Context, machineID string) (*Lease, error) {
+	leases, err := ipam.Leases(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, lease := range leases {
+		if lease.MachineID == machineID {
+			return &lease, nil
+		}
+	}
+	return nil, nil
+}
+
+func (ipam *IPAM) Leases(ctx context.Context) ([]Lease, error) {
+	entries, err := rdb.HGetAll(ctx, ipamLeasesKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	leases := make([]Lease, 0, len(entries))
+	for ip, data := range entries {
+		var lease Lease
+		if err := json.Unmarshal([]byte(data), &lease); err != nil {
+			log.WithError(err).Errorf("failed to unmarshal lease for %s", ip)
+			continue
+		}
+		leases = append(leases, lease)
+	}
+
+	sort.Slice(leases, func(i, j int) bool {
+		return ipToUint32(leases[i].IP) < ipToUint32(leases[j].IP)
+	})
+	return leases, nil
+}
+
+func (ipam *IPAM) claim(ctx context.Context, machineID string, ip net.IP, mac string) (*Lease, bool, error) {
+	lease := &Lease{
+		MachineID: machineID,
+		IP:        ip,
+		MAC:       mac,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	data, err := json.Marshal(lease)
+	if err != nil {
+		return nil, false, err
+	}
+
+	ok, err := rdb.HSetNX(ctx, ipamLeasesKey, ip.String(), data).Result()
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	log.WithField("ip", ip).Infof("Leased address to machine %s", machineID)
+	return lease, true, nil
+}
+
+func (ipam *IPAM) lookup(ctx context.Context, ip net.IP) (*Lease, error) {
+	data, err := rdb.HGet(ctx, ipamLeasesKey, ip.String()).Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var lease Lease
+	if err := json.Unmarshal([]byte(data), &lease); err != nil {
+		return nil, err
+	}
+	return &lease, nil
+}
+
+// macForIP derives a locally administered MAC from an IPv4 address, so a
+// machine keeps the same MAC for as long as it holds its lease.
+func macForIP(ip net.IP) string {
+	ip4 := ip.To4()
+	return fmt.Sprintf("06:00:%02x:%02x:%02x:%02x", ip4[0], ip4[1], ip4[2], ip4[3])
+}
+
+func ipAdd(ip net.IP, n uint32) net.IP {
+	out := make(net.IP, 4)
+	binary.BigEndian.PutUint32(out, ipToUint32(ip)+n)
+	return out
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(ip4)
+}
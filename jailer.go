@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	JailerEnabledEnvVar       = "JAILER_ENABLED"
+	JailerBinaryEnvVar        = "JAILER_BINARY"
+	JailerChrootBaseDirEnvVar = "JAILER_CHROOT_BASE_DIR"
+	JailerUIDRangeEnvVar      = "JAILER_UID_RANGE"
+	JailerCgroupVersionEnvVar = "JAILER_CGROUP_VERSION"
+	JailerNumaNodeEnvVar      = "JAILER_NUMA_NODE"
+	JailerSeccompEnvVar       = "JAILER_SECCOMP"
+	JailerNetNSDirEnvVar      = "JAILER_NETNS_DIR"
+
+	defaultJailerBinary        = "jailer"
+	defaultJailerChrootBaseDir = "/srv/jailer"
+	defaultJailerUIDRange      = "100000-165535"
+	defaultJailerNetNSDir      = "/var/run/netns"
+
+	jailerUIDsKey = "jailer:uids"
+
+	// Files firecracker uses, relative to the root of its chroot
+	jailSocketName  = "firecracker.socket"
+	jailLogName     = "firecracker.log"
+	jailMetricsName = "firecracker.metrics"
+	jailVsockName   = "firecracker.vsock"
+	jailSeccompName = "seccomp.bpf"
+	jailMemName     = "snapshot.mem"
+	jailStateName   = "snapshot.state"
+)
+
+// jailer is nil unless VMMs run under the jailer.
+var jailer *Jailer
+
+// Jailer holds the settings every VMM is jailed with. Each VM runs as its own
+// uid and gid, taken from UIDMin-UIDMax, in a chroot below ChrootBaseDir.
+type Jailer struct {
+	Binary        string
+	ExecFile      string
+	ChrootBaseDir string
+	UIDMin        int
+	UIDMax        int
+	CgroupVersion string
+	NumaNode      int
+	Seccomp       firecracker.SeccompConfig
+	NetNSDir      string
+}
+
+func loadJailer() (*Jailer, error) {
+	if enabled, _ := strconv.ParseBool(os.Getenv(JailerEnabledEnvVar)); !enabled {
+		return nil, nil
+	}
+
+	j := &Jailer{
+		Binary:        envOrDefault(JailerBinaryEnvVar, defaultJailerBinary),
+		ExecFile:      os.Getenv(FirecrackerBinEnvVar),
+		ChrootBaseDir: envOrDefault(JailerChrootBaseDirEnvVar, defaultJailerChrootBaseDir),
+		CgroupVersion: os.Getenv(JailerCgroupVersionEnvVar),
+		NetNSDir:      envOrDefault(JailerNetNSDirEnvVar, defaultJailerNetNSDir),
+	}
+
+	uidRange := envOrDefault(JailerUIDRangeEnvVar, defaultJailerUIDRange)
+	first, last, ok := strings.Cut(uidRange, "-")
+	uidMin, minErr := strconv.Atoi(first)
+	uidMax, maxErr := strconv.Atoi(last)
+	if !ok || minErr != nil || maxErr != nil || uidMin <= 0 || uidMax < uidMin {
+		return nil, fmt.Errorf("invalid %s %q, expected <first>-<last>", JailerUIDRangeEnvVar, uidRange)
+	}
+	j.UIDMin, j.UIDMax = uidMin, uidMax
+
+	if j.CgroupVersion != "" && j.CgroupVersion != "1" && j.CgroupVersion != "2" {
+		return nil, fmt.Errorf("invalid %s %q, expected 1 or 2", JailerCgroupVersionEnvVar, j.CgroupVersion)
+	}
+
+	if node := os.Getenv(JailerNumaNodeEnvVar); node != "" {
+		value, err := strconv.Atoi(node)
+		if err != nil || value < 0 {
+			return nil, fmt.Errorf("invalid %s %q", JailerNumaNodeEnvVar, node)
+		}
+		j.NumaNode = value
+	}
+
+	// "default" keeps firecracker's own filters, "off" disables seccomp and
+	// anything else is a custom BPF filter file.
+	switch seccomp := os.Getenv(JailerSeccompEnvVar); seccomp {
+	case "", "default":
+		j.Seccomp = firecracker.SeccompConfig{Enabled: true}
+	case "off":
+		j.Seccomp = firecracker.SeccompConfig{Enabled: false}
+		log.Warn("seccomp is disabled for jailed VMMs")
+	default:
+		if _, err := os.Stat(seccomp); err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", JailerSeccompEnvVar, err)
+		}
+		j.Seccomp = firecracker.SeccompConfig{Enabled: true, Filter: seccomp}
+	}
+
+	if j.ExecFile == "" {
+		return nil, fmt.Errorf("%s must be set to run under the jailer", FirecrackerBinEnvVar)
+	}
+	if err := os.MkdirAll(j.ChrootBaseDir, 0755); err != nil {
+		return nil, err
+	}
+
+	return j, nil
+}
+
+func envOrDefault(envVar, fallback string) string {
+	if value := os.Getenv(envVar); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// jailDir is the directory the jailer builds for a VMM, root is its chroot.
+func (j *Jailer) jailDir(vmmID string) string {
+	return filepath.Join(j.ChrootBaseDir, filepath.Base(j.ExecFile), vmmID)
+}
+
+func (j *Jailer) rootDir(vmmID string) string {
+	return filepath.Join(j.jailDir(vmmID), "root")
+}
+
+// allocateUID hands out the first free uid of the range to machineID. The VM
+// uses it as its gid too. Allocating twice for a machine returns the same uid.
+func (j *Jailer) allocateUID(ctx context.Context, machineID string) (int, error) {
+	owners, err := rdb.HGetAll(ctx, jailerUIDsKey).Result()
+	if err != nil {
+		return 0, err
+	}
+	for uid, owner := range owners {
+		if owner == machineID {
+			return strconv.Atoi(uid)
+		}
+	}
+
+	for uid := j.UIDMin; uid <= j.UIDMax; uid++ {
+		if _, taken := owners[strconv.Itoa(uid)]; taken {
+			continue
+		}
+		ok, err := rdb.HSetNX(ctx, jailerUIDsKey, strconv.Itoa(uid), machineID).Result()
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return uid, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no free uids left in %d-%d", j.UIDMin, j.UIDMax)
+}
+
+func releaseJailerUID(ctx context.Context, machineID string) error {
+	owners, err := rdb.HGetAll(ctx, jailerUIDsKey).Result()
+	if err != nil {
+		return err
+	}
+	for uid, owner := range owners {
+		if owner == machineID {
+			if err := rdb.HDel(ctx, jailerUIDsKey, uid).Err(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// prepareJail sets up a fresh chroot for a VMM and switches fcCfg to jailer
+// mode. Files firecracker writes to are created up front and handed to the
+// VM's uid; the kernel and drives are hard-linked in by the SDK once the
+// jailer is up, so they have to live on the same filesystem as the chroot.
+func (j *Jailer) prepareJail(ctx context.Context, vmmID string, fcCfg *firecracker.Config) error {
+	uid, err := j.allocateUID(ctx, vmmID)
+	if err != nil {
+		return err
+	}
+
+	// A restarted VMM gets a new chroot, the jailer won't reuse one
+	if err := os.RemoveAll(j.jailDir(vmmID)); err != nil {
+		return err
+	}
+	root := j.rootDir(vmmID)
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return err
+	}
+	if err := os.Chown(root, uid, uid); err != nil {
+		return err
+	}
+
+	for _, path := range []string{getLogPath(vmmID), getMetricsPath(vmmID)} {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		f.Close()
+		if err := os.Chown(path, uid, uid); err != nil {
+			return err
+		}
+	}
+	for _, drive := range fcCfg.Drives {
+		if err := os.Chown(firecracker.StringValue(drive.PathOnHost), uid, uid); err != nil {
+			return err
+		}
+	}
+
+	fcCfg.Seccomp = j.Seccomp
+	if j.Seccomp.Filter != "" {
+		if err := os.Link(j.Seccomp.Filter, filepath.Join(root, jailSeccompName)); err != nil {
+			return fmt.Errorf("failed to link seccomp filter into the jail: %v", err)
+		}
+		fcCfg.Seccomp.Filter = "/" + jailSeccompName
+	}
+
+	// CNI sets up a namespace per VM, the jailer moves firecracker into it.
+	// Taps are created on the host's bridge so they stay in the host's.
+	if networkMode() == NetworkModeCNI {
+		fcCfg.NetNS = filepath.Join(j.NetNSDir, vmmID)
+	}
+
+	fcCfg.VMID = vmmID
+	fcCfg.SocketPath = "/" + jailSocketName
+	fcCfg.JailerCfg = &firecracker.JailerConfig{
+		UID:            firecracker.Int(uid),
+		GID:            firecracker.Int(uid),
+		ID:             vmmID,
+		NumaNode:       firecracker.Int(j.NumaNode),
+		ExecFile:       j.ExecFile,
+		JailerBinary:   j.Binary,
+		ChrootBaseDir:  j.ChrootBaseDir,
+		CgroupVersion:  j.CgroupVersion,
+		ChrootStrategy: jailStrategy{firecracker.NewNaiveChrootStrategy(fcCfg.KernelImagePath)},
+		Stderr:         os.Stderr,
+	}
+
+	return nil
+}
+
+// command builds the jailer command line the SDK would, with extraArgs for
+// the jailer itself. fcCfg has to be complete, the NetNS of a restored
+// snapshot is only known late.
+func (j *Jailer) command(ctx context.Context, fcCfg *firecracker.Config, extraArgs []string) *exec.Cmd {
+	fcArgs := []string{"--api-sock", fcCfg.SocketPath}
+	if !fcCfg.Seccomp.Enabled {
+		fcArgs = append([]string{"--no-seccomp"}, fcArgs...)
+	} else if fcCfg.Seccomp.Filter != "" {
+		fcArgs = append([]string{"--seccomp-filter", fcCfg.Seccomp.Filter}, fcArgs...)
+	}
+
+	builder := firecracker.NewJailerCommandBuilder().
+		WithBin(j.Binary).
+		WithID(fcCfg.JailerCfg.ID).
+		WithUID(*fcCfg.JailerCfg.UID).
+		WithGID(*fcCfg.JailerCfg.GID).
+		WithNumaNode(j.NumaNode).
+		WithExecFile(j.ExecFile).
+		WithChrootBaseDir(j.ChrootBaseDir).
+		WithCgroupVersion(j.CgroupVersion).
+		WithFirecrackerArgs(fcArgs...)
+	if fcCfg.NetNS != "" {
+		builder = builder.WithNetNS(fcCfg.NetNS)
+	}
+
+	// The jailer's own args end where firecracker's start
+	args := builder.Args()
+	for i, arg := range args {
+		if arg == "--" {
+			args = append(args[:i:i], append(extraArgs, args[i:]...)...)
+			break
+		}
+	}
+
+	cmd := exec.CommandContext(ctx, builder.Bin(), args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// removeJail drops the chroot of a machine and gives its uid back.
+func removeJail(ctx context.Context, machineID string) {
+	if jailer != nil {
+		if err := os.RemoveAll(jailer.jailDir(machineID)); err != nil {
+			log.WithError(err).Errorf("failed to remove jail of machine %s", machineID)
+		}
+	}
+	if err := releaseJailerUID(ctx, machineID); err != nil {
+		log.WithError(err).Errorf("failed to release uid of machine %s", machineID)
+	}
+}
+
+// jailStrategy hard-links the kernel and drives like the SDK's naive
+// strategy, then points firecracker at the log, metrics and vsock files
+// through their paths inside the chroot.
+type jailStrategy struct {
+	firecracker.NaiveChrootStrategy
+}
+
+func (s jailStrategy) AdaptHandlers(handlers *firecracker.Handlers) error {
+	if err := s.NaiveChrootStrategy.AdaptHandlers(handlers); err != nil {
+		return err
+	}
+	handlers.FcInit = handlers.FcInit.AppendAfter(firecracker.LinkFilesToRootFSHandlerName, jailPathsHandler)
+	return nil
+}
+
+var jailPathsHandler = firecracker.Handler{
+	Name: "quest.JailPaths",
+	Fn: func(ctx context.Context, m *firecracker.Machine) error {
+		for _, path := range []*string{&m.Cfg.LogPath, &m.Cfg.MetricsPath} {
+			if *path != "" {
+				*path = "/" + filepath.Base(*path)
+			}
+		}
+		for i := range m.Cfg.VsockDevices {
+			m.Cfg.VsockDevices[i].Path = "/" + filepath.Base(m.Cfg.VsockDevices[i].Path)
+		}
+		return nil
+	},
+}
+
+// linkSnapshot hard-links what restoring a snapshot needs into a prepared
+// jail and returns the snapshot's paths inside it. The SDK skips linking
+// files when loading a snapshot, and the state refers to the drives by the
+// names they were linked under at boot.
+func (j *Jailer) linkSnapshot(vmmID string, fcCfg *firecracker.Config, snapshot *MachineSnapshot) (string, string, error) {
+	root := j.rootDir(vmmID)
+	uid := firecracker.IntValue(fcCfg.JailerCfg.UID)
+
+	links := map[string]string{
+		snapshot.MemFilePath: jailMemName,
+		snapshot.StatePath:   jailStateName,
+	}
+	for _, drive := range fcCfg.Drives {
+		path := firecracker.StringValue(drive.PathOnHost)
+		links[path] = filepath.Base(path)
+	}
+
+	for src, name := range links {
+		if err := linkIntoJail(root, uid, src, name); err != nil {
+			return "", "", err
+		}
+	}
+	// A snapshot of another machine opens its rootfs under that machine's
+	// name until bootVM switches the drive over
+	if snapshot.RootFSPath != "" && snapshot.RootFSPath != getRootFSPath(vmmID) {
+		if err := linkIntoJail(root, uid, getRootFSPath(vmmID), filepath.Base(snapshot.RootFSPath)); err != nil {
+			return "", "", err
+		}
+	}
+
+	return "/" + jailMemName, "/" + jailStateName, nil
+}
+
+func linkIntoJail(root string, uid int, src, name string) error {
+	dst := filepath.Join(root, name)
+	if err := os.Link(src, dst); err != nil {
+		return err
+	}
+	return os.Chown(dst, uid, uid)
+}
+
+// jailedMachineID returns the machine of an API socket inside a jail. The
+// jailed process only knows the socket by its path in the chroot.
+func jailedMachineID(socketPath string) (string, bool) {
+	if filepath.Base(socketPath) != jailSocketName {
+		return "", false
+	}
+	root := filepath.Dir(socketPath)
+	if filepath.Base(root) != "root" {
+		return "", false
+	}
+	return filepath.Base(filepath.Dir(root)), true
+}
@@ -4,16 +4,21 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/rs/xid"
 
 	"github.com/joho/godotenv"
 	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -37,31 +42,165 @@ func main() {
 		log.Fatalf("Error loading .env file")
 	}
 
-	e := echo.New()
+	ipam, err = NewIPAM(os.Getenv(IPAMSubnetEnvVar), os.Getenv(IPAMGatewayEnvVar))
+	if err != nil {
+		log.Fatalf("Error configuring IPAM: %v", err)
+	}
+
+	jailer, err = loadJailer()
+	if err != nil {
+		log.Fatalf("Error configuring the jailer: %v", err)
+	}
+	cgroups, err = loadCgroups()
+	if err != nil {
+		log.Fatalf("Error setting up cgroups: %v", err)
+	}
+	loadMetricsImages()
+	if err := loadPortForwards(); err != nil {
+		log.Fatalf("Error configuring port forwards: %v", err)
+	}
 
-	// Define the routes
-	// e.POST("/apps/:app_name/machines", createMachine)
-	// e.GET("/apps/:app_name/machines/:machine_id/wait", waitForMachineState)
-	// e.GET("/apps/:app_name/machines/:machine_id", getMachine)
-	// e.GET("/apps/machines", listMachines)
-	// e.POST("/apps/:app_name/machines/:machine_id/run", runCode)
+	if err := migrateLegacyMachines(context.Background()); err != nil {
+		log.Fatalf("Error moving machines into apps: %v", err)
+	}
+	if _, err := ensureApp(context.Background(), defaultMachineConfig().AppName); err != nil {
+		log.Fatalf("Error creating default app: %v", err)
+	}
+
+	if err := reconcileMachines(context.Background()); err != nil {
+		log.WithError(err).Error("failed to reconcile machines with the store")
+	}
+	if err := rebuildUsage(context.Background()); err != nil {
+		log.WithError(err).Error("failed to rebuild resource usage")
+	}
+
+	if networkMode() == NetworkModeTap {
+		if err := setupBridge(); err != nil {
+			log.Fatalf("Error setting up bridge network: %v", err)
+		}
+		if err := cleanupOrphanedTaps(context.Background()); err != nil {
+			log.WithError(err).Error("failed to clean up orphaned taps")
+		}
+	}
 
-	e.POST("/machines", createMachine)
-	e.GET("/machines/:machine_id/wait", waitForMachineState)
-	e.GET("/machines/:machine_id", getMachine)
-	e.GET("/machines", listMachines)
-	e.POST("/machines/:machine_id/run", runCode)
+	rdb.AddHook(storeMetricsHook{})
+	if err := bootstrapAPIKey(context.Background()); err != nil {
+		log.Fatalf("Error setting up API keys: %v", err)
+	}
+	enableKeyspaceNotifications(context.Background())
+	go reclaimMemory(context.Background())
+	go autoPauseIdleMachines(context.Background())
+	go scaleIdleMachinesToZero(context.Background())
 
-	e.GET("/machines/:machine_id/start", startMachine)
-	e.GET("/machines/:machine_id/stop", stopMachine)
-	e.GET("/machines/:machine_id/delete", startMachine)
+	e := echo.New()
+	// Rate limits key on the client IP, which mustn't come from headers
+	// any client can set
+	e.IPExtractor = echo.ExtractIPDirect()
+	e.Use(httpMetricsMiddleware)
+	e.Use(authenticate)
+	e.Use(authorizeApp)
+
+	read := requireScope(ScopeRead)
+	write := requireScope(ScopeMachinesWrite)
+	run := requireScope(ScopeRun)
+	admin := requireScope(ScopeAdmin)
+	global := requireUnscopedKey
+	createLimit := rateLimit("create", rateLimitFromEnv(RateLimitCreateEnvVar, defaultCreateRateLimit))
+	runLimit := rateLimit("run", rateLimitFromEnv(RateLimitRunEnvVar, defaultRunRateLimit))
+
+	e.POST("/apps", createApp, admin, global)
+	e.GET("/apps", getApps, read)
+	e.GET("/apps/:app_name", getApp, read)
+	e.DELETE("/apps/:app_name", deleteApp, admin)
+	e.PUT("/apps/:app_name/quota", setAppQuota, admin, global)
+	e.GET("/apps/:app_name/usage", getAppUsage, read)
+	e.GET("/capacity", getHostCapacity, read)
+
+	e.POST("/apps/:app_name/machines", createMachine, write, createLimit)
+	e.GET("/apps/:app_name/machines", listMachines, read)
+	e.GET("/apps/:app_name/machines/:machine_id/wait", waitForMachineState, read)
+	e.GET("/apps/:app_name/machines/:machine_id", getMachine, read)
+	e.GET("/apps/:app_name/machines/:machine_id/health", getMachineHealth, read)
+	e.GET("/apps/:app_name/machines/:machine_id/stats", getMachineStats, read)
+	e.GET("/apps/:app_name/machines/:machine_id/memory", getMachineMemory, read)
+	e.PATCH("/apps/:app_name/machines/:machine_id/memory", updateMachineMemory, write)
+	e.POST("/apps/:app_name/machines/:machine_id/run", runCode, run, runLimit)
+	e.GET("/apps/:app_name/machines/:machine_id/start", startMachine, write)
+	e.GET("/apps/:app_name/machines/:machine_id/stop", stopMachine, write)
+	e.POST("/apps/:app_name/machines/:machine_id/pause", pauseMachine, write)
+	e.POST("/apps/:app_name/machines/:machine_id/resume", resumeMachine, write)
+	e.POST("/apps/:app_name/machines/:machine_id/clone", cloneMachine, write, createLimit)
+	e.POST("/apps/:app_name/machines/:machine_id/snapshots", createMachineSnapshot, write)
+	e.POST("/apps/:app_name/machines/:machine_id/disk/resize", resizeMachineDisk, write)
+	e.DELETE("/apps/:app_name/machines/:machine_id", deleteMachine, write)
+
+	// Unscoped routes, machines are looked up by ID across the caller's apps
+	e.POST("/machines", createMachine, write, createLimit)
+	e.GET("/machines/:machine_id/wait", waitForMachineState, read)
+	e.GET("/machines/:machine_id", getMachine, read)
+	e.GET("/machines/:machine_id/health", getMachineHealth, read)
+	e.GET("/machines/:machine_id/stats", getMachineStats, read)
+	e.GET("/machines/:machine_id/memory", getMachineMemory, read)
+	e.PATCH("/machines/:machine_id/memory", updateMachineMemory, write)
+	e.GET("/machines", listMachines, read)
+	e.POST("/machines/:machine_id/run", runCode, run, runLimit)
+
+	e.GET("/machines/:machine_id/start", startMachine, write)
+	e.GET("/machines/:machine_id/stop", stopMachine, write)
+	e.POST("/machines/:machine_id/pause", pauseMachine, write)
+	e.POST("/machines/:machine_id/resume", resumeMachine, write)
+	e.POST("/machines/:machine_id/clone", cloneMachine, write, createLimit)
+	e.POST("/machines/:machine_id/snapshots", createMachineSnapshot, write)
+	e.POST("/machines/:machine_id/disk/resize", resizeMachineDisk, write)
+	e.GET("/machines/:machine_id/delete", deleteMachine, write)
+	e.DELETE("/machines/:machine_id", deleteMachine, write)
+
+	e.GET("/apps/:app_name/snapshots", getSnapshots, read)
+	e.GET("/apps/:app_name/snapshots/:snapshot_id", getSnapshot, read)
+	e.GET("/apps/:app_name/snapshots/:snapshot_id/export", exportSnapshot, read)
+	e.POST("/apps/:app_name/snapshots/import", importSnapshot, write)
+	e.DELETE("/apps/:app_name/snapshots/:snapshot_id", deleteSnapshot, write)
+	e.GET("/snapshots", getSnapshots, read)
+	e.GET("/snapshots/:snapshot_id", getSnapshot, read)
+	e.GET("/snapshots/:snapshot_id/export", exportSnapshot, read)
+	e.POST("/snapshots/import", importSnapshot, write)
+	e.DELETE("/snapshots/:snapshot_id", deleteSnapshot, write)
+
+	e.POST("/apps/:app_name/volumes", createVolume, write)
+	e.GET("/apps/:app_name/volumes", getVolumes, read)
+	e.GET("/apps/:app_name/volumes/:volume_id", getVolume, read)
+	e.DELETE("/apps/:app_name/volumes/:volume_id", deleteVolume, write)
+	e.POST("/volumes", createVolume, write)
+	e.GET("/volumes", getVolumes, read)
+	e.GET("/volumes/:volume_id", getVolume, read)
+	e.DELETE("/volumes/:volume_id", deleteVolume, write)
+
+	e.GET("/network/leases", listLeases, read, global)
+	e.GET("/metrics", echo.WrapHandler(promhttp.Handler()), read, global)
+	e.GET("/events", streamEvents, read)
+
+	e.POST("/webhooks", createWebhook, admin, global)
+	e.GET("/webhooks", getWebhooks, admin, global)
+	e.GET("/webhooks/:webhook_id", getWebhook, admin, global)
+	e.DELETE("/webhooks/:webhook_id", deleteWebhook, admin, global)
+	e.GET("/webhooks/:webhook_id/deliveries", getWebhookDeliveries, admin, global)
+	e.GET("/webhooks/:webhook_id/dead-letters", getWebhookDeadLetters, admin, global)
+
+	e.GET("/auth/whoami", whoami)
+	e.POST("/keys", createAPIKey, admin, global)
+	e.GET("/keys", getAPIKeys, admin, global)
+	e.DELETE("/keys/:key_id", deleteAPIKey, admin, global)
 
 	// Start the server
 	e.Logger.Fatal(e.Start(":1323"))
 }
 
+// runTimeout bounds a code run, a guest that never answers would otherwise
+// keep the machine busy forever
+const runTimeout = 5 * time.Minute
+
 var fcManager = NewFirecrackerManager()
-var client = &http.Client{}
+var client = &http.Client{Timeout: runTimeout}
 
 func handleError(c echo.Context, err error, httpStatus int, errMsg string) error {
 	log.WithError(err).Error(errMsg)
@@ -69,7 +208,12 @@ func handleError(c echo.Context, err error, httpStatus int, errMsg string) error
 }
 
 func fetchMachineInfo(ctx context.Context, machineID string) (*MachineInfo, error) {
-	data, err := rdb.Get(ctx, "machine:"+machineID).Result()
+	key, err := machineRecordKey(ctx, machineID)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := rdb.Get(ctx, key).Result()
 	if err == redis.Nil {
 		return nil, fmt.Errorf("machine not found")
 	} else if err != nil {
@@ -86,53 +230,224 @@ func fetchMachineInfo(ctx context.Context, machineID string) (*MachineInfo, erro
 
 func createAndInitializeVM(ctx context.Context, machineConfig *ApiMachineConfig) (*runningFirecracker, error) {
 	// machineConfig := defaultMachineConfig()
-	vm, err := createAndStartVM(ctx, machineConfig)
+	reservation, err := admitMachine(ctx, machineConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	vmmID := xid.New().String()
+	if err := attachVolumes(ctx, vmmID, machineConfig); err != nil {
+		release(ctx, machineChecks(machineConfig.AppName, AppQuota{}, *reservation))
+		return nil, err
+	}
+	if err := registerMachine(ctx, vmmID, machineConfig.AppName); err != nil {
+		detachVolumes(ctx, vmmID)
+		release(ctx, machineChecks(machineConfig.AppName, AppQuota{}, *reservation))
+		return nil, err
+	}
+
+	err = updateMachineInfo(ctx, vmmID, func(info *MachineInfo) {
+		info.Status = string(StatusPending)
+		info.Config = machineConfig
+		info.Reservation = reservation
+	})
+	if err != nil {
+		log.WithError(err).Error("failed to store machine info in Redis")
+	}
+
+	emitEvent(Event{
+		Type:      EventMachineCreated,
+		MachineID: vmmID,
+		App:       machineConfig.AppName,
+		Data: map[string]interface{}{
+			"image":        machineConfig.Image,
+			"machine_type": machineConfig.MachineType,
+		},
+	})
+
+	vm, err := createAndStartVM(ctx, vmmID, machineConfig)
 	if err != nil {
 		log.WithError(err).Error("failed to create VMM")
-		updateMachineStatus(ctx, vm.vmmID, StatusFailed)
+		updateMachineStatus(ctx, vmmID, StatusFailed)
+		// The failed record stays around for inspection, the resources don't
+		releaseMachine(ctx, vmmID)
+		detachVolumes(ctx, vmmID)
 		return nil, err
 	}
 
-	log.WithField("ip", vm.ip).Info("New VM created and started")
-	fcManager.AddVM(vm.vmmID, vm)
-	go healthCheckMachine(ctx, vm.ip, vm.vmmID)
+	if err := initializeVM(ctx, vm, machineConfig); err != nil {
+		return nil, err
+	}
 
 	return vm, nil
 }
 
-func createMachine(c echo.Context) error {
-	ctx := context.Background()
-	machineConfig := defaultMachineConfig()
+// initializeVM hands a freshly booted VMM over to the manager and starts the
+// goroutines that look after it.
+func initializeVM(ctx context.Context, vm *runningFirecracker, machineConfig *ApiMachineConfig) error {
+	log.WithField("ip", vm.ip).Info("New VM created and started")
+	fcManager.AddVM(vm.vmmID, vm)
+	go superviseVM(vm)
+
+	if err := startMachinePortForwards(ctx, vm, machineConfig.Ports); err != nil {
+		log.WithError(err).Error("failed to set up port forwards")
+		// Unmanage first so the supervisor leaves the failed status alone
+		fcManager.RemoveVM(vm.vmmID)
+		vm.requestStop()
+		if stopErr := vm.stopVMM(); stopErr != nil {
+			log.WithError(stopErr).Errorf("failed to stop VMM for machine %s", vm.vmmID)
+		}
+		vm.vmmCancel()
+		updateMachineStatus(ctx, vm.vmmID, StatusFailed)
 
-	log.Info(machineConfig)
+		// The failed record stays around for inspection, the resources don't
+		if teardownErr := teardownNetwork(ctx, vm.vmmID); teardownErr != nil {
+			log.WithError(teardownErr).Errorf("failed to tear down network for machine %s", vm.vmmID)
+		}
+		removeIfExists(getRootFSPath(vm.vmmID))
+		releaseMachine(ctx, vm.vmmID)
+		detachVolumes(ctx, vm.vmmID)
+		return err
+	}
+
+	go monitorMachineHealth(vm, machineConfig)
+
+	return nil
+}
 
-	vm, err := createAndInitializeVM(ctx, machineConfig)
+func startMachinePortForwards(ctx context.Context, vm *runningFirecracker, ports []PortMapping) error {
+	if len(ports) == 0 {
+		return nil
+	}
+
+	forwarder, err := startPortForwards(vm.vmmID, vm.ip, ports, wakeOnActivity(vm.vmmID))
 	if err != nil {
-		return handleError(c, err, http.StatusInternalServerError, "Failed to create and initialize VM")
+		return err
 	}
+	vm.forwarder.Store(forwarder)
 
-	return c.JSON(http.StatusOK, CreateMachineResponse{
-		MachineID:     vm.vmmID,
-		IP:            vm.ip,
-		MachineConfig: *defaultMachineConfig(),
+	return updateMachineInfo(ctx, vm.vmmID, func(info *MachineInfo) {
+		info.Ports = ports
 	})
 }
 
-func waitForMachineState(c echo.Context) error {
-	machineID := c.Param("machine_id")
+func stopMachinePortForwards(ctx context.Context, vm *runningFirecracker) {
+	forwarder := vm.forwarder.Swap(nil)
+	if forwarder == nil {
+		return
+	}
+
+	forwarder.Close()
+
+	err := updateMachineInfo(ctx, vm.vmmID, func(info *MachineInfo) {
+		info.Ports = nil
+	})
+	if err != nil {
+		log.WithError(err).Errorf("failed to clear port forwards of machine %s", vm.vmmID)
+	}
+}
+
+// validateMachineConfig checks what a machine is created with. Snapshot
+// imports run it too, their config comes from an uploaded manifest.
+func validateMachineConfig(machineConfig *ApiMachineConfig) error {
+	if err := validatePortMappings(machineConfig.Ports); err != nil {
+		return err
+	}
+	if err := validateRestartPolicy(machineConfig.RestartPolicy); err != nil {
+		return err
+	}
+	if err := validateHealthCheck(machineConfig.HealthCheck); err != nil {
+		return err
+	}
+	if err := validateMachineType(machineConfig.MachineType); err != nil {
+		return err
+	}
+	if err := validateBalloon(machineConfig.Balloon, machineConfig.MachineType.MemoryMb); err != nil {
+		return err
+	}
+	if err := validateVolumeMounts(machineConfig.Volumes); err != nil {
+		return err
+	}
+	return validateDiskSize(machineConfig.MachineType.DiskSizeMb)
+}
+
+func createMachine(c echo.Context) error {
 	ctx := context.Background()
+	machineConfig := defaultMachineConfig()
 
-	machineInfo, err := fetchMachineInfo(ctx, machineID)
+	if err := c.Bind(machineConfig); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	// The app in the path wins, it's already been checked by authorizeApp
+	if app := c.Param("app_name"); app != "" {
+		machineConfig.AppName = app
+	} else {
+		if !callerKey(c).canAccessApp(machineConfig.AppName) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "App not found"})
+		}
+		if _, err := fetchApp(ctx, machineConfig.AppName); err != nil {
+			if strings.Contains(err.Error(), "app not found") {
+				return c.JSON(http.StatusNotFound, map[string]string{"error": "App not found"})
+			}
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+		}
+	}
+	if err := validateMachineConfig(machineConfig); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	var snapshot *Snapshot
+	if machineConfig.FromSnapshot != "" {
+		var err error
+		snapshot, err = fetchSnapshot(ctx, machineConfig.FromSnapshot)
+		if err != nil && !strings.Contains(err.Error(), "snapshot not found") {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+		}
+		if err != nil || snapshot.App != machineConfig.AppName {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Snapshot not found"})
+		}
+		if host := snapshot.host(); host != currentHost() {
+			return c.JSON(http.StatusConflict, map[string]string{"error": fmt.Sprintf("Snapshot is on host %s, create the machine there", host)})
+		}
+
+		host, err := currentSnapshotHost()
+		if err != nil {
+			return handleError(c, err, http.StatusInternalServerError, "Failed to inspect host")
+		}
+		if err := host.checkCompatible(snapshot.SnapshotHost); err != nil {
+			return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+		}
+		if err := snapshot.applyTo(machineConfig); err != nil {
+			return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+		}
+	}
+
+	log.Info(machineConfig)
+
+	start := time.Now()
+	var vm *runningFirecracker
+	var err error
+	if snapshot != nil {
+		vm, err = createClone(ctx, machineConfig, snapshot.capture())
+	} else {
+		vm, err = createAndInitializeVM(ctx, machineConfig)
+	}
 	if err != nil {
-		if strings.Contains(err.Error(), "machine not found") {
-			return c.JSON(http.StatusNotFound, map[string]string{"error": "Machine not found"})
+		observeSince(machineCreateDuration.WithLabelValues(imageLabel(machineConfig.Image), machineTypeLabel(machineConfig.MachineType), "error"), start)
+		var admissionErr *AdmissionError
+		if errors.As(err, &admissionErr) {
+			return c.JSON(admissionErr.StatusCode, map[string]string{"error": admissionErr.Reason})
 		}
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+		return handleError(c, err, http.StatusInternalServerError, "Failed to create and initialize VM")
 	}
+	observeSince(machineCreateDuration.WithLabelValues(imageLabel(machineConfig.Image), machineTypeLabel(machineConfig.MachineType), "success"), start)
 
-	return c.JSON(http.StatusOK, MachineStatusResponse{
-		MachineID: machineID,
-		Status:    MachineStatusType(machineInfo.Status),
+	return c.JSON(http.StatusOK, CreateMachineResponse{
+		MachineID:     vm.vmmID,
+		IP:            vm.ip,
+		Ports:         machineConfig.Ports,
+		MachineConfig: *machineConfig,
 	})
 }
 
@@ -148,48 +463,35 @@ func getMachine(c echo.Context) error {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
 	}
 
-	machineConfig := defaultMachineConfig()
-
 	return c.JSON(http.StatusOK, CreateMachineResponse{
 		MachineID:     machineID,
-		MachineConfig: *machineConfig,
+		MachineConfig: machineInfo.machineConfig(),
 		Status:        MachineStatusType(machineInfo.Status),
+		Ports:         machineInfo.Ports,
 	})
 }
 
 func listMachines(c echo.Context) error {
 	ctx := context.Background()
 
-	// Assuming all machine IDs are stored with a common prefix, e.g., "machine:"
-	keys, err := rdb.Keys(ctx, "machine:*").Result()
+	infos, err := listMachineInfos(ctx, c.Param("app_name"))
 	if err != nil {
 		log.WithError(err).Error("failed to fetch machine keys from Redis")
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
 	}
 
+	key := callerKey(c)
 	var machines []CreateMachineResponse
 
-	for _, key := range keys {
-		data, err := rdb.Get(ctx, key).Result()
-		if err != nil {
-			log.WithError(err).Errorf("failed to fetch machine info for key %s", key)
-			continue // Skip this machine and continue with others
-		}
-
-		var machineInfo MachineInfo
-		err = json.Unmarshal([]byte(data), &machineInfo)
-		if err != nil {
-			log.WithError(err).Errorf("failed to unmarshal machine info for key %s", key)
-			continue // Skip this machine and continue with others
+	for machineID, machineInfo := range infos {
+		if !key.canAccessApp(machineInfo.machineConfig().AppName) {
+			continue
 		}
-
-		machineID := strings.TrimPrefix(key, "machine:") // Remove prefix to get the actual ID
-		machineConfig := defaultMachineConfig()          // Or fetch specific config if stored separately
-
 		machines = append(machines, CreateMachineResponse{
 			MachineID:     machineID,
-			MachineConfig: *machineConfig,
+			MachineConfig: machineInfo.machineConfig(),
 			Status:        MachineStatusType(machineInfo.Status),
+			Ports:         machineInfo.Ports,
 			// IP will be empty if not available
 			IP: net.ParseIP(machineInfo.IP),
 		})
@@ -217,6 +519,49 @@ func runCode(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
 	}
 
+	machineConfig := machineInfo.machineConfig()
+
+	endRun, err := admitRun(ctx, machineConfig.AppName)
+	if err != nil {
+		var admissionErr *AdmissionError
+		if errors.As(err, &admissionErr) {
+			return c.JSON(admissionErr.StatusCode, map[string]string{"error": admissionErr.Reason})
+		}
+		return handleError(c, err, http.StatusInternalServerError, "Failed to admit run")
+	}
+	defer endRun()
+	finishRun, err := startRun(ctx, machineID)
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to wake machine")
+	}
+	defer finishRun()
+	markActive(ctx, machineID)
+
+	start := time.Now()
+	outcome := "error"
+	emitEvent(Event{
+		Type:      EventRunStarted,
+		MachineID: machineID,
+		App:       machineConfig.AppName,
+		Data: map[string]interface{}{
+			"run_id":   codeRunRequest.ID,
+			"language": codeRunRequest.Language,
+		},
+	})
+	defer func() {
+		observeSince(runDuration.WithLabelValues(imageLabel(machineConfig.Image), machineTypeLabel(machineConfig.MachineType), outcome), start)
+		emitEvent(Event{
+			Type:      EventRunFinished,
+			MachineID: machineID,
+			App:       machineConfig.AppName,
+			Data: map[string]interface{}{
+				"run_id":      codeRunRequest.ID,
+				"outcome":     outcome,
+				"duration_ms": time.Since(start).Milliseconds(),
+			},
+		})
+	}()
+
 	url := fmt.Sprintf("http://%s:8081/run", machineIP)
 	jsonData, err := json.Marshal(codeRunRequest)
 	if err != nil {
@@ -243,5 +588,19 @@ func runCode(c echo.Context) error {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
 	}
 
+	outcome = "success"
+	if codeRunResponse.Error != "" {
+		outcome = "failed"
+	}
+
 	return c.JSON(http.StatusOK, codeRunResponse)
 }
+
+func listLeases(c echo.Context) error {
+	leases, err := ipam.Leases(context.Background())
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to fetch leases")
+	}
+
+	return c.JSON(http.StatusOK, leases)
+}
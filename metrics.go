@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	metricsNamespace = "quest"
+
+	MetricsImagesEnvVar = "METRICS_IMAGES"
+
+	// otherLabel stands in for any value outside a label's bounded set
+	otherLabel = "other"
+
+	maxLabelCpus     = 64
+	maxLabelMemoryMb = 256 * 1024
+)
+
+// metricsImages are the images that get their own label value, set by
+// loadMetricsImages. Images are free-form, so the rest are counted as other.
+var metricsImages map[string]bool
+
+var (
+	machineCreateDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "machine_create_duration_seconds",
+		Help:      "Time taken by POST /machines, from request to VMM started.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 10),
+	}, []string{"image", "machine_type", "outcome"})
+
+	machineBootDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "machine_boot_duration_seconds",
+		Help:      "Time taken by firecracker to start a VMM.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"image", "machine_type"})
+
+	machineReadyDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "machine_ready_duration_seconds",
+		Help:      "Time from VMM start until the readiness probe first passes.",
+		Buckets:   prometheus.ExponentialBuckets(0.25, 2, 10),
+	}, []string{"image", "machine_type"})
+
+	machineWakeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "machine_wake_duration_seconds",
+		Help:      "Time taken to restore a scaled to zero machine from its snapshot.",
+		Buckets:   prometheus.ExponentialBuckets(0.025, 2, 10),
+	}, []string{"image", "machine_type"})
+
+	runDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "run_duration_seconds",
+		Help:      "Time taken by code runs, including the round trip to the guest agent.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+	}, []string{"image", "machine_type", "outcome"})
+
+	storeErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "store_errors_total",
+		Help:      "Failed state store commands.",
+	}, []string{"command"})
+
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests handled by the API server.",
+	}, []string{"method", "route", "code"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests handled by the API server.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+)
+
+func init() {
+	prometheus.MustRegister(machineCollector{})
+}
+
+// loadMetricsImages reads the comma separated METRICS_IMAGES allow-list,
+// the default image is always on it.
+func loadMetricsImages() {
+	metricsImages = map[string]bool{defaultMachineConfig().Image: true}
+	for _, image := range strings.Split(os.Getenv(MetricsImagesEnvVar), ",") {
+		if image = strings.TrimSpace(image); image != "" {
+			metricsImages[image] = true
+		}
+	}
+}
+
+// imageLabel keeps the image label low-cardinality.
+func imageLabel(image string) string {
+	if metricsImages[image] {
+		return image
+	}
+	return otherLabel
+}
+
+// machineTypeLabel keeps the machine type label low-cardinality. Sizes are
+// rounded up to a power of two and anything past the largest bucket is other.
+func machineTypeLabel(machineType ApiMachineType) string {
+	if machineType.Cpus <= 0 || machineType.Cpus > maxLabelCpus ||
+		machineType.MemoryMb <= 0 || machineType.MemoryMb > maxLabelMemoryMb {
+		return otherLabel
+	}
+	return fmt.Sprintf("%dcpu-%dmb", powerOfTwoBucket(machineType.Cpus), powerOfTwoBucket(machineType.MemoryMb))
+}
+
+func powerOfTwoBucket(n int64) int64 {
+	bucket := int64(1)
+	for bucket < n {
+		bucket <<= 1
+	}
+	return bucket
+}
+
+func observeSince(observer prometheus.Observer, start time.Time) {
+	observer.Observe(time.Since(start).Seconds())
+}
+
+// httpMetricsMiddleware records every request by its route template rather
+// than the raw path, so machine IDs don't end up in labels.
+func httpMetricsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+		if err != nil {
+			c.Error(err)
+		}
+
+		route := c.Path()
+		if route == "" {
+			route = "unmatched"
+		}
+		method := c.Request().Method
+
+		httpRequests.WithLabelValues(method, route, strconv.Itoa(c.Response().Status)).Inc()
+		observeSince(httpRequestDuration.WithLabelValues(method, route), start)
+		return nil
+	}
+}
+
+// machineCollector reads machine and pool counts at scrape time, so they
+// always match the store instead of drifting with missed updates.
+type machineCollector struct{}
+
+var (
+	machinesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "machines"),
+		"Machines known to the store by status.",
+		[]string{"status", "image", "machine_type"}, nil,
+	)
+	managedVMMsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "managed_vmms"),
+		"VMM processes managed by this server.",
+		nil, nil,
+	)
+	ipPoolSizeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "ip_pool", "size"),
+		"Addresses available for leases in the managed subnet.",
+		nil, nil,
+	)
+	ipPoolLeasedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "ip_pool", "leased"),
+		"Addresses currently leased to machines.",
+		nil, nil,
+	)
+)
+
+func (machineCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- machinesDesc
+	ch <- managedVMMsDesc
+	ch <- ipPoolSizeDesc
+	ch <- ipPoolLeasedDesc
+}
+
+func (machineCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx := context.Background()
+
+	ch <- prometheus.MustNewConstMetric(managedVMMsDesc, prometheus.GaugeValue, float64(fcManager.Count()))
+
+	infos, err := listMachineInfos(ctx, "")
+	if err != nil {
+		log.WithError(err).Error("failed to list machines for metrics")
+	} else {
+		type key struct{ status, image, machineType string }
+		counts := make(map[key]int)
+		for _, info := range infos {
+			config := info.machineConfig()
+			counts[key{info.Status, imageLabel(config.Image), machineTypeLabel(config.MachineType)}]++
+		}
+		for k, n := range counts {
+			ch <- prometheus.MustNewConstMetric(machinesDesc, prometheus.GaugeValue, float64(n), k.status, k.image, k.machineType)
+		}
+	}
+
+	if ipam == nil {
+		return
+	}
+
+	ones, bits := ipam.Subnet().Mask.Size()
+	// Network, broadcast and gateway addresses are never leased, which
+	// leaves nothing in a /31 or /32
+	size := uint64(1) << uint(bits-ones)
+	if size > 3 {
+		size -= 3
+	} else {
+		size = 0
+	}
+	ch <- prometheus.MustNewConstMetric(ipPoolSizeDesc, prometheus.GaugeValue, float64(size))
+
+	leases, err := ipam.Leases(ctx)
+	if err != nil {
+		log.WithError(err).Error("failed to list leases for metrics")
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(ipPoolLeasedDesc, prometheus.GaugeValue, float64(len(leases)))
+}
+
+// storeMetricsHook counts failed Redis commands. A missing key is a normal
+// answer, not an error.
+type storeMetricsHook struct{}
+
+func (storeMetricsHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (storeMetricsHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	countStoreError(cmd)
+	return nil
+}
+
+func (storeMetricsHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (storeMetricsHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	for _, cmd := range cmds {
+		countStoreError(cmd)
+	}
+	return nil
+}
+
+func countStoreError(cmd redis.Cmder) {
+	if err := cmd.Err(); err != nil && err != redis.Nil {
+		storeErrors.WithLabelValues(cmd.Name()).Inc()
+	}
+}
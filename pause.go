@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	IdlePauseAfterEnvVar = "IDLE_PAUSE_AFTER"
+
+	idlePauseCheckInterval = 30 * time.Second
+)
+
+// errNotIdle is returned when a machine picked as idle got busy before it
+// could be paused or suspended.
+var errNotIdle = errors.New("machine is no longer idle")
+
+// pauseVM freezes the vCPUs of a running machine. The VMM and the guest's
+// memory stay around, so resuming is instant.
+func pauseVM(ctx context.Context, vm *runningFirecracker) error {
+	vm.stateMu.Lock()
+	defer vm.stateMu.Unlock()
+
+	return pauseLocked(ctx, vm)
+}
+
+// pauseIdleVM is pauseVM for machines idle for at least after. Idleness is
+// checked again under stateMu, a run may have started since the machine was
+// picked.
+func pauseIdleVM(ctx context.Context, vm *runningFirecracker, after time.Duration) error {
+	vm.stateMu.Lock()
+	defer vm.stateMu.Unlock()
+
+	if vm.idleFor() < after {
+		return errNotIdle
+	}
+	return pauseLocked(ctx, vm)
+}
+
+// pauseLocked pauses vm, callers hold its stateMu.
+func pauseLocked(ctx context.Context, vm *runningFirecracker) error {
+	info, err := fetchMachineInfo(ctx, vm.vmmID)
+	if err != nil {
+		return err
+	}
+	status := MachineStatusType(info.Status)
+	if status == StatusPaused {
+		return nil
+	}
+	if status != StatusRunning && status != StatusUnhealthy {
+		return fmt.Errorf("machine is %s, only running machines can be paused", status)
+	}
+
+	if err := vm.machine.PauseVM(ctx); err != nil {
+		return err
+	}
+	vm.paused.Store(true)
+	updateMachineStatus(ctx, vm.vmmID, StatusPaused)
+	return nil
+}
+
+func resumeVM(ctx context.Context, vm *runningFirecracker) error {
+	vm.stateMu.Lock()
+	defer vm.stateMu.Unlock()
+
+	if !vm.paused.Load() {
+		return nil
+	}
+	log.Infof("Resuming paused machine %s", vm.vmmID)
+	if err := vm.machine.ResumeVM(ctx); err != nil {
+		return err
+	}
+	vm.paused.Store(false)
+	vm.touch()
+	updateMachineStatus(ctx, vm.vmmID, StatusRunning)
+	return nil
+}
+
+// wakeMachine resumes a machine that was paused, or restores one that was
+// scaled to zero, before work is sent to it.
+func wakeMachine(ctx context.Context, machineID string) error {
+	unlock := lockMachine(machineID)
+	defer unlock()
+
+	_, err := wakeLocked(ctx, machineID)
+	return err
+}
+
+// startRun wakes a machine for a code run and counts the run before the
+// machine's lock is let go, so it isn't paused or suspended until the
+// returned func ended the run.
+func startRun(ctx context.Context, machineID string) (func(), error) {
+	unlock := lockMachine(machineID)
+	defer unlock()
+
+	vm, err := wakeLocked(ctx, machineID)
+	if err != nil {
+		return nil, err
+	}
+	// Not running here, the run fails on its own
+	if vm == nil {
+		return func() {}, nil
+	}
+
+	vm.runs.Add(1)
+	return func() {
+		vm.touch()
+		vm.runs.Add(-1)
+	}, nil
+}
+
+// wakeLocked does the work of wakeMachine, callers hold the machine's lock.
+// It returns the machine's VMM, if it has one.
+func wakeLocked(ctx context.Context, machineID string) (*runningFirecracker, error) {
+	vm, ok := fcManager.GetVM(machineID)
+	if !ok {
+		if err := restoreMachine(ctx, machineID); err != nil {
+			return nil, err
+		}
+		vm, _ = fcManager.GetVM(machineID)
+		return vm, nil
+	}
+	vm.touch()
+	return vm, resumeVM(ctx, vm)
+}
+
+func pauseMachine(c echo.Context) error {
+	machineID := c.Param("machine_id")
+	vm, ok := fcManager.GetVM(machineID)
+	if !ok {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Machine is not running"})
+	}
+
+	if err := pauseVM(context.Background(), vm); err != nil {
+		if strings.Contains(err.Error(), "only running machines can be paused") {
+			return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+		}
+		return handleError(c, err, http.StatusInternalServerError, "Failed to pause machine")
+	}
+
+	return c.JSON(http.StatusOK, MachineStatusResponse{MachineID: machineID, Status: StatusPaused})
+}
+
+func resumeMachine(c echo.Context) error {
+	machineID := c.Param("machine_id")
+	vm, ok := fcManager.GetVM(machineID)
+	if !ok {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Machine is not running"})
+	}
+	if !vm.paused.Load() {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Machine is not paused"})
+	}
+
+	if err := resumeVM(context.Background(), vm); err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to resume machine")
+	}
+
+	return c.JSON(http.StatusOK, MachineStatusResponse{MachineID: machineID, Status: StatusRunning})
+}
+
+// autoPauseIdleMachines pauses machines that haven't run code or proxied
+// traffic for IDLE_PAUSE_AFTER. They are resumed by the next run or
+// connection.
+func autoPauseIdleMachines(ctx context.Context) {
+	value := os.Getenv(IdlePauseAfterEnvVar)
+	if value == "" || value == "off" {
+		return
+	}
+	after, err := time.ParseDuration(value)
+	if err != nil || after <= 0 {
+		log.Warnf("ignoring %s %q, idle machines won't be paused", IdlePauseAfterEnvVar, value)
+		return
+	}
+
+	ticker := time.NewTicker(idlePauseCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, vm := range fcManager.List() {
+			if vm.paused.Load() || vm.stopRequested() || vm.idleFor() < after {
+				continue
+			}
+
+			info, err := fetchMachineInfo(ctx, vm.vmmID)
+			if err != nil || MachineStatusType(info.Status) != StatusRunning {
+				continue
+			}
+
+			if err := pauseIdleVM(ctx, vm, after); err != nil {
+				if err != errNotIdle {
+					log.WithError(err).Errorf("failed to pause idle machine %s", vm.vmmID)
+				}
+				continue
+			}
+			log.Infof("Paused machine %s after %s without activity", vm.vmmID, vm.idleFor().Round(time.Second))
+		}
+	}
+}
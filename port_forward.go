@@ -0,0 +1,353 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ProtocolTCP = "tcp"
+	ProtocolUDP = "udp"
+
+	PortForwardAddressEnvVar = "PORT_FORWARD_ADDRESS"
+	PortForwardRangeEnvVar   = "PORT_FORWARD_RANGE"
+
+	defaultPortForwardAddress = "127.0.0.1"
+	defaultPortForwardRange   = "1024-65535"
+
+	udpSessionIdleTimeout = 2 * time.Minute
+	udpBufferSize         = 64 * 1024
+	// udpMaxSessions bounds the client addresses a UDP port keeps upstream
+	// sockets for, the least recently seen one makes room for a new client
+	udpMaxSessions = 1024
+)
+
+// portForwardAddress is the host address forwarded ports listen on, and
+// host ports can only be picked from portForwardMin to portForwardMax.
+var (
+	portForwardAddress             = defaultPortForwardAddress
+	portForwardMin, portForwardMax = 1024, 65535
+)
+
+// portForwarder proxies host ports to a guest in userspace. One forwarder
+// serves all the port mappings of a machine.
+type portForwarder struct {
+	machineID string
+	guestIP   net.IP
+
+	// activity is called for every connection or datagram session
+	activity func()
+	// open counts TCP connections being proxied
+	open atomic.Int32
+
+	mu        sync.Mutex
+	listeners []io.Closer
+	conns     map[net.Conn]struct{}
+	closed    bool
+}
+
+// loadPortForwards reads the address forwarded ports listen on and the range
+// host ports may be picked from. By default only the host itself can reach
+// them and privileged ports are off limits.
+func loadPortForwards() error {
+	if address := os.Getenv(PortForwardAddressEnvVar); address != "" {
+		portForwardAddress = address
+	}
+	if net.ParseIP(portForwardAddress) == nil {
+		return fmt.Errorf("invalid %s %q, expected an IP address", PortForwardAddressEnvVar, portForwardAddress)
+	}
+
+	portRange := defaultPortForwardRange
+	if value := os.Getenv(PortForwardRangeEnvVar); value != "" {
+		portRange = value
+	}
+	first, last, ok := strings.Cut(portRange, "-")
+	portMin, minErr := strconv.Atoi(first)
+	portMax, maxErr := strconv.Atoi(last)
+	if !ok || minErr != nil || maxErr != nil || portMin < 1 || portMax > 65535 || portMax < portMin {
+		return fmt.Errorf("invalid %s %q, expected <first>-<last>", PortForwardRangeEnvVar, portRange)
+	}
+	portForwardMin, portForwardMax = portMin, portMax
+	return nil
+}
+
+func validatePortMappings(ports []PortMapping) error {
+	seen := make(map[string]bool)
+	for i := range ports {
+		p := &ports[i]
+		if p.Protocol == "" {
+			p.Protocol = ProtocolTCP
+		}
+		if p.Protocol != ProtocolTCP && p.Protocol != ProtocolUDP {
+			return fmt.Errorf("unsupported protocol %q, expected tcp or udp", p.Protocol)
+		}
+		if p.HostPort < 1 || p.HostPort > 65535 || p.GuestPort < 1 || p.GuestPort > 65535 {
+			return fmt.Errorf("invalid port mapping %d:%d, ports must be between 1 and 65535", p.HostPort, p.GuestPort)
+		}
+		if p.HostPort < portForwardMin || p.HostPort > portForwardMax {
+			return fmt.Errorf("host port %d is not allowed, host ports must be between %d and %d", p.HostPort, portForwardMin, portForwardMax)
+		}
+
+		key := p.Protocol + "/" + strconv.Itoa(p.HostPort)
+		if seen[key] {
+			return fmt.Errorf("host port %s is mapped more than once", key)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+func startPortForwards(machineID string, guestIP net.IP, ports []PortMapping, activity func()) (*portForwarder, error) {
+	pf := &portForwarder{
+		machineID: machineID,
+		guestIP:   guestIP,
+		activity:  activity,
+		conns:     make(map[net.Conn]struct{}),
+	}
+
+	for _, p := range ports {
+		var err error
+		switch p.Protocol {
+		case ProtocolUDP:
+			err = pf.forwardUDP(p)
+		default:
+			err = pf.forwardTCP(p)
+		}
+		if err != nil {
+			pf.Close()
+			return nil, fmt.Errorf("failed to forward %s port %d: %v", p.Protocol, p.HostPort, err)
+		}
+
+		log.Infof("Forwarding %s host port %d to %s:%d for machine %s", p.Protocol, p.HostPort, guestIP, p.GuestPort, machineID)
+	}
+
+	return pf, nil
+}
+
+// Close stops accepting new connections and drops the ones being proxied.
+func (pf *portForwarder) Close() {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	if pf.closed {
+		return
+	}
+	pf.closed = true
+
+	for _, l := range pf.listeners {
+		l.Close()
+	}
+	for conn := range pf.conns {
+		conn.Close()
+	}
+	log.Infof("Stopped port forwards for machine %s", pf.machineID)
+}
+
+// busy reports whether a connection to the guest is open. Idle policies
+// leave the machine alone while it is.
+func (pf *portForwarder) busy() bool {
+	return pf.open.Load() > 0
+}
+
+func (pf *portForwarder) track(l io.Closer) {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	pf.listeners = append(pf.listeners, l)
+}
+
+// trackConn registers a proxied connection so Close can drop it. It reports
+// false, and closes conn, if the forwarder is already closed.
+func (pf *portForwarder) trackConn(conn net.Conn) bool {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	if pf.closed {
+		conn.Close()
+		return false
+	}
+	pf.conns[conn] = struct{}{}
+	return true
+}
+
+func (pf *portForwarder) untrackConn(conn net.Conn) {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	delete(pf.conns, conn)
+}
+
+func (pf *portForwarder) listenAddr(port int) string {
+	return net.JoinHostPort(portForwardAddress, strconv.Itoa(port))
+}
+
+func (pf *portForwarder) guestAddr(port int) string {
+	return net.JoinHostPort(pf.guestIP.String(), strconv.Itoa(port))
+}
+
+func (pf *portForwarder) forwardTCP(p PortMapping) error {
+	l, err := net.Listen("tcp", pf.listenAddr(p.HostPort))
+	if err != nil {
+		return err
+	}
+	pf.track(l)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go pf.proxyTCP(conn, p.GuestPort)
+		}
+	}()
+
+	return nil
+}
+
+func (pf *portForwarder) proxyTCP(conn net.Conn, guestPort int) {
+	if !pf.trackConn(conn) {
+		return
+	}
+	defer pf.untrackConn(conn)
+	defer conn.Close()
+
+	// A connection keeps the machine busy for as long as it's open
+	pf.open.Add(1)
+	defer pf.open.Add(-1)
+	pf.activity()
+	defer pf.activity()
+
+	guestConn, err := net.DialTimeout("tcp", pf.guestAddr(guestPort), 5*time.Second)
+	if err != nil {
+		log.WithError(err).Warnf("failed to reach port %d of machine %s", guestPort, pf.machineID)
+		return
+	}
+	if !pf.trackConn(guestConn) {
+		return
+	}
+	defer pf.untrackConn(guestConn)
+	defer guestConn.Close()
+
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		if tcp, ok := dst.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+
+	go pipe(guestConn, conn)
+	go pipe(conn, guestConn)
+	<-done
+	<-done
+}
+
+func (pf *portForwarder) forwardUDP(p PortMapping) error {
+	l, err := net.ListenPacket("udp", pf.listenAddr(p.HostPort))
+	if err != nil {
+		return err
+	}
+	pf.track(l)
+
+	go pf.proxyUDP(l, p.GuestPort)
+	return nil
+}
+
+// udpSession is the upstream socket of one client of a UDP port.
+type udpSession struct {
+	conn     net.Conn
+	lastSeen time.Time
+}
+
+// proxyUDP keeps one upstream socket per client address so that replies
+// from the guest can be routed back to the right client. Sessions end after
+// udpSessionIdleTimeout without replies, or when udpMaxSessions newer
+// clients have come along.
+func (pf *portForwarder) proxyUDP(l net.PacketConn, guestPort int) {
+	var mu sync.Mutex
+	sessions := make(map[string]*udpSession)
+
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, clientAddr, err := l.ReadFrom(buf)
+		if err != nil {
+			mu.Lock()
+			for _, s := range sessions {
+				s.conn.Close()
+			}
+			mu.Unlock()
+			return
+		}
+		pf.activity()
+
+		mu.Lock()
+		session, ok := sessions[clientAddr.String()]
+		if !ok {
+			if len(sessions) >= udpMaxSessions {
+				evictOldestSession(sessions)
+			}
+
+			conn, err := net.Dial("udp", pf.guestAddr(guestPort))
+			if err != nil {
+				mu.Unlock()
+				log.WithError(err).Warnf("failed to reach udp port %d of machine %s", guestPort, pf.machineID)
+				continue
+			}
+			session = &udpSession{conn: conn}
+			sessions[clientAddr.String()] = session
+
+			go func(session *udpSession, clientAddr net.Addr) {
+				defer func() {
+					mu.Lock()
+					if sessions[clientAddr.String()] == session {
+						delete(sessions, clientAddr.String())
+					}
+					mu.Unlock()
+					session.conn.Close()
+				}()
+
+				reply := make([]byte, udpBufferSize)
+				for {
+					session.conn.SetReadDeadline(time.Now().Add(udpSessionIdleTimeout))
+					n, err := session.conn.Read(reply)
+					if err != nil {
+						return
+					}
+					if _, err := l.WriteTo(reply[:n], clientAddr); err != nil {
+						return
+					}
+				}
+			}(session, clientAddr)
+		}
+		session.lastSeen = time.Now()
+		mu.Unlock()
+
+		if _, err := session.conn.Write(buf[:n]); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.WithError(err).Warnf("failed to forward udp packet to machine %s", pf.machineID)
+		}
+	}
+}
+
+// evictOldestSession closes the session of the client seen least recently.
+func evictOldestSession(sessions map[string]*udpSession) {
+	var oldestAddr string
+	var oldest *udpSession
+	for addr, session := range sessions {
+		if oldest == nil || session.lastSeen.Before(oldest.lastSeen) {
+			oldestAddr, oldest = addr, session
+		}
+	}
+	if oldest != nil {
+		delete(sessions, oldestAddr)
+		oldest.conn.Close()
+	}
+}
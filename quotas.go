@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	HostMemoryEnvVar = "HOST_MEMORY_MB"
+	HostVcpusEnvVar  = "HOST_VCPUS"
+
+	// Left to the host itself when the memory available to VMs is derived
+	// from /proc/meminfo
+	hostReservedMemoryMb = 512
+
+	usageMachines = "machines"
+	usageVcpus    = "vcpus"
+	usageMemoryMb = "memory_mb"
+	usageRuns     = "runs"
+	usageDiskMb   = "disk_mb"
+
+	// Set on a host's usage once it keeps its share of the app counters
+	usageLedger = "ledger"
+)
+
+// AppQuota limits what an app can use, zero means no limit.
+type AppQuota struct {
+	MaxMachines       int64 `json:"max_machines,omitempty"`
+	MaxVcpus          int64 `json:"max_vcpus,omitempty"`
+	MaxMemoryMb       int64 `json:"max_memory_mb,omitempty"`
+	MaxConcurrentRuns int64 `json:"max_concurrent_runs,omitempty"`
+	MaxDiskMb         int64 `json:"max_disk_mb,omitempty"`
+}
+
+// Reservation is what a machine was admitted with, on which host. It's held
+// until the machine is deleted, so stopped and failed machines still count.
+type Reservation struct {
+	Host     string `json:"host,omitempty"`
+	Vcpus    int64  `json:"vcpus"`
+	MemoryMb int64  `json:"memory_mb"`
+	DiskMb   int64  `json:"disk_mb,omitempty"`
+}
+
+type Usage struct {
+	Machines int64 `json:"machines"`
+	Vcpus    int64 `json:"vcpus"`
+	MemoryMb int64 `json:"memory_mb"`
+	DiskMb   int64 `json:"disk_mb"`
+	Runs     int64 `json:"runs"`
+}
+
+type AppUsageResponse struct {
+	App   string    `json:"app"`
+	Quota *AppQuota `json:"quota,omitempty"`
+	Usage Usage     `json:"usage"`
+}
+
+type HostCapacityResponse struct {
+	Vcpus    int64 `json:"vcpus"`
+	MemoryMb int64 `json:"memory_mb"`
+	Usage    Usage `json:"usage"`
+}
+
+// AdmissionError explains why a request was turned away. StatusCode is 429
+// for app quotas and 507 when the host is out of capacity.
+type AdmissionError struct {
+	StatusCode int
+	Reason     string
+}
+
+func (e *AdmissionError) Error() string {
+	return e.Reason
+}
+
+func appUsageKey(app string) string {
+	return appKey(app) + ":usage"
+}
+
+func currentHost() string {
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+func hostUsageKey(host string) string {
+	return "host-usage:" + host
+}
+
+// hostAppUsageKey is the share of an app's usage admitted on host. App
+// counters are shared by every host, this is what lets a host rebuild its
+// own part of them without touching the others'.
+func hostAppUsageKey(host, app string) string {
+	return hostUsageKey(host) + ":app:" + app
+}
+
+// usageCheck is one counter to bump on admission, if that keeps it within
+// limit.
+type usageCheck struct {
+	key    string
+	field  string
+	amount int64
+	limit  int64
+	err    *AdmissionError
+}
+
+// reserveScript checks every counter against its limit and only increments
+// them if all fit, so concurrent admissions can't overshoot. It returns the
+// 1-based index of the first check that failed, or 0.
+var reserveScript = redis.NewScript(`
+for i = 1, #KEYS do
+	local amount = tonumber(ARGV[i * 3 - 1])
+	local limit = tonumber(ARGV[i * 3])
+	local current = tonumber(redis.call("HGET", KEYS[i], ARGV[i * 3 - 2]) or "0")
+	if limit > 0 and current + amount > limit then
+		return i
+	end
+end
+for i = 1, #KEYS do
+	redis.call("HINCRBY", KEYS[i], ARGV[i * 3 - 2], ARGV[i * 3 - 1])
+end
+return 0
+`)
+
+func reserve(ctx context.Context, checks []usageCheck) error {
+	keys := make([]string, 0, len(checks))
+	args := make([]interface{}, 0, len(checks)*3)
+	for _, check := range checks {
+		keys = append(keys, check.key)
+		args = append(args, check.field, check.amount, check.limit)
+	}
+
+	failed, err := reserveScript.Run(ctx, rdb, keys, args...).Int()
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return checks[failed-1].err
+	}
+	return nil
+}
+
+func release(ctx context.Context, checks []usageCheck) {
+	pipe := rdb.TxPipeline()
+	for _, check := range checks {
+		pipe.HIncrBy(ctx, check.key, check.field, -check.amount)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.WithError(err).Error("failed to release reserved resources")
+	}
+}
+
+// hostCapacity is what the host offers to VMs: HOST_VCPUS and HOST_MEMORY_MB
+// if set, otherwise every CPU and all memory but a reserve for the host.
+func hostCapacity() (vcpus, memoryMb int64) {
+	vcpus = int64(runtime.NumCPU())
+	if value, err := strconv.ParseInt(os.Getenv(HostVcpusEnvVar), 10, 64); err == nil && value > 0 {
+		vcpus = value
+	}
+
+	if value, err := strconv.ParseInt(os.Getenv(HostMemoryEnvVar), 10, 64); err == nil && value > 0 {
+		return vcpus, value
+	}
+	total, err := hostMeminfoMb("MemTotal")
+	if err != nil {
+		log.WithError(err).Warn("failed to read host memory, not limiting memory")
+		return vcpus, 0
+	}
+	return vcpus, total - hostReservedMemoryMb
+}
+
+// hostMeminfoMb reads a field of /proc/meminfo, like MemTotal, in MiB.
+func hostMeminfoMb(field string) (int64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == field+":" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0, err
+			}
+			return kb / 1024, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("%s missing from /proc/meminfo", field)
+}
+
+// validateMachineType checks the sizes a machine is admitted and booted with.
+func validateMachineType(machineType ApiMachineType) error {
+	if machineType.Cpus <= 0 {
+		return fmt.Errorf("cpus must be at least 1")
+	}
+	if machineType.MemoryMb <= 0 {
+		return fmt.Errorf("memory_mb must be at least 1")
+	}
+	return nil
+}
+
+func machineChecks(app string, quota AppQuota, reservation Reservation) []usageCheck {
+	hostVcpus, hostMemoryMb := hostCapacity()
+	hostApp := hostAppUsageKey(reservation.Host, app)
+
+	return append([]usageCheck{
+		{appUsageKey(app), usageMachines, 1, quota.MaxMachines, &AdmissionError{
+			http.StatusTooManyRequests, fmt.Sprintf("app %s is at its quota of %d machines", app, quota.MaxMachines),
+		}},
+		{appUsageKey(app), usageVcpus, reservation.Vcpus, quota.MaxVcpus, &AdmissionError{
+			http.StatusTooManyRequests, fmt.Sprintf("%d more vCPUs would exceed the quota of %d vCPUs of app %s", reservation.Vcpus, quota.MaxVcpus, app),
+		}},
+		{appUsageKey(app), usageMemoryMb, reservation.MemoryMb, quota.MaxMemoryMb, &AdmissionError{
+			http.StatusTooManyRequests, fmt.Sprintf("%d MiB more would exceed the memory quota of %d MiB of app %s", reservation.MemoryMb, quota.MaxMemoryMb, app),
+		}},
+		{hostUsageKey(reservation.Host), usageVcpus, reservation.Vcpus, hostVcpus, &AdmissionError{
+			http.StatusInsufficientStorage, fmt.Sprintf("host doesn't have %d vCPUs left", reservation.Vcpus),
+		}},
+		{hostUsageKey(reservation.Host), usageMemoryMb, reservation.MemoryMb, hostMemoryMb, &AdmissionError{
+			http.StatusInsufficientStorage, fmt.Sprintf("host doesn't have %d MiB of memory left", reservation.MemoryMb),
+		}},
+		{hostApp, usageMachines, 1, 0, nil},
+		{hostApp, usageVcpus, reservation.Vcpus, 0, nil},
+		{hostApp, usageMemoryMb, reservation.MemoryMb, 0, nil},
+	}, diskChecks(app, quota, reservation.Host, reservation.DiskMb)...)
+}
+
+// diskChecks counts diskMb more of disk against an app's quota. Disks are
+// sparse, this is what they may grow to rather than what they take up.
+func diskChecks(app string, quota AppQuota, host string, diskMb int64) []usageCheck {
+	return []usageCheck{
+		{appUsageKey(app), usageDiskMb, diskMb, quota.MaxDiskMb, &AdmissionError{
+			http.StatusTooManyRequests, fmt.Sprintf("%d MiB more of disk would exceed the disk quota of %d MiB of app %s", diskMb, quota.MaxDiskMb, app),
+		}},
+		{hostAppUsageKey(host, app), usageDiskMb, diskMb, 0, nil},
+	}
+}
+
+// imageSizeMB is the size of the base rootfs, rounded up to whole MiB.
+func imageSizeMB() (int64, error) {
+	info, err := os.Stat(os.Getenv(RootFSPathEnvVar))
+	if err != nil {
+		return 0, err
+	}
+	return (info.Size() + 1<<20 - 1) >> 20, nil
+}
+
+// machineDiskMb is the size of a machine type's rootfs, the image's unless
+// disk_size_mb is set.
+func machineDiskMb(machineType ApiMachineType) int64 {
+	if machineType.DiskSizeMb > 0 {
+		return machineType.DiskSizeMb
+	}
+	imageMb, err := imageSizeMB()
+	if err != nil {
+		return 0
+	}
+	return imageMb
+}
+
+func appQuota(ctx context.Context, app string) (AppQuota, error) {
+	stored, err := fetchApp(ctx, app)
+	if err != nil {
+		return AppQuota{}, err
+	}
+	if stored.Quota == nil {
+		return AppQuota{}, nil
+	}
+	return *stored.Quota, nil
+}
+
+// admitMachine reserves the resources of a new machine against its app's
+// quota and the host's capacity. Rejections are *AdmissionError.
+func admitMachine(ctx context.Context, machineConfig *ApiMachineConfig) (*Reservation, error) {
+	quota, err := appQuota(ctx, machineConfig.AppName)
+	if err != nil {
+		return nil, err
+	}
+
+	reservation := &Reservation{
+		Host:     currentHost(),
+		Vcpus:    machineConfig.MachineType.Cpus,
+		MemoryMb: machineConfig.MachineType.MemoryMb,
+		DiskMb:   machineDiskMb(machineConfig.MachineType),
+	}
+	if err := reserve(ctx, machineChecks(machineConfig.AppName, quota, *reservation)); err != nil {
+		return nil, err
+	}
+	return reservation, nil
+}
+
+// releaseMachine gives back what a machine reserved at admission. It's safe
+// to call more than once.
+func releaseMachine(ctx context.Context, machineID string) {
+	var app string
+	var reservation *Reservation
+	err := updateMachineInfo(ctx, machineID, func(info *MachineInfo) {
+		app = info.machineConfig().AppName
+		reservation = info.Reservation
+		info.Reservation = nil
+	})
+	if err != nil {
+		log.WithError(err).Errorf("failed to release resources of machine %s", machineID)
+		return
+	}
+	if reservation != nil {
+		// Reservations from before hosts were recorded were all made here
+		if reservation.Host == "" {
+			reservation.Host = currentHost()
+		}
+		release(ctx, machineChecks(app, AppQuota{}, *reservation))
+	}
+}
+
+// admitRun counts a run against the app's concurrent run quota. The returned
+// func ends it.
+func admitRun(ctx context.Context, app string) (func(), error) {
+	quota, err := appQuota(ctx, app)
+	if err != nil {
+		return nil, err
+	}
+
+	checks := []usageCheck{
+		{appUsageKey(app), usageRuns, 1, quota.MaxConcurrentRuns, &AdmissionError{
+			http.StatusTooManyRequests, fmt.Sprintf("app %s is at its quota of %d concurrent runs", app, quota.MaxConcurrentRuns),
+		}},
+		{hostAppUsageKey(currentHost(), app), usageRuns, 1, 0, nil},
+	}
+	if err := reserve(ctx, checks); err != nil {
+		return nil, err
+	}
+	return func() { release(context.Background(), checks) }, nil
+}
+
+// rebuildUsage recomputes this host's usage from the records of the machines
+// admitted on it, so reservations lost to a crash don't stay counted forever.
+// Runs in flight here didn't survive the restart either. App counters are
+// moved by the difference between the rebuilt share of this host and the
+// one it had counted, other hosts' shares are left alone.
+func rebuildUsage(ctx context.Context) error {
+	infos, err := listMachineInfos(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	host := currentHost()
+	apps := make(map[string]*Usage)
+	hostUsage := &Usage{}
+	for _, info := range infos {
+		if info.Reservation == nil {
+			continue
+		}
+		// Reservations from before hosts were recorded were all made here
+		if info.Reservation.Host != "" && info.Reservation.Host != host {
+			continue
+		}
+		app := info.machineConfig().AppName
+		if apps[app] == nil {
+			apps[app] = &Usage{}
+		}
+		apps[app].Machines++
+		apps[app].Vcpus += info.Reservation.Vcpus
+		apps[app].MemoryMb += info.Reservation.MemoryMb
+		apps[app].DiskMb += info.Reservation.DiskMb
+		hostUsage.Vcpus += info.Reservation.Vcpus
+		hostUsage.MemoryMb += info.Reservation.MemoryMb
+	}
+
+	snapshots, err := listSnapshots(ctx)
+	if err != nil {
+		return err
+	}
+	for i := range snapshots {
+		snapshot := &snapshots[i]
+		if snapshot.host() != host {
+			continue
+		}
+		if apps[snapshot.App] == nil {
+			apps[snapshot.App] = &Usage{}
+		}
+		apps[snapshot.App].DiskMb += snapshot.diskMb()
+	}
+
+	volumes, err := listVolumes(ctx)
+	if err != nil {
+		return err
+	}
+	for _, volume := range volumes {
+		if volume.host() != host {
+			continue
+		}
+		if apps[volume.App] == nil {
+			apps[volume.App] = &Usage{}
+		}
+		apps[volume.App].DiskMb += volume.SizeMB
+	}
+
+	known, err := listApps(ctx)
+	if err != nil {
+		return err
+	}
+	// Before hosts kept their share, every rebuild overwrote the app
+	// counters with its own, so that's what they hold the first time round
+	hasLedger, err := rdb.HExists(ctx, hostUsageKey(host), usageLedger).Result()
+	if err != nil {
+		return err
+	}
+
+	pipe := rdb.TxPipeline()
+	for _, app := range known {
+		usage := apps[app.Name]
+		if usage == nil {
+			usage = &Usage{}
+		}
+		countedKey := hostAppUsageKey(host, app.Name)
+		if !hasLedger {
+			countedKey = appUsageKey(app.Name)
+		}
+		counted, err := readUsage(ctx, countedKey)
+		if err != nil {
+			return err
+		}
+
+		key := appUsageKey(app.Name)
+		pipe.HIncrBy(ctx, key, usageMachines, usage.Machines-counted.Machines)
+		pipe.HIncrBy(ctx, key, usageVcpus, usage.Vcpus-counted.Vcpus)
+		pipe.HIncrBy(ctx, key, usageMemoryMb, usage.MemoryMb-counted.MemoryMb)
+		pipe.HIncrBy(ctx, key, usageDiskMb, usage.DiskMb-counted.DiskMb)
+		pipe.HIncrBy(ctx, key, usageRuns, -counted.Runs)
+		pipe.HSet(ctx, hostAppUsageKey(host, app.Name), usageMachines, usage.Machines, usageVcpus, usage.Vcpus, usageMemoryMb, usage.MemoryMb, usageDiskMb, usage.DiskMb, usageRuns, 0)
+	}
+	pipe.HSet(ctx, hostUsageKey(host), usageVcpus, hostUsage.Vcpus, usageMemoryMb, hostUsage.MemoryMb, usageLedger, 1)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func readUsage(ctx context.Context, key string) (Usage, error) {
+	values, err := rdb.HGetAll(ctx, key).Result()
+	if err != nil {
+		return Usage{}, err
+	}
+
+	field := func(name string) int64 {
+		n, _ := strconv.ParseInt(values[name], 10, 64)
+		return n
+	}
+	return Usage{
+		Machines: field(usageMachines),
+		Vcpus:    field(usageVcpus),
+		MemoryMb: field(usageMemoryMb),
+		DiskMb:   field(usageDiskMb),
+		Runs:     field(usageRuns),
+	}, nil
+}
+
+func setAppQuota(c echo.Context) error {
+	name := c.Param("app_name")
+	ctx := context.Background()
+
+	var quota AppQuota
+	if err := c.Bind(&quota); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	if quota.MaxMachines < 0 || quota.MaxVcpus < 0 || quota.MaxMemoryMb < 0 || quota.MaxConcurrentRuns < 0 || quota.MaxDiskMb < 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "quota limits must not be negative"})
+	}
+
+	app, err := fetchApp(ctx, name)
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to fetch app")
+	}
+	app.Quota = &quota
+
+	data, err := json.Marshal(app)
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to update quota")
+	}
+	if err := rdb.HSet(ctx, appsKey, name, data).Err(); err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to update quota")
+	}
+
+	return c.JSON(http.StatusOK, app)
+}
+
+func getAppUsage(c echo.Context) error {
+	name := c.Param("app_name")
+	ctx := context.Background()
+
+	app, err := fetchApp(ctx, name)
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to fetch app")
+	}
+	usage, err := readUsage(ctx, appUsageKey(name))
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to fetch usage")
+	}
+
+	return c.JSON(http.StatusOK, AppUsageResponse{App: name, Quota: app.Quota, Usage: usage})
+}
+
+func getHostCapacity(c echo.Context) error {
+	usage, err := readUsage(context.Background(), hostUsageKey(currentHost()))
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to fetch usage")
+	}
+
+	vcpus, memoryMb := hostCapacity()
+	return c.JSON(http.StatusOK, HostCapacityResponse{Vcpus: vcpus, MemoryMb: memoryMb, Usage: usage})
+}
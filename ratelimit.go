@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	RateLimitCreateEnvVar = "RATE_LIMIT_CREATE"
+	RateLimitRunEnvVar    = "RATE_LIMIT_RUN"
+
+	defaultCreateRateLimit = "10/m"
+	defaultRunRateLimit    = "60/m"
+)
+
+// RateLimit is a token bucket that holds up to Burst tokens and refills at
+// Burst per Period.
+type RateLimit struct {
+	Burst  int64
+	Period time.Duration
+}
+
+func (limit *RateLimit) String() string {
+	unit := map[time.Duration]string{time.Second: "s", time.Minute: "m", time.Hour: "h"}[limit.Period]
+	return fmt.Sprintf("%d/%s", limit.Burst, unit)
+}
+
+// parseRateLimit reads limits like "10/m", "100/h" or "5/s". "off" or "0"
+// disables the limit.
+func parseRateLimit(value string) (*RateLimit, error) {
+	if value == "off" || value == "0" {
+		return nil, nil
+	}
+
+	count, unit, ok := strings.Cut(value, "/")
+	if !ok {
+		return nil, fmt.Errorf("invalid rate limit %q, expected <count>/<s|m|h>", value)
+	}
+	burst, err := strconv.ParseInt(count, 10, 64)
+	if err != nil || burst <= 0 {
+		return nil, fmt.Errorf("invalid rate limit %q, count must be a positive number", value)
+	}
+
+	periods := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}
+	period, ok := periods[unit]
+	if !ok {
+		return nil, fmt.Errorf("invalid rate limit %q, period must be s, m or h", value)
+	}
+	return &RateLimit{Burst: burst, Period: period}, nil
+}
+
+func rateLimitFromEnv(envVar, fallback string) *RateLimit {
+	value := os.Getenv(envVar)
+	if value == "" {
+		value = fallback
+	}
+
+	limit, err := parseRateLimit(value)
+	if err != nil {
+		log.WithError(err).Warnf("ignoring %s, using %s", envVar, fallback)
+		limit, _ = parseRateLimit(fallback)
+	}
+	return limit
+}
+
+// tokenBucketScript refills and takes a token from every bucket in KEYS, or
+// from none if any of them is empty. It uses the store's clock, so servers
+// sharing the store agree on the buckets. Returns whether the request is
+// allowed, the tokens left in the emptiest bucket and, if not allowed, the
+// milliseconds until a token is available.
+var tokenBucketScript = redis.NewScript(`
+local burst = tonumber(ARGV[1])
+local rate = burst / tonumber(ARGV[2])
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local tokens = {}
+local remaining = burst
+local wait = 0
+for i = 1, #KEYS do
+	local state = redis.call("HMGET", KEYS[i], "tokens", "ts")
+	local available = tonumber(state[1]) or burst
+	local ts = tonumber(state[2]) or now
+	available = math.min(burst, available + (now - ts) * rate)
+	tokens[i] = available
+	remaining = math.min(remaining, available)
+	if available < 1 then
+		wait = math.max(wait, math.ceil((1 - available) / rate))
+	end
+end
+
+if wait > 0 then
+	return {0, math.floor(remaining), wait}
+end
+
+for i = 1, #KEYS do
+	redis.call("HSET", KEYS[i], "tokens", tostring(tokens[i] - 1), "ts", now)
+	redis.call("PEXPIRE", KEYS[i], math.ceil(burst / rate))
+end
+return {1, math.floor(remaining - 1), 0}
+`)
+
+// rateLimit limits a route per API key and per client IP. Both buckets have
+// to have a token left. If the store can't be reached requests are let
+// through rather than failing the API.
+func rateLimit(name string, limit *RateLimit) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		if limit == nil {
+			return next
+		}
+
+		return func(c echo.Context) error {
+			keys := []string{"ratelimit:" + name + ":ip:" + c.RealIP()}
+			if key := callerKey(c); key != nil {
+				keys = append(keys, "ratelimit:"+name+":key:"+key.ID)
+			}
+
+			result, err := tokenBucketScript.Run(c.Request().Context(), rdb, keys, limit.Burst, limit.Period.Milliseconds()).Int64Slice()
+			if err != nil {
+				log.WithError(err).Errorf("failed to check %s rate limit", name)
+				return next(c)
+			}
+			allowed, remaining, waitMs := result[0] == 1, result[1], result[2]
+
+			header := c.Response().Header()
+			header.Set("X-RateLimit-Limit", fmt.Sprintf("%d;w=%d", limit.Burst, int64(limit.Period.Seconds())))
+			header.Set("X-RateLimit-Remaining", strconv.FormatInt(remaining, 10))
+
+			if !allowed {
+				retryAfter := int64(math.Ceil(float64(waitMs) / 1000))
+				header.Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+				header.Set("X-RateLimit-Reset", strconv.FormatInt(retryAfter, 10))
+				return c.JSON(http.StatusTooManyRequests, map[string]string{
+					"error": fmt.Sprintf("%s rate limit of %s exceeded, retry in %ds", name, limit, retryAfter),
+				})
+			}
+
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	log "github.com/sirupsen/logrus"
+)
+
+// reconcileMachines brings the in-memory manager back in line with the store
+// after a server restart: live firecracker processes are adopted again,
+// machines whose VMM is gone are marked failed, scaled to zero machines get
+// their port forwards back, and volumes and files that no machine owns
+// anymore are freed.
+func reconcileMachines(ctx context.Context) error {
+	infos, err := listMachineInfos(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	for machineID, info := range infos {
+		if MachineStatusType(info.Status) == StatusSuspended {
+			if err := listenForSuspended(machineID, info); err != nil {
+				log.WithError(err).Errorf("failed to restore port forwards of machine %s", machineID)
+			}
+			continue
+		}
+		if !isActiveStatus(MachineStatusType(info.Status)) {
+			continue
+		}
+		if _, ok := fcManager.GetVM(machineID); ok {
+			continue
+		}
+
+		socketPath := info.SocketPath
+		if socketPath == "" {
+			socketPath = findSocketPath(machineID)
+		}
+
+		pid := info.PID
+		if pid == 0 || !isFirecrackerProcess(pid, socketPath) {
+			pid = findFirecrackerPID(socketPath)
+		}
+
+		if pid == 0 {
+			log.Warnf("VMM of machine %s is gone, marking it as failed", machineID)
+			updateMachineStatus(ctx, machineID, StatusFailed)
+			if socketPath != "" {
+				removeIfExists(socketPath)
+			}
+			continue
+		}
+
+		vm, err := attachVM(ctx, machineID, info, socketPath, pid)
+		if err != nil {
+			log.WithError(err).Errorf("failed to re-attach to machine %s", machineID)
+			continue
+		}
+
+		fcManager.AddVM(machineID, vm)
+		go superviseVM(vm)
+
+		machineConfig := info.machineConfig()
+		go monitorMachineHealth(vm, &machineConfig)
+		log.WithField("pid", pid).Infof("Re-attached to machine %s", machineID)
+	}
+
+	detachOrphanedVolumes(ctx, infos)
+	cleanupOrphanedFiles(infos)
+	return nil
+}
+
+func isActiveStatus(status MachineStatusType) bool {
+	return status == StatusPending || status == StatusRunning || status == StatusUnhealthy || status == StatusPaused
+}
+
+// attachVM builds a runningFirecracker around a VMM started by an earlier
+// server process. Only the API socket is used to talk to it.
+func attachVM(ctx context.Context, machineID string, info *MachineInfo, socketPath string, pid int) (*runningFirecracker, error) {
+	vmmCtx, vmmCancel := context.WithCancel(ctx)
+
+	m, err := firecracker.NewMachine(vmmCtx, firecracker.Config{
+		SocketPath:        socketPath,
+		VMID:              machineID,
+		DisableValidation: true,
+	}, firecracker.WithLogger(log.NewEntry(log.New())))
+	if err != nil {
+		vmmCancel()
+		return nil, err
+	}
+
+	vm := &runningFirecracker{
+		vmmCtx:    vmmCtx,
+		vmmCancel: vmmCancel,
+		vmmID:     machineID,
+		machine:   m,
+		ip:        net.ParseIP(info.IP),
+		mac:       info.MAC,
+		pid:       pid,
+		attached:  true,
+	}
+	vm.touch()
+	vm.paused.Store(MachineStatusType(info.Status) == StatusPaused)
+
+	if err := startMachinePortForwards(ctx, vm, info.machineConfig().Ports); err != nil {
+		log.WithError(err).Errorf("failed to restore port forwards of machine %s", machineID)
+	}
+
+	err = updateMachineInfo(ctx, machineID, func(info *MachineInfo) {
+		info.PID = pid
+		info.SocketPath = socketPath
+	})
+	if err != nil {
+		log.WithError(err).Errorf("failed to update machine info of %s", machineID)
+	}
+
+	return vm, nil
+}
+
+// findSocketPath looks for the API socket of a machine. Socket names carry the
+// PID of the server that created them, so any PID matches.
+func findSocketPath(machineID string) string {
+	if jailer != nil {
+		path := filepath.Join(jailer.rootDir(machineID), jailSocketName)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(os.TempDir(), ".firecracker.sock-*-"+machineID))
+	if len(matches) == 0 {
+		return ""
+	}
+	return matches[0]
+}
+
+func isFirecrackerProcess(pid int, socketPath string) bool {
+	if err := syscall.Kill(pid, 0); err != nil && err != syscall.EPERM {
+		return false
+	}
+
+	cmdline, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		return false
+	}
+
+	if machineID, ok := jailedMachineID(socketPath); ok {
+		return bytes.Contains(cmdline, []byte("--id\x00"+machineID+"\x00"))
+	}
+	return socketPath != "" && bytes.Contains(cmdline, []byte(socketPath))
+}
+
+// findFirecrackerPID scans /proc for a process serving socketPath.
+func findFirecrackerPID(socketPath string) int {
+	if socketPath == "" {
+		return 0
+	}
+
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0
+	}
+
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		if isFirecrackerProcess(pid, socketPath) {
+			return pid
+		}
+	}
+	return 0
+}
+
+// cleanupOrphanedFiles removes rootfs copies, jails and API sockets that don't
+// belong to any known machine, plus sockets of machines that aren't running
+// here.
+func cleanupOrphanedFiles(infos map[string]*MachineInfo) {
+	rootfsCopies, _ := filepath.Glob(getRootFSPath("*"))
+	for _, path := range rootfsCopies {
+		machineID := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "rootfs-"), ".ext4")
+		if _, ok := infos[machineID]; !ok {
+			log.Infof("Removing orphaned rootfs %s", path)
+			removeIfExists(path)
+		}
+	}
+
+	if jailer != nil {
+		jails, _ := filepath.Glob(jailer.jailDir("*"))
+		for _, path := range jails {
+			if _, ok := infos[filepath.Base(path)]; !ok {
+				log.Infof("Removing orphaned jail %s", path)
+				if err := os.RemoveAll(path); err != nil {
+					log.WithError(err).Errorf("failed to remove %s", path)
+				}
+			}
+		}
+	}
+
+	snapshots, _ := filepath.Glob(snapshotDir("*"))
+	for _, path := range snapshots {
+		if path == savedSnapshotsDir() {
+			continue
+		}
+		if _, ok := infos[filepath.Base(path)]; !ok {
+			log.Infof("Removing orphaned snapshot %s", path)
+			if err := os.RemoveAll(path); err != nil {
+				log.WithError(err).Errorf("failed to remove %s", path)
+			}
+		}
+	}
+
+	sockets, _ := filepath.Glob(filepath.Join(os.TempDir(), ".firecracker.sock-*-*"))
+	for _, path := range sockets {
+		machineID := path[strings.LastIndex(path, "-")+1:]
+		if _, ok := fcManager.GetVM(machineID); ok {
+			continue
+		}
+		log.Infof("Removing stale socket %s", path)
+		removeIfExists(path)
+	}
+}
+
+func removeIfExists(path string) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.WithError(err).Errorf("failed to remove %s", path)
+	}
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/xid"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	snapshotArchiveVersion = 1
+
+	snapshotManifestName = "manifest.json"
+	maxManifestSize      = 1 << 20
+
+	rootFSExtentsName = "rootfs.extents"
+	maxExtentsSize    = 16 << 20
+
+	// Largest entries an archive may hold, the rootfs is bounded like
+	// disk_size_mb
+	maxSnapshotStateSize  = 32 << 20
+	maxSnapshotMemorySize = 256 << 30
+	maxSnapshotRootFSSize = maxDiskSizeMB << 20
+
+	// Compressed entries are never much larger than they are unpacked
+	maxSnapshotArchiveSize = maxSnapshotStateSize + maxSnapshotMemorySize + maxSnapshotRootFSSize + maxManifestSize + 1<<20
+)
+
+var snapshotEntryLimits = map[string]int64{
+	snapshotManifestName: maxManifestSize,
+	rootFSExtentsName:    maxExtentsSize,
+	"state":              maxSnapshotStateSize,
+	"memory":             maxSnapshotMemorySize,
+	"rootfs":             maxSnapshotRootFSSize,
+}
+
+// diskExtent is a range of a sparse file that holds data.
+type diskExtent struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// dataExtents lists the ranges of f that hold data and its size. Holes, like
+// the space growRootFS added and the guest never wrote, are left out. Where
+// the filesystem can't tell, the whole file is data.
+func dataExtents(f *os.File) ([]diskExtent, int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	size := info.Size()
+
+	var extents []diskExtent
+	fd := int(f.Fd())
+	for offset := int64(0); offset < size; {
+		start, err := unix.Seek(fd, offset, unix.SEEK_DATA)
+		if err == unix.ENXIO {
+			// Nothing but a hole up to the end
+			break
+		}
+		if err == unix.EINVAL && offset == 0 {
+			return []diskExtent{{Offset: 0, Length: size}}, size, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		end, err := unix.Seek(fd, start, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, 0, err
+		}
+		extents = append(extents, diskExtent{Offset: start, Length: end - start})
+		offset = end
+	}
+	return extents, size, nil
+}
+
+// sparseLayout describes a sparse file whose data extents were stored back
+// to back.
+type sparseLayout struct {
+	Size    int64        `json:"size"`
+	Extents []diskExtent `json:"extents"`
+}
+
+// validate checks that the extents are in order, don't overlap, fit in the
+// file and add up to dataSize.
+func (l *sparseLayout) validate(dataSize int64) error {
+	if l.Size < 0 || l.Size > maxSnapshotRootFSSize {
+		return fmt.Errorf("invalid size %d", l.Size)
+	}
+	var end, total int64
+	for _, extent := range l.Extents {
+		if extent.Offset < end || extent.Length <= 0 || extent.Length > l.Size-extent.Offset {
+			return fmt.Errorf("invalid extent at %d", extent.Offset)
+		}
+		end = extent.Offset + extent.Length
+		total += extent.Length
+	}
+	if total != dataSize {
+		return fmt.Errorf("extents hold %d bytes, the data is %d", total, dataSize)
+	}
+	return nil
+}
+
+// SnapshotManifest describes the files of an exported snapshot. It is the
+// last entry of the archive, so checksums can be taken while streaming. The
+// rootfs entry only holds the data of the rootfs, the rootfs.extents entry
+// in front of it says where that goes.
+type SnapshotManifest struct {
+	Version  int               `json:"version"`
+	Snapshot Snapshot          `json:"snapshot"`
+	SHA256   map[string]string `json:"sha256"`
+}
+
+// archiveFiles maps the entries of an exported snapshot to their paths.
+func (s *Snapshot) archiveFiles() map[string]string {
+	return map[string]string{
+		"memory": s.Files.MemFilePath,
+		"state":  s.Files.StatePath,
+		"rootfs": s.RootFS,
+	}
+}
+
+// exportSnapshot streams a snapshot as a gzipped tar that importSnapshot
+// on another host can register.
+func exportSnapshot(c echo.Context) error {
+	snapshot, err := fetchSnapshot(context.Background(), c.Param("snapshot_id"))
+	if err != nil {
+		if strings.Contains(err.Error(), "snapshot not found") {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Snapshot not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+	if !canAccessSnapshot(c, snapshot) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Snapshot not found"})
+	}
+	if host := snapshot.host(); host != currentHost() {
+		return c.JSON(http.StatusConflict, map[string]string{"error": fmt.Sprintf("Snapshot is on host %s, export it there", host)})
+	}
+
+	// Open everything up front, once the body has started an error can only
+	// cut it short. Open files stay readable if the snapshot is deleted.
+	files := make(map[string]*os.File)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for name, path := range snapshot.archiveFiles() {
+		f, err := os.Open(path)
+		if err != nil {
+			return handleError(c, err, http.StatusInternalServerError, "Failed to read snapshot")
+		}
+		files[name] = f
+	}
+
+	header := c.Response().Header()
+	header.Set(echo.HeaderContentType, "application/gzip")
+	header.Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", snapshot.Name+".tar.gz"))
+	c.Response().WriteHeader(http.StatusOK)
+
+	if err := writeSnapshotArchive(c.Response(), snapshot, files); err != nil {
+		log.WithError(err).Errorf("failed to export snapshot %s", snapshot.ID)
+	}
+	return nil
+}
+
+func writeSnapshotArchive(w io.Writer, snapshot *Snapshot, files map[string]*os.File) error {
+	// Memory files are mostly zeroes, the fastest level already shrinks them
+	gz, err := gzip.NewWriterLevel(w, gzip.BestSpeed)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(gz)
+
+	manifest := SnapshotManifest{
+		Version:  snapshotArchiveVersion,
+		Snapshot: *snapshot,
+		SHA256:   make(map[string]string),
+	}
+	// Paths on this host mean nothing to the importing one, except the
+	// rootfs path the VMM state refers to
+	manifest.Snapshot.Files = &MachineSnapshot{
+		TakenAt:    snapshot.Files.TakenAt,
+		RootFSPath: snapshot.Files.RootFSPath,
+	}
+	manifest.Snapshot.RootFS = ""
+
+	for _, name := range []string{"state", "memory"} {
+		info, err := files[name].Stat()
+		if err != nil {
+			return err
+		}
+		manifest.SHA256[name], err = writeArchiveEntry(tw, name, info.Size(), files[name])
+		if err != nil {
+			return err
+		}
+	}
+
+	// A grown rootfs is mostly holes, only its data goes into the archive
+	extents, size, err := dataExtents(files["rootfs"])
+	if err != nil {
+		return err
+	}
+	layout, err := json.Marshal(sparseLayout{Size: size, Extents: extents})
+	if err != nil {
+		return err
+	}
+	manifest.SHA256[rootFSExtentsName], err = writeArchiveEntry(tw, rootFSExtentsName, int64(len(layout)), bytes.NewReader(layout))
+	if err != nil {
+		return err
+	}
+	var dataSize int64
+	readers := make([]io.Reader, 0, len(extents))
+	for _, extent := range extents {
+		readers = append(readers, io.NewSectionReader(files["rootfs"], extent.Offset, extent.Length))
+		dataSize += extent.Length
+	}
+	manifest.SHA256["rootfs"], err = writeArchiveEntry(tw, "rootfs", dataSize, io.MultiReader(readers...))
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if _, err := writeArchiveEntry(tw, snapshotManifestName, int64(len(data)), bytes.NewReader(data)); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// writeArchiveEntry adds a file of size bytes read from r and returns the
+// hex SHA-256 of its content.
+func writeArchiveEntry(tw *tar.Writer, name string, size int64, r io.Reader) (string, error) {
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0600,
+		Size:     size,
+		ModTime:  time.Now(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	digest := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tw, digest), r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// readSnapshotArchive unpacks an exported snapshot into dir and checks its
+// files against the manifest.
+func readSnapshotArchive(r io.Reader, dir string) (*SnapshotManifest, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	var manifest *SnapshotManifest
+	var layout *sparseLayout
+	sums := make(map[string]string)
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("unexpected entry %q", header.Name)
+		}
+		// The tar reader stops every entry at its header's size, checking
+		// it up front keeps a small archive from unpacking into a huge one
+		limit, ok := snapshotEntryLimits[header.Name]
+		if !ok {
+			return nil, fmt.Errorf("unexpected entry %q", header.Name)
+		}
+		if header.Size < 0 || header.Size > limit {
+			return nil, fmt.Errorf("entry %q is larger than %d bytes", header.Name, limit)
+		}
+		if available, err := availableBytes(dir); err == nil && header.Size > available {
+			return nil, fmt.Errorf("not enough space left for entry %q", header.Name)
+		}
+
+		if _, ok := sums[header.Name]; ok {
+			return nil, fmt.Errorf("duplicate entry %q", header.Name)
+		}
+
+		switch header.Name {
+		case snapshotManifestName:
+			manifest = &SnapshotManifest{}
+			if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+				return nil, fmt.Errorf("invalid manifest: %v", err)
+			}
+		case rootFSExtentsName:
+			if _, ok := sums["rootfs"]; ok {
+				return nil, fmt.Errorf("%s must come before the rootfs", rootFSExtentsName)
+			}
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				return nil, err
+			}
+			layout = &sparseLayout{}
+			if err := json.Unmarshal(data, layout); err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", rootFSExtentsName, err)
+			}
+			sum := sha256.Sum256(data)
+			sums[header.Name] = hex.EncodeToString(sum[:])
+		case "rootfs":
+			if layout == nil {
+				return nil, fmt.Errorf("%s must come before the rootfs", rootFSExtentsName)
+			}
+			if err := layout.validate(header.Size); err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", rootFSExtentsName, err)
+			}
+			sum, err := extractFile(tr, filepath.Join(dir, header.Name), layout)
+			if err != nil {
+				return nil, err
+			}
+			sums[header.Name] = sum
+		case "memory", "state":
+			sum, err := extractFile(tr, filepath.Join(dir, header.Name), nil)
+			if err != nil {
+				return nil, err
+			}
+			sums[header.Name] = sum
+		}
+	}
+
+	if manifest == nil {
+		return nil, fmt.Errorf("archive has no %s", snapshotManifestName)
+	}
+	if manifest.Version != snapshotArchiveVersion {
+		return nil, fmt.Errorf("unsupported archive version %d", manifest.Version)
+	}
+	if manifest.Snapshot.Files == nil {
+		return nil, fmt.Errorf("manifest doesn't describe the snapshot's files")
+	}
+	for _, name := range []string{"memory", "state", rootFSExtentsName, "rootfs"} {
+		sum, ok := sums[name]
+		if !ok {
+			return nil, fmt.Errorf("archive has no %s", name)
+		}
+		if sum != manifest.SHA256[name] {
+			return nil, fmt.Errorf("checksum mismatch for %s", name)
+		}
+	}
+
+	return manifest, nil
+}
+
+func availableBytes(dir string) (int64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// validateImportedSnapshot checks what a manifest says about the machine the
+// snapshot was taken of. It comes from whoever uploaded the archive, and
+// restoring trusts it with a host path, a tap name and an address.
+func validateImportedSnapshot(snapshot *Snapshot) error {
+	if _, err := xid.FromString(snapshot.MachineID); err != nil {
+		return fmt.Errorf("invalid machine id %q", snapshot.MachineID)
+	}
+	if snapshot.Files.RootFSPath != getRootFSPath(snapshot.MachineID) {
+		return fmt.Errorf("rootfs path %q is not where this host keeps the machine's rootfs", snapshot.Files.RootFSPath)
+	}
+	if ip, ok := tapIP(snapshot.TapName); !ok || tapName(ip) != snapshot.TapName {
+		return fmt.Errorf("invalid tap name %q", snapshot.TapName)
+	}
+	if ip := net.ParseIP(snapshot.IP); ip == nil || ipam == nil || !ipam.Subnet().Contains(ip) {
+		return fmt.Errorf("address %q is outside of the managed subnet", snapshot.IP)
+	}
+	if err := validateMachineType(snapshot.MachineType); err != nil {
+		return err
+	}
+	if err := validateDiskSize(snapshot.MachineType.DiskSizeMb); err != nil {
+		return err
+	}
+	if snapshot.Config != nil {
+		return validateMachineConfig(snapshot.Config)
+	}
+	return nil
+}
+
+// extractFile writes r to path and returns its hex SHA-256. With a layout r
+// only holds the data extents and the holes between them are left as holes.
+func extractFile(r io.Reader, path string, layout *sparseLayout) (string, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	digest := sha256.New()
+	if layout == nil {
+		if _, err := io.Copy(io.MultiWriter(f, digest), r); err != nil {
+			return "", err
+		}
+	} else {
+		for _, extent := range layout.Extents {
+			if _, err := io.CopyN(io.MultiWriter(io.NewOffsetWriter(f, extent.Offset), digest), r, extent.Length); err != nil {
+				return "", err
+			}
+		}
+		if err := f.Truncate(layout.Size); err != nil {
+			return "", err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// importSnapshot registers a snapshot exported from another host, it lives
+// on this one from then on. What it was taken with is kept, from_snapshot
+// refuses it if this host differs. The app and name can be overridden with
+// the app and name query params.
+func importSnapshot(c echo.Context) error {
+	ctx := context.Background()
+
+	snapshotID := xid.New().String()
+	dir := filepath.Join(savedSnapshotsDir(), snapshotID)
+	stored := false
+	defer func() {
+		if !stored {
+			if err := os.RemoveAll(dir); err != nil {
+				log.WithError(err).Errorf("failed to remove files of snapshot %s", snapshotID)
+			}
+		}
+	}()
+
+	body := http.MaxBytesReader(c.Response(), c.Request().Body, maxSnapshotArchiveSize)
+	manifest, err := readSnapshotArchive(body, dir)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("Invalid snapshot archive: %v", err)})
+	}
+	snapshot := manifest.Snapshot
+	if err := validateImportedSnapshot(&snapshot); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("Invalid snapshot archive: %v", err)})
+	}
+
+	// The app in the path wins, it's already been checked by authorizeApp
+	if app := c.Param("app_name"); app != "" {
+		snapshot.App = app
+	} else {
+		if app := c.QueryParam("app"); app != "" {
+			snapshot.App = app
+		}
+		if !callerKey(c).canAccessApp(snapshot.App) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "App not found"})
+		}
+		if _, err := fetchApp(ctx, snapshot.App); err != nil {
+			if strings.Contains(err.Error(), "app not found") {
+				return c.JSON(http.StatusNotFound, map[string]string{"error": "App not found"})
+			}
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+		}
+	}
+	if name := c.QueryParam("name"); name != "" {
+		snapshot.Name = name
+	}
+	if err := validateSnapshotName(snapshot.Name); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	existing, err := listSnapshots(ctx)
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to fetch snapshots")
+	}
+	for _, other := range existing {
+		if other.App == snapshot.App && other.Name == snapshot.Name {
+			return c.JSON(http.StatusConflict, map[string]string{"error": fmt.Sprintf("App already has a snapshot named %s", snapshot.Name)})
+		}
+	}
+
+	snapshot.ID = snapshotID
+	if snapshot.Config != nil {
+		snapshot.Config.AppName = snapshot.App
+	}
+	snapshot.Files.MemFilePath = filepath.Join(dir, "memory")
+	snapshot.Files.StatePath = filepath.Join(dir, "state")
+	snapshot.RootFS = filepath.Join(dir, "rootfs")
+	snapshot.SizeBytes = fileSize(snapshot.Files.MemFilePath) + fileSize(snapshot.Files.StatePath) + fileSize(snapshot.RootFS)
+	snapshot.Host = currentHost()
+
+	quota, err := appQuota(ctx, snapshot.App)
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to fetch quota")
+	}
+	checks := diskChecks(snapshot.App, quota, snapshot.Host, snapshot.diskMb())
+	if err := reserve(ctx, checks); err != nil {
+		var admissionErr *AdmissionError
+		if errors.As(err, &admissionErr) {
+			return c.JSON(admissionErr.StatusCode, map[string]string{"error": admissionErr.Reason})
+		}
+		return handleError(c, err, http.StatusInternalServerError, "Failed to reserve disk")
+	}
+
+	data, err := json.Marshal(snapshot)
+	if err == nil {
+		err = rdb.HSet(ctx, snapshotsKey, snapshot.ID, data).Err()
+	}
+	if err != nil {
+		release(ctx, checks)
+		return handleError(c, err, http.StatusInternalServerError, "Failed to store snapshot")
+	}
+	stored = true
+
+	return c.JSON(http.StatusCreated, snapshot.public())
+}
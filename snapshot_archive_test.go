@@ -0,0 +1,290 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/xid"
+)
+
+type archiveEntry struct {
+	name     string
+	data     []byte
+	typeflag byte
+}
+
+func buildArchive(t *testing.T, entries []archiveEntry) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, entry := range entries {
+		typeflag := entry.typeflag
+		if typeflag == 0 {
+			typeflag = tar.TypeReg
+		}
+		header := &tar.Header{Typeflag: typeflag, Name: entry.name, Mode: 0600, ModTime: time.Now()}
+		if typeflag == tar.TypeReg {
+			header.Size = int64(len(entry.data))
+		} else {
+			header.Linkname = "/etc/passwd"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(entry.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// validEntries are the entries of an archive of a 1 MiB rootfs holding 4
+// bytes of data at 4096, followed by the manifest for them.
+func validEntries(t *testing.T, tamper func(manifest *SnapshotManifest, layout *sparseLayout)) []archiveEntry {
+	t.Helper()
+	layout := sparseLayout{Size: 1 << 20, Extents: []diskExtent{{Offset: 4096, Length: 4}}}
+	manifest := SnapshotManifest{
+		Version:  snapshotArchiveVersion,
+		Snapshot: Snapshot{Name: "snap", Files: &MachineSnapshot{}},
+	}
+	if tamper != nil {
+		tamper(&manifest, &layout)
+	}
+
+	layoutData, err := json.Marshal(layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []archiveEntry{
+		{name: "state", data: []byte("state")},
+		{name: "memory", data: []byte("memory")},
+		{name: rootFSExtentsName, data: layoutData},
+		{name: "rootfs", data: []byte("data")},
+	}
+	if manifest.SHA256 == nil {
+		manifest.SHA256 = make(map[string]string)
+		for _, entry := range entries {
+			manifest.SHA256[entry.name] = sha256Hex(entry.data)
+		}
+	}
+	manifestData, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(entries, archiveEntry{name: snapshotManifestName, data: manifestData})
+}
+
+func TestReadSnapshotArchive(t *testing.T) {
+	dir := t.TempDir()
+	manifest, err := readSnapshotArchive(buildArchive(t, validEntries(t, nil)), filepath.Join(dir, "snapshot"))
+	if err != nil {
+		t.Fatalf("valid archive: %v", err)
+	}
+	if manifest.Snapshot.Name != "snap" {
+		t.Fatalf("got snapshot %q, want snap", manifest.Snapshot.Name)
+	}
+	rootfs, err := os.ReadFile(filepath.Join(dir, "snapshot", "rootfs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rootfs) != 1<<20 || string(rootfs[4096:4100]) != "data" {
+		t.Fatalf("rootfs wasn't laid out by its extents")
+	}
+}
+
+func TestReadSnapshotArchiveRejects(t *testing.T) {
+	valid := validEntries(t, nil)
+	withEntries := func(edit func([]archiveEntry) []archiveEntry) []archiveEntry {
+		entries := append([]archiveEntry(nil), valid...)
+		return edit(entries)
+	}
+
+	tests := []struct {
+		name    string
+		entries []archiveEntry
+		wantErr string
+	}{
+		{
+			name: "duplicate entry",
+			entries: withEntries(func(entries []archiveEntry) []archiveEntry {
+				return append([]archiveEntry{entries[0]}, entries...)
+			}),
+			wantErr: `duplicate entry "state"`,
+		},
+		{
+			name: "unexpected entry",
+			entries: withEntries(func(entries []archiveEntry) []archiveEntry {
+				return append([]archiveEntry{{name: "../etc/cron.d/x", data: []byte("x")}}, entries...)
+			}),
+			wantErr: "unexpected entry",
+		},
+		{
+			name: "symlink entry",
+			entries: withEntries(func(entries []archiveEntry) []archiveEntry {
+				return append([]archiveEntry{{name: "state", typeflag: tar.TypeSymlink}}, entries[1:]...)
+			}),
+			wantErr: "unexpected entry",
+		},
+		{
+			name: "oversized entry",
+			entries: withEntries(func(entries []archiveEntry) []archiveEntry {
+				entries[len(entries)-1].data = bytes.Repeat([]byte(" "), maxManifestSize+1)
+				return entries
+			}),
+			wantErr: "is larger than",
+		},
+		{
+			name: "rootfs before its extents",
+			entries: withEntries(func(entries []archiveEntry) []archiveEntry {
+				entries[2], entries[3] = entries[3], entries[2]
+				return entries
+			}),
+			wantErr: "must come before the rootfs",
+		},
+		{
+			name: "overlapping extents",
+			entries: validEntries(t, func(_ *SnapshotManifest, layout *sparseLayout) {
+				layout.Extents = []diskExtent{{Offset: 4096, Length: 2}, {Offset: 4097, Length: 2}}
+			}),
+			wantErr: "invalid extent at 4097",
+		},
+		{
+			name: "extent past the end",
+			entries: validEntries(t, func(_ *SnapshotManifest, layout *sparseLayout) {
+				layout.Extents = []diskExtent{{Offset: 1<<20 - 2, Length: 4}}
+			}),
+			wantErr: "invalid extent",
+		},
+		{
+			name: "checksum mismatch",
+			entries: validEntries(t, func(manifest *SnapshotManifest, _ *sparseLayout) {
+				manifest.SHA256 = map[string]string{"memory": sha256Hex([]byte("other"))}
+			}),
+			wantErr: "checksum mismatch for memory",
+		},
+		{
+			name: "missing manifest",
+			entries: withEntries(func(entries []archiveEntry) []archiveEntry {
+				return entries[:len(entries)-1]
+			}),
+			wantErr: "has no manifest.json",
+		},
+		{
+			name: "unknown version",
+			entries: validEntries(t, func(manifest *SnapshotManifest, _ *sparseLayout) {
+				manifest.Version = snapshotArchiveVersion + 1
+			}),
+			wantErr: "unsupported archive version",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readSnapshotArchive(buildArchive(t, tt.entries), filepath.Join(t.TempDir(), "snapshot"))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSparseLayoutValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		layout   sparseLayout
+		dataSize int64
+		valid    bool
+	}{
+		{"in order", sparseLayout{Size: 100, Extents: []diskExtent{{0, 10}, {50, 50}}}, 60, true},
+		{"all holes", sparseLayout{Size: 100}, 0, true},
+		{"overlapping", sparseLayout{Size: 100, Extents: []diskExtent{{0, 10}, {5, 10}}}, 20, false},
+		{"out of order", sparseLayout{Size: 100, Extents: []diskExtent{{50, 10}, {0, 10}}}, 20, false},
+		{"past the end", sparseLayout{Size: 100, Extents: []diskExtent{{90, 20}}}, 20, false},
+		{"negative offset", sparseLayout{Size: 100, Extents: []diskExtent{{-10, 20}}}, 20, false},
+		{"empty extent", sparseLayout{Size: 100, Extents: []diskExtent{{10, 0}}}, 0, false},
+		{"too large", sparseLayout{Size: maxSnapshotRootFSSize + 1}, 0, false},
+		{"data size mismatch", sparseLayout{Size: 100, Extents: []diskExtent{{0, 10}}}, 11, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.layout.validate(tt.dataSize)
+			if tt.valid && err != nil {
+				t.Fatalf("got error %v, want none", err)
+			}
+			if !tt.valid && err == nil {
+				t.Fatal("got no error")
+			}
+		})
+	}
+}
+
+func TestValidateImportedSnapshot(t *testing.T) {
+	var err error
+	ipam, err = NewIPAM("172.16.0.0/24", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	machineID := xid.New().String()
+	ip := "172.16.0.7"
+	valid := func() *Snapshot {
+		return &Snapshot{
+			MachineID:   machineID,
+			MachineType: ApiMachineType{Cpus: 1, MemoryMb: 256},
+			Files:       &MachineSnapshot{RootFSPath: getRootFSPath(machineID)},
+			TapName:     tapName(ipAdd(ipam.Subnet().IP, 7)),
+			IP:          ip,
+		}
+	}
+	if err := validateImportedSnapshot(valid()); err != nil {
+		t.Fatalf("valid snapshot: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		tamper  func(s *Snapshot)
+		wantErr string
+	}{
+		{"machine id", func(s *Snapshot) { s.MachineID = "../../etc" }, "invalid machine id"},
+		{"rootfs path", func(s *Snapshot) { s.Files.RootFSPath = "/etc/shadow" }, "rootfs path"},
+		{"rootfs path of another machine", func(s *Snapshot) { s.Files.RootFSPath = getRootFSPath(xid.New().String()) }, "rootfs path"},
+		{"tap name", func(s *Snapshot) { s.TapName = "eth0" }, "invalid tap name"},
+		{"non-canonical tap name", func(s *Snapshot) { s.TapName = s.TapName + "x" }, "invalid tap name"},
+		{"ip outside the subnet", func(s *Snapshot) { s.IP = "10.0.0.7" }, "outside of the managed subnet"},
+		{"unparsable ip", func(s *Snapshot) { s.IP = "not-an-ip" }, "outside of the managed subnet"},
+		{"machine type", func(s *Snapshot) { s.MachineType.Cpus = 0 }, "cpus must be at least 1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snapshot := valid()
+			tt.tamper(snapshot)
+			err := validateImportedSnapshot(snapshot)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/xid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	snapshotsKey = "snapshots"
+
+	savedSnapshotsDirName = "saved"
+)
+
+// SnapshotHost is what a snapshot depends on besides the machine itself.
+// Firecracker only loads snapshots on the CPU and version they were written
+// with, and a restored machine that restarts boots the host's kernel.
+type SnapshotHost struct {
+	Arch               string `json:"arch"`
+	CPUModel           string `json:"cpu_model"`
+	FirecrackerVersion string `json:"firecracker_version"`
+	Kernel             string `json:"kernel"`
+	KernelSHA256       string `json:"kernel_sha256"`
+}
+
+// Snapshot is a saved copy of a machine that new machines can be created
+// from with from_snapshot.
+type Snapshot struct {
+	ID          string         `json:"id"`
+	Name        string         `json:"name"`
+	App         string         `json:"app"`
+	MachineID   string         `json:"machine_id"`
+	Image       string         `json:"image"`
+	MachineType ApiMachineType `json:"machine_type"`
+	SizeBytes   int64          `json:"size_bytes"`
+	CreatedAt   time.Time      `json:"created_at"`
+	SnapshotHost
+
+	// Host is the server the snapshot's files live on, only it can restore,
+	// export or delete the snapshot
+	Host string `json:"host,omitempty"`
+
+	Config *ApiMachineConfig `json:"config,omitempty"`
+
+	// Where the snapshot lives on the host and what its VMM state refers
+	// to, left out of API responses
+	Files   *MachineSnapshot `json:"files,omitempty"`
+	RootFS  string           `json:"rootfs,omitempty"`
+	TapName string           `json:"tap_name,omitempty"`
+	IP      string           `json:"ip,omitempty"`
+}
+
+type CreateSnapshotRequest struct {
+	Name string `json:"name"`
+}
+
+func (s Snapshot) public() Snapshot {
+	s.Files = nil
+	s.RootFS = ""
+	s.TapName = ""
+	s.IP = ""
+	return s
+}
+
+// host is where the snapshot's files live. Snapshots from before hosts were
+// recorded were all taken here.
+func (s *Snapshot) host() string {
+	if s.Host == "" {
+		return currentHost()
+	}
+	return s.Host
+}
+
+// diskMb is what the snapshot counts against its app's disk quota.
+func (s *Snapshot) diskMb() int64 {
+	return (s.SizeBytes + 1<<20 - 1) >> 20
+}
+
+// capture lets machines be restored from the snapshot the way clones are.
+func (s *Snapshot) capture() *capturedMachine {
+	files := *s.Files
+	return &capturedMachine{
+		sourceID: s.MachineID,
+		snapshot: &files,
+		rootFS:   s.RootFS,
+		tapName:  s.TapName,
+		sourceIP: net.ParseIP(s.IP),
+	}
+}
+
+// applyTo makes a machine config restorable from the snapshot. What is baked
+// into the VMM state comes from the snapshot, the rest from the request.
+func (s *Snapshot) applyTo(machineConfig *ApiMachineConfig) error {
+	if networkMode() != NetworkModeTap {
+		return fmt.Errorf("restoring snapshots needs tap networking")
+	}
+	if len(machineConfig.Ports) > 0 {
+		return fmt.Errorf("machines restored from snapshots can't have port forwards")
+	}
+	if len(machineConfig.Volumes) > 0 {
+		return fmt.Errorf("machines restored from snapshots can't have volumes")
+	}
+	taken := s.Config
+	if taken == nil {
+		taken = defaultMachineConfig()
+	}
+	if jailer == nil && usesVsockProbe(taken) {
+		return fmt.Errorf("restoring snapshots of machines with a vsock probe needs the jailer")
+	}
+
+	machineConfig.Image = s.Image
+	machineConfig.MachineType = s.MachineType
+	machineConfig.Balloon = taken.Balloon
+	if machineConfig.HealthCheck == nil {
+		machineConfig.HealthCheck = taken.HealthCheck
+	}
+	if usesVsockProbe(machineConfig) && !usesVsockProbe(taken) {
+		return fmt.Errorf("the snapshot's machine has no vsock device for the health check to use")
+	}
+	return nil
+}
+
+// Snapshot names follow the rules of app names.
+func validateSnapshotName(name string) error {
+	if !appNamePattern.MatchString(name) {
+		return fmt.Errorf("snapshot name must be 1-63 lowercase letters, digits, '-' or '_', starting with a letter or digit")
+	}
+	return nil
+}
+
+func savedSnapshotsDir() string {
+	return filepath.Join(snapshotRoot(), savedSnapshotsDirName)
+}
+
+// currentSnapshotHost describes this host the way snapshots record it.
+func currentSnapshotHost() (SnapshotHost, error) {
+	host := SnapshotHost{
+		Arch:     runtime.GOARCH,
+		CPUModel: cpuModel(),
+		Kernel:   os.Getenv("KERNEL_IMAGE_PATH"),
+	}
+
+	version, err := firecrackerVersion()
+	if err != nil {
+		return host, fmt.Errorf("failed to get firecracker version: %v", err)
+	}
+	host.FirecrackerVersion = version
+
+	f, err := os.Open(host.Kernel)
+	if err != nil {
+		return host, err
+	}
+	defer f.Close()
+	digest := sha256.New()
+	if _, err := io.Copy(digest, f); err != nil {
+		return host, err
+	}
+	host.KernelSHA256 = hex.EncodeToString(digest.Sum(nil))
+
+	return host, nil
+}
+
+// firecrackerVersion runs the configured binary with --version, which
+// starts with "Firecracker v1.4.1".
+func firecrackerVersion() (string, error) {
+	out, err := exec.Command(os.Getenv(FirecrackerBinEnvVar), "--version").Output()
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) < 2 {
+		return "", fmt.Errorf("unexpected version output %q", out)
+	}
+	return fields[1], nil
+}
+
+// cpuModel returns the model name from /proc/cpuinfo. Some architectures
+// don't report one, snapshots taken there record it as empty.
+func cpuModel() string {
+	f, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if ok && strings.TrimSpace(key) == "model name" {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// checkCompatible refuses snapshots taken on hosts this one can't stand in
+// for. Firecracker keeps the snapshot format within a minor version.
+func (host SnapshotHost) checkCompatible(taken SnapshotHost) error {
+	if taken.Arch != host.Arch {
+		return fmt.Errorf("snapshot was taken on %s, this host is %s", taken.Arch, host.Arch)
+	}
+	if taken.CPUModel != host.CPUModel {
+		return fmt.Errorf("snapshot was taken on a %q CPU, this host has %q", taken.CPUModel, host.CPUModel)
+	}
+	if minorVersion(taken.FirecrackerVersion) != minorVersion(host.FirecrackerVersion) {
+		return fmt.Errorf("snapshot was taken with firecracker %s, this host runs %s", taken.FirecrackerVersion, host.FirecrackerVersion)
+	}
+	if taken.KernelSHA256 != host.KernelSHA256 {
+		return fmt.Errorf("snapshot was taken with a different kernel than %s", host.Kernel)
+	}
+	return nil
+}
+
+func minorVersion(version string) string {
+	parts := strings.SplitN(strings.TrimPrefix(version, "v"), ".", 3)
+	if len(parts) < 2 {
+		return version
+	}
+	return parts[0] + "." + parts[1]
+}
+
+// capturedMachine is a machine's memory, VMM state and rootfs from one
+// moment, plus the names of the devices the state refers to.
+type capturedMachine struct {
+	dir      string
+	sourceID string
+	snapshot *MachineSnapshot
+	rootFS   string
+	tapName  string
+	sourceIP net.IP
+}
+
+func (m *capturedMachine) remove() {
+	if m.dir == "" {
+		return
+	}
+	if err := os.RemoveAll(m.dir); err != nil {
+		log.WithError(err).Errorf("failed to remove snapshot %s", m.dir)
+	}
+}
+
+// captureMachine snapshots a machine into dir, or links in its snapshot if
+// it's scaled to zero. The rootfs is copied along so disk and memory match.
+func captureMachine(ctx context.Context, machineID, dir string) (*capturedMachine, error) {
+	unlock := lockMachine(machineID)
+	defer unlock()
+
+	// Read under the lock, the machine may have been suspended or woken since
+	info, err := fetchMachineInfo(ctx, machineID)
+	if err != nil {
+		return nil, err
+	}
+
+	capture := &capturedMachine{
+		dir:      dir,
+		sourceID: machineID,
+		rootFS:   filepath.Join(dir, "rootfs"),
+		tapName:  tapName(net.ParseIP(info.IP)),
+		sourceIP: net.ParseIP(info.IP),
+	}
+	if info.CloneNetwork != nil {
+		capture.tapName = info.CloneNetwork.TapName
+	}
+
+	if MachineStatusType(info.Status) == StatusSuspended && info.Snapshot != nil {
+		snapshot := *info.Snapshot
+		snapshot.MemFilePath = filepath.Join(dir, "memory")
+		snapshot.StatePath = filepath.Join(dir, "state")
+		if snapshot.RootFSPath == "" {
+			snapshot.RootFSPath = getRootFSPath(machineID)
+		}
+
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+		links := map[string]string{info.Snapshot.MemFilePath: snapshot.MemFilePath, info.Snapshot.StatePath: snapshot.StatePath}
+		for src, dst := range links {
+			if err := os.Link(src, dst); err != nil {
+				capture.remove()
+				return nil, err
+			}
+		}
+		if err := cloneFile(getRootFSPath(machineID), capture.rootFS); err != nil {
+			capture.remove()
+			return nil, err
+		}
+		capture.snapshot = &snapshot
+		return capture, nil
+	}
+
+	vm, ok := fcManager.GetVM(machineID)
+	if !ok {
+		return nil, fmt.Errorf("machine %s is not running", machineID)
+	}
+
+	vm.stateMu.Lock()
+	defer vm.stateMu.Unlock()
+
+	if !vm.paused.Load() {
+		if err := vm.machine.PauseVM(ctx); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err := vm.machine.ResumeVM(ctx); err != nil {
+				log.WithError(err).Errorf("failed to resume machine %s after snapshotting it", machineID)
+			}
+		}()
+	}
+
+	capture.snapshot, err = writeSnapshot(ctx, vm, dir)
+	if err != nil {
+		capture.remove()
+		return nil, err
+	}
+	if err := cloneFile(getRootFSPath(machineID), capture.rootFS); err != nil {
+		capture.remove()
+		return nil, err
+	}
+
+	return capture, nil
+}
+
+func listSnapshots(ctx context.Context) ([]Snapshot, error) {
+	entries, err := rdb.HGetAll(ctx, snapshotsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]Snapshot, 0, len(entries))
+	for id, data := range entries {
+		var snapshot Snapshot
+		if err := json.Unmarshal([]byte(data), &snapshot); err != nil {
+			log.WithError(err).Errorf("failed to unmarshal snapshot %s", id)
+			continue
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].CreatedAt.Before(snapshots[j].CreatedAt)
+	})
+	return snapshots, nil
+}
+
+func fetchSnapshot(ctx context.Context, snapshotID string) (*Snapshot, error) {
+	data, err := rdb.HGet(ctx, snapshotsKey, snapshotID).Result()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("snapshot not found")
+	} else if err != nil {
+		return nil, err
+	}
+
+	var snapshot Snapshot
+	if err := json.Unmarshal([]byte(data), &snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// canAccessSnapshot applies the app scoping authorizeApp does for machines.
+func canAccessSnapshot(c echo.Context, snapshot *Snapshot) bool {
+	if app := c.Param("app_name"); app != "" && app != snapshot.App {
+		return false
+	}
+	return callerKey(c).canAccessApp(snapshot.App)
+}
+
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+func createMachineSnapshot(c echo.Context) error {
+	machineID := c.Param("machine_id")
+	ctx := context.Background()
+
+	var req CreateSnapshotRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	if err := validateSnapshotName(req.Name); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	machineInfo, err := fetchMachineInfo(ctx, machineID)
+	if err != nil {
+		if strings.Contains(err.Error(), "machine not found") {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Machine not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+	switch MachineStatusType(machineInfo.Status) {
+	case StatusRunning, StatusUnhealthy, StatusPaused, StatusSuspended:
+	default:
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Only running, paused or suspended machines can be snapshotted"})
+	}
+	machineConfig := machineInfo.machineConfig()
+	// The volumes aren't part of the snapshot, but its VMM state has them
+	// attached
+	if len(machineConfig.Volumes) > 0 {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Machines with volumes can't be snapshotted"})
+	}
+
+	existing, err := listSnapshots(ctx)
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to fetch snapshots")
+	}
+	for _, snapshot := range existing {
+		if snapshot.App == machineConfig.AppName && snapshot.Name == req.Name {
+			return c.JSON(http.StatusConflict, map[string]string{"error": fmt.Sprintf("App already has a snapshot named %s", req.Name)})
+		}
+	}
+
+	host, err := currentSnapshotHost()
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to inspect host")
+	}
+
+	snapshotID := xid.New().String()
+	capture, err := captureMachine(ctx, machineID, filepath.Join(savedSnapshotsDir(), snapshotID))
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to snapshot machine")
+	}
+
+	snapshot := Snapshot{
+		ID:           snapshotID,
+		Name:         req.Name,
+		App:          machineConfig.AppName,
+		MachineID:    machineID,
+		Image:        machineConfig.Image,
+		MachineType:  machineConfig.MachineType,
+		SizeBytes:    fileSize(capture.snapshot.MemFilePath) + fileSize(capture.snapshot.StatePath) + fileSize(capture.rootFS),
+		CreatedAt:    time.Now().UTC(),
+		SnapshotHost: host,
+		Host:         currentHost(),
+		Config:       &machineConfig,
+		Files:        capture.snapshot,
+		RootFS:       capture.rootFS,
+		TapName:      capture.tapName,
+		IP:           capture.sourceIP.String(),
+	}
+
+	// Snapshots count against the app's disk quota, their size is only
+	// known once they're taken
+	quota, err := appQuota(ctx, snapshot.App)
+	if err != nil {
+		capture.remove()
+		return handleError(c, err, http.StatusInternalServerError, "Failed to fetch quota")
+	}
+	checks := diskChecks(snapshot.App, quota, snapshot.Host, snapshot.diskMb())
+	if err := reserve(ctx, checks); err != nil {
+		capture.remove()
+		var admissionErr *AdmissionError
+		if errors.As(err, &admissionErr) {
+			return c.JSON(admissionErr.StatusCode, map[string]string{"error": admissionErr.Reason})
+		}
+		return handleError(c, err, http.StatusInternalServerError, "Failed to reserve disk")
+	}
+
+	data, err := json.Marshal(snapshot)
+	if err == nil {
+		err = rdb.HSet(ctx, snapshotsKey, snapshot.ID, data).Err()
+	}
+	if err != nil {
+		capture.remove()
+		release(ctx, checks)
+		return handleError(c, err, http.StatusInternalServerError, "Failed to store snapshot")
+	}
+
+	return c.JSON(http.StatusCreated, snapshot.public())
+}
+
+func getSnapshots(c echo.Context) error {
+	snapshots, err := listSnapshots(context.Background())
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to fetch snapshots")
+	}
+
+	visible := make([]Snapshot, 0, len(snapshots))
+	for i := range snapshots {
+		if canAccessSnapshot(c, &snapshots[i]) {
+			visible = append(visible, snapshots[i].public())
+		}
+	}
+	return c.JSON(http.StatusOK, visible)
+}
+
+func getSnapshot(c echo.Context) error {
+	snapshot, err := fetchSnapshot(context.Background(), c.Param("snapshot_id"))
+	if err != nil {
+		if strings.Contains(err.Error(), "snapshot not found") {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Snapshot not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+	if !canAccessSnapshot(c, snapshot) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Snapshot not found"})
+	}
+
+	return c.JSON(http.StatusOK, snapshot.public())
+}
+
+// deleteSnapshot drops a snapshot. Machines created from it have copies of
+// its rootfs and private mappings of its memory, they keep running. Only the
+// host the snapshot lives on can delete it.
+func deleteSnapshot(c echo.Context) error {
+	snapshotID := c.Param("snapshot_id")
+	ctx := context.Background()
+
+	snapshot, err := fetchSnapshot(ctx, snapshotID)
+	if err != nil {
+		if strings.Contains(err.Error(), "snapshot not found") {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Snapshot not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+	if !canAccessSnapshot(c, snapshot) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Snapshot not found"})
+	}
+	if host := snapshot.host(); host != currentHost() {
+		return c.JSON(http.StatusConflict, map[string]string{"error": fmt.Sprintf("Snapshot is on host %s, delete it there", host)})
+	}
+
+	deleted, err := rdb.HDel(ctx, snapshotsKey, snapshotID).Result()
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to delete snapshot")
+	}
+	if deleted == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Snapshot not found"})
+	}
+	if err := os.RemoveAll(filepath.Join(savedSnapshotsDir(), snapshotID)); err != nil {
+		log.WithError(err).Errorf("failed to remove files of snapshot %s", snapshotID)
+	}
+	release(ctx, diskChecks(snapshot.App, AppQuota{}, snapshot.host(), snapshot.diskMb()))
+
+	return c.JSON(http.StatusOK, "Snapshot deleted!")
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	RestartNever     = "never"
+	RestartOnFailure = "on-failure"
+	RestartAlways    = "always"
+
+	restartBackoff       = 2 * time.Second
+	attachedPollInterval = 2 * time.Second
+)
+
+func validateRestartPolicy(policy *RestartPolicy) error {
+	if policy == nil {
+		return nil
+	}
+
+	switch policy.Policy {
+	case "", RestartNever, RestartOnFailure, RestartAlways:
+	default:
+		return fmt.Errorf("unsupported restart policy %q, expected never, on-failure or always", policy.Policy)
+	}
+	if policy.MaxRetries < 0 {
+		return fmt.Errorf("max_retries must not be negative")
+	}
+	return nil
+}
+
+// shouldRestart applies the machine's restart policy to an unrequested exit.
+// MaxRetries of 0 means no limit.
+func shouldRestart(policy *RestartPolicy, exitCode, restartCount int) bool {
+	if policy == nil {
+		return false
+	}
+
+	switch policy.Policy {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		return exitCode != 0 && (policy.MaxRetries == 0 || restartCount < policy.MaxRetries)
+	default:
+		return false
+	}
+}
+
+// superviseVM waits for the VMM process to exit, records how it went and
+// applies the restart policy. It runs for the lifetime of each VMM.
+func superviseVM(vm *runningFirecracker) {
+	exitCode, reason := waitForExit(vm)
+
+	// The machine was deleted or replaced by a newer VMM in the meantime
+	if !fcManager.IsCurrent(vm) {
+		return
+	}
+
+	ctx := context.Background()
+	requested := vm.stopRequested()
+
+	status := StatusStopped
+	if !requested && exitCode != 0 {
+		status = StatusFailed
+	}
+
+	if forwarder := vm.forwarder.Swap(nil); forwarder != nil {
+		forwarder.Close()
+	}
+
+	var info MachineInfo
+	err := updateMachineInfo(ctx, vm.vmmID, func(stored *MachineInfo) {
+		stored.Status = string(status)
+		stored.ExitCode = &exitCode
+		stored.ExitReason = reason
+		stored.Ports = nil
+		stored.PID = 0
+		info = *stored
+	})
+	if err != nil {
+		log.WithError(err).Errorf("failed to record exit of machine %s", vm.vmmID)
+	}
+
+	config := info.machineConfig()
+
+	log.Warnf("VMM of machine %s exited: %s", vm.vmmID, reason)
+	emitEvent(Event{
+		Type:      EventMachineExited,
+		MachineID: vm.vmmID,
+		App:       config.AppName,
+		Data: map[string]interface{}{
+			"exit_code": exitCode,
+			"reason":    reason,
+			"status":    status,
+			"requested": requested,
+		},
+	})
+
+	if requested || !shouldRestart(config.RestartPolicy, exitCode, info.RestartCount) {
+		return
+	}
+
+	time.Sleep(restartBackoff)
+	if !fcManager.IsCurrent(vm) {
+		return
+	}
+
+	if err := restartVM(ctx, vm.vmmID, &config); err != nil {
+		log.WithError(err).Errorf("failed to restart machine %s", vm.vmmID)
+		updateMachineStatus(ctx, vm.vmmID, StatusFailed)
+		return
+	}
+
+	err = updateMachineInfo(ctx, vm.vmmID, func(stored *MachineInfo) {
+		stored.RestartCount++
+	})
+	if err != nil {
+		log.WithError(err).Errorf("failed to record restart of machine %s", vm.vmmID)
+	}
+
+	emitEvent(Event{
+		Type:      EventMachineRestarted,
+		MachineID: vm.vmmID,
+		App:       config.AppName,
+		Data: map[string]interface{}{
+			"restart_count": info.RestartCount + 1,
+		},
+	})
+}
+
+// restartVM boots a fresh VMM for an existing machine, reusing its rootfs
+// copy and network lease.
+func restartVM(ctx context.Context, machineID string, machineConfig *ApiMachineConfig) error {
+	log.Infof("Restarting machine %s", machineID)
+	updateMachineStatus(ctx, machineID, StatusPending)
+
+	// Booted from scratch a clone's VMM uses a tap of its own
+	dropCloneNetwork(ctx, machineID)
+	iface, lease, err := setupNetworkInterface(ctx, machineID)
+	if err != nil {
+		return err
+	}
+
+	vm, err := bootVM(ctx, machineID, machineConfig, iface, lease, nil)
+	if err != nil {
+		return err
+	}
+
+	return initializeVM(ctx, vm, machineConfig)
+}
+
+// waitForExit blocks until the VMM process is gone and returns its exit code
+// and a human readable reason.
+func waitForExit(vm *runningFirecracker) (int, string) {
+	if vm.attached {
+		// Not our child, so there is no exit status to collect
+		for isFirecrackerProcess(vm.pid, vm.machine.Cfg.SocketPath) {
+			time.Sleep(attachedPollInterval)
+		}
+		return -1, "process exited (exit status unknown for adopted VMM)"
+	}
+
+	err := vm.machine.Wait(context.Background())
+	if err == nil {
+		return 0, "exited"
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal()), fmt.Sprintf("killed by signal %s", status.Signal())
+		}
+		return exitErr.ExitCode(), fmt.Sprintf("exited with code %d", exitErr.ExitCode())
+	}
+
+	return -1, err.Error()
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ScaleToZeroAfterEnvVar = "SCALE_TO_ZERO_AFTER"
+	SnapshotDirEnvVar      = "SNAPSHOT_DIR"
+
+	defaultSnapshotDir = "/var/lib/quest/snapshots"
+
+	scaleToZeroCheckInterval = 30 * time.Second
+)
+
+// MachineSnapshot is where the memory and VMM state of a scaled to zero
+// machine were written.
+type MachineSnapshot struct {
+	MemFilePath string    `json:"mem_file_path"`
+	StatePath   string    `json:"state_path"`
+	TakenAt     time.Time `json:"taken_at"`
+
+	// RootFSPath is the rootfs the VMM state refers to. Restoring a machine
+	// from another machine's snapshot switches the drive over to its own.
+	RootFSPath string `json:"rootfs_path,omitempty"`
+
+	// NetNS is the network namespace to restore in, for machines whose tap
+	// is named after another machine's
+	NetNS string `json:"-"`
+}
+
+var (
+	// machineLocks serializes suspending and waking a machine, keyed by
+	// machine ID
+	machineLocks sync.Map
+
+	// suspendedForwarders keeps the port forwards of scaled to zero machines
+	// listening, so a connection can wake them
+	suspendedForwarders   = make(map[string]*portForwarder)
+	suspendedForwardersMu sync.Mutex
+)
+
+func lockMachine(machineID string) func() {
+	value, _ := machineLocks.LoadOrStore(machineID, &sync.Mutex{})
+	mu := value.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+// snapshotRoot holds all snapshots. Under the jailer it defaults to a
+// directory below the chroots, firecracker writes snapshots inside its jail
+// and they are moved out with a rename.
+func snapshotRoot() string {
+	if dir := os.Getenv(SnapshotDirEnvVar); dir != "" {
+		return dir
+	}
+	if jailer != nil {
+		return filepath.Join(jailer.ChrootBaseDir, "snapshots")
+	}
+	return defaultSnapshotDir
+}
+
+// snapshotDir holds the snapshot of a scaled to zero machine.
+func snapshotDir(machineID string) string {
+	return filepath.Join(snapshotRoot(), machineID)
+}
+
+// wakeOnActivity is the port forward callback of a machine: every connection
+// brings it back from being paused or scaled to zero before it is proxied.
+func wakeOnActivity(machineID string) func() {
+	return func() {
+		if err := wakeMachine(context.Background(), machineID); err != nil {
+			log.WithError(err).Errorf("failed to wake machine %s for a connection", machineID)
+		}
+	}
+}
+
+// suspendVM snapshots a machine idle for at least after and releases its
+// VMM. The rootfs copy, the network lease and tap, the jail uid and the port
+// forwards stay, so restoreMachine can bring it back as it was.
+func suspendVM(ctx context.Context, vm *runningFirecracker, after time.Duration) error {
+	unlock := lockMachine(vm.vmmID)
+	defer unlock()
+
+	if !fcManager.IsCurrent(vm) {
+		return nil
+	}
+
+	vm.stateMu.Lock()
+	defer vm.stateMu.Unlock()
+
+	// A run or connection may have come in since the machine was picked
+	if vm.idleFor() < after {
+		return errNotIdle
+	}
+
+	wasPaused := vm.paused.Load()
+	if !wasPaused {
+		if err := vm.machine.PauseVM(ctx); err != nil {
+			return err
+		}
+	}
+
+	dir := snapshotDir(vm.vmmID)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	snapshot, err := writeSnapshot(ctx, vm, dir)
+	if err != nil {
+		if !wasPaused {
+			if resumeErr := vm.machine.ResumeVM(ctx); resumeErr != nil {
+				log.WithError(resumeErr).Errorf("failed to resume machine %s after a failed snapshot", vm.vmmID)
+			}
+		}
+		return fmt.Errorf("failed to snapshot machine: %v", err)
+	}
+
+	// Unmanage first so the supervisor doesn't record the exit
+	fcManager.RemoveVM(vm.vmmID)
+	vm.requestStop()
+	if err := vm.stopVMM(); err != nil {
+		log.WithError(err).Errorf("failed to stop VMM for machine %s", vm.vmmID)
+	}
+	vm.vmmCancel()
+
+	if cgroups != nil {
+		if err := cgroups.remove(vm.vmmID); err != nil {
+			log.WithError(err).Errorf("failed to remove cgroup of machine %s", vm.vmmID)
+		}
+	}
+
+	if forwarder := vm.forwarder.Swap(nil); forwarder != nil {
+		suspendedForwardersMu.Lock()
+		suspendedForwarders[vm.vmmID] = forwarder
+		suspendedForwardersMu.Unlock()
+	}
+
+	return updateMachineInfo(ctx, vm.vmmID, func(info *MachineInfo) {
+		info.Status = string(StatusSuspended)
+		info.PID = 0
+		info.Snapshot = snapshot
+	})
+}
+
+// writeSnapshot snapshots a paused VMM into dir. A jailed VMM can only write
+// inside its chroot, so its snapshot is moved out afterwards.
+func writeSnapshot(ctx context.Context, vm *runningFirecracker, dir string) (*MachineSnapshot, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	snapshot := &MachineSnapshot{
+		MemFilePath: filepath.Join(dir, "memory"),
+		StatePath:   filepath.Join(dir, "state"),
+		TakenAt:     time.Now().UTC(),
+		RootFSPath:  getRootFSPath(vm.vmmID),
+	}
+
+	memPath, statePath := snapshot.MemFilePath, snapshot.StatePath
+	if jailer != nil {
+		memPath, statePath = "/"+jailMemName, "/"+jailStateName
+	}
+	if err := vm.machine.CreateSnapshot(ctx, memPath, statePath); err != nil {
+		return nil, err
+	}
+
+	if jailer != nil {
+		root := jailer.rootDir(vm.vmmID)
+		for name, dst := range map[string]string{jailMemName: snapshot.MemFilePath, jailStateName: snapshot.StatePath} {
+			if err := os.Rename(filepath.Join(root, name), dst); err != nil {
+				return nil, fmt.Errorf("failed to move snapshot out of the jail: %v", err)
+			}
+		}
+	}
+	return snapshot, nil
+}
+
+// restoreMachine boots a scaled to zero machine from its snapshot. The guest
+// resumes where it was suspended. Machines that aren't suspended are left
+// alone. Callers hold the machine's lock.
+func restoreMachine(ctx context.Context, machineID string) error {
+	info, err := fetchMachineInfo(ctx, machineID)
+	if err != nil {
+		return err
+	}
+	if MachineStatusType(info.Status) != StatusSuspended || info.Snapshot == nil {
+		return nil
+	}
+
+	log.Infof("Waking machine %s from its snapshot", machineID)
+	start := time.Now()
+	machineConfig := info.machineConfig()
+
+	snapshot := *info.Snapshot
+	var iface firecracker.NetworkInterface
+	var lease *Lease
+	if info.CloneNetwork != nil {
+		iface, lease, err = cloneNetworkInterface(ctx, machineID, info.CloneNetwork)
+		snapshot.NetNS = info.CloneNetwork.NetNS
+	} else {
+		iface, lease, err = setupNetworkInterface(ctx, machineID)
+	}
+	if err != nil {
+		return err
+	}
+
+	vm, err := bootVM(ctx, machineID, &machineConfig, iface, lease, &snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to restore snapshot: %v", err)
+	}
+
+	suspendedForwardersMu.Lock()
+	vm.forwarder.Store(suspendedForwarders[machineID])
+	delete(suspendedForwarders, machineID)
+	suspendedForwardersMu.Unlock()
+
+	fcManager.AddVM(machineID, vm)
+	go superviseVM(vm)
+	go monitorMachineHealth(vm, &machineConfig)
+
+	err = updateMachineInfo(ctx, machineID, func(info *MachineInfo) {
+		info.Status = string(StatusRunning)
+		info.Snapshot = nil
+	})
+	if err != nil {
+		log.WithError(err).Errorf("failed to record wake of machine %s", machineID)
+	}
+	observeSince(machineWakeDuration.WithLabelValues(imageLabel(machineConfig.Image), machineTypeLabel(machineConfig.MachineType)), start)
+	log.Infof("Woke machine %s in %s", machineID, time.Since(start).Round(time.Millisecond))
+
+	if err := os.RemoveAll(filepath.Dir(info.Snapshot.StatePath)); err != nil {
+		log.WithError(err).Errorf("failed to remove snapshot of machine %s", machineID)
+	}
+	return nil
+}
+
+// discardSuspendedState drops what a scaled to zero machine kept around,
+// for when the machine is deleted.
+func discardSuspendedState(machineID string) {
+	suspendedForwardersMu.Lock()
+	if forwarder, ok := suspendedForwarders[machineID]; ok {
+		forwarder.Close()
+		delete(suspendedForwarders, machineID)
+	}
+	suspendedForwardersMu.Unlock()
+
+	if err := os.RemoveAll(snapshotDir(machineID)); err != nil {
+		log.WithError(err).Errorf("failed to remove snapshot of machine %s", machineID)
+	}
+	machineLocks.Delete(machineID)
+}
+
+// listenForSuspended opens the port forwards of a scaled to zero machine
+// again after a server restart.
+func listenForSuspended(machineID string, info *MachineInfo) error {
+	if len(info.Ports) == 0 {
+		return nil
+	}
+	forwarder, err := startPortForwards(machineID, net.ParseIP(info.IP), info.Ports, wakeOnActivity(machineID))
+	if err != nil {
+		return err
+	}
+
+	suspendedForwardersMu.Lock()
+	suspendedForwarders[machineID] = forwarder
+	suspendedForwardersMu.Unlock()
+	return nil
+}
+
+// scaleIdleMachinesToZero snapshots machines that have been idle for
+// SCALE_TO_ZERO_AFTER and stops their VMMs. The next run or connection
+// restores them. Restoring reuses the machine's tap and address, which only
+// tap networking keeps while no VMM is running.
+func scaleIdleMachinesToZero(ctx context.Context) {
+	value := os.Getenv(ScaleToZeroAfterEnvVar)
+	if value == "" || value == "off" {
+		return
+	}
+	after, err := time.ParseDuration(value)
+	if err != nil || after <= 0 {
+		log.Warnf("ignoring %s %q, idle machines won't be scaled to zero", ScaleToZeroAfterEnvVar, value)
+		return
+	}
+	if networkMode() != NetworkModeTap {
+		log.Warnf("%s needs %s=%s, idle machines won't be scaled to zero", ScaleToZeroAfterEnvVar, NetworkModeEnvVar, NetworkModeTap)
+		return
+	}
+
+	ticker := time.NewTicker(scaleToZeroCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, vm := range fcManager.List() {
+			if vm.stopRequested() || vm.idleFor() < after {
+				continue
+			}
+
+			info, err := fetchMachineInfo(ctx, vm.vmmID)
+			if err != nil {
+				continue
+			}
+			if status := MachineStatusType(info.Status); status != StatusRunning && status != StatusPaused {
+				continue
+			}
+
+			idle := vm.idleFor().Round(time.Second)
+			if err := suspendVM(ctx, vm, after); err != nil {
+				if err != errNotIdle {
+					log.WithError(err).Errorf("failed to scale idle machine %s to zero", vm.vmmID)
+				}
+				continue
+			}
+			log.Infof("Scaled machine %s to zero after %s without activity", vm.vmmID, idle)
+		}
+	}
+}
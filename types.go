@@ -26,6 +26,60 @@ type ApiMachineConfig struct {
 	AppName     string         `json:"app_name"`
 	Image       string         `json:"image"`
 	MachineType ApiMachineType `json:"machine_type"`
+	Ports       []PortMapping  `json:"ports,omitempty"`
+
+	RestartPolicy *RestartPolicy     `json:"restart_policy,omitempty"`
+	HealthCheck   *HealthCheckConfig `json:"health_check,omitempty"`
+	Balloon       *BalloonConfig     `json:"balloon,omitempty"`
+	Volumes       []VolumeMount      `json:"volumes,omitempty"`
+
+	// FromSnapshot restores the machine from a saved snapshot instead of
+	// booting it
+	FromSnapshot string `json:"from_snapshot,omitempty"`
+}
+
+// VolumeMount attaches a volume of the machine's app. The guest agent finds
+// the device and mount path in the quest.volumes kernel argument.
+type VolumeMount struct {
+	Volume    string `json:"volume"`
+	MountPath string `json:"mount_path"`
+	ReadOnly  bool   `json:"read_only,omitempty"`
+
+	// VolumeID is the volume the name resolved to when it was attached
+	VolumeID string `json:"volume_id,omitempty"`
+}
+
+type BalloonConfig struct {
+	AmountMib            int64 `json:"amount_mib"`
+	DeflateOnOom         bool  `json:"deflate_on_oom"`
+	StatsIntervalSeconds int64 `json:"stats_interval_seconds,omitempty"`
+}
+
+type HealthCheckConfig struct {
+	Liveness    *ProbeConfig `json:"liveness,omitempty"`
+	Readiness   *ProbeConfig `json:"readiness,omitempty"`
+	AutoRestart bool         `json:"auto_restart,omitempty"`
+}
+
+type ProbeConfig struct {
+	Type             string `json:"type"`
+	Path             string `json:"path,omitempty"`
+	Port             int    `json:"port,omitempty"`
+	Command          string `json:"command,omitempty"`
+	IntervalSeconds  int    `json:"interval_seconds,omitempty"`
+	TimeoutSeconds   int    `json:"timeout_seconds,omitempty"`
+	FailureThreshold int    `json:"failure_threshold,omitempty"`
+}
+
+type RestartPolicy struct {
+	Policy     string `json:"policy"`
+	MaxRetries int    `json:"max_retries,omitempty"`
+}
+
+type PortMapping struct {
+	HostPort  int    `json:"host_port"`
+	GuestPort int    `json:"guest_port"`
+	Protocol  string `json:"protocol,omitempty"`
 }
 
 type ApiMachineType struct {
@@ -33,12 +87,16 @@ type ApiMachineType struct {
 	Cpus     int64  `json:"cpus"`
 	GpuKind  string `json:"gpu_kind"`
 	MemoryMb int64  `json:"memory_mb"`
+
+	// DiskSizeMb grows the machine's rootfs copy past the size of the image
+	DiskSizeMb int64 `json:"disk_size_mb,omitempty"`
 }
 
 type CreateMachineResponse struct {
 	MachineID     string            `json:"machine_id"`
 	IP            net.IP            `json:"ip,omitempty"`
 	Status        MachineStatusType `json:"status,omitempty"`
+	Ports         []PortMapping     `json:"ports,omitempty"`
 	MachineConfig ApiMachineConfig  `json:"machine_config"`
 }
 
@@ -54,7 +112,10 @@ const (
 	StatusRunning   MachineStatusType = "running"
 	StatusStopped   MachineStatusType = "stopped"
 	StatusFailed    MachineStatusType = "failed"
+	StatusUnhealthy MachineStatusType = "unhealthy"
 	StatusCompleted MachineStatusType = "completed"
+	StatusPaused    MachineStatusType = "paused"
+	StatusSuspended MachineStatusType = "suspended"
 )
 
 type CodeRunRequest struct {
@@ -4,29 +4,37 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
 )
 
 // This would take a snapshot of the VM state, stop the vm and save location of snap
 func stopMachine(c echo.Context) error {
 	machineID := c.Param("machine_id")
-	vm, _ := fcManager.GetVM(machineID)
+	vm, ok := fcManager.GetVM(machineID)
+	if !ok {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Machine not found"})
+	}
 
 	fmt.Println("Stopping VM ...")
 	// if err := vm.machine.Shutdown(vm.vmmCtx); err != nil {
 	// 	return c.JSON(http.StatusInternalServerError, fmt.Sprintf("failed to stop machine: %v", err))
 	// }
 
-	ctx := context.Background()
-
-	vmmCtx, vmmCancel := context.WithCancel(ctx)
+	// A frozen guest can't react to the shutdown request
+	if err := resumeVM(context.Background(), vm); err != nil {
+		log.WithError(err).Errorf("failed to resume machine %s before stopping it", machineID)
+	}
 
-	if err := vm.machine.Shutdown(vmmCtx); err != nil {
-		vmmCancel()
+	vm.requestStop()
+	if err := vm.machine.Shutdown(context.Background()); err != nil {
 		return c.JSON(http.StatusInternalServerError, fmt.Sprintf("failed to stop machine: %v", err))
 	}
 
+	stopMachinePortForwards(context.Background(), vm)
+
 	updateMachineStatus(vm.vmmCtx, machineID, StatusStopped)
 
 	return c.JSON(http.StatusOK, "Machine stopped!")
@@ -35,7 +43,22 @@ func stopMachine(c echo.Context) error {
 // This would use the snapshot to start the VM
 func startMachine(c echo.Context) error {
 	machineID := c.Param("machine_id")
-	vm, _ := fcManager.GetVM(machineID)
+
+	// A disk resize holds the lock while it rewrites the rootfs
+	unlock := lockMachine(machineID)
+	defer unlock()
+
+	vm, ok := fcManager.GetVM(machineID)
+	if !ok {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Machine not found"})
+	}
+	info, err := fetchMachineInfo(vm.vmmCtx, machineID)
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to fetch machine")
+	}
+	if MachineStatusType(info.Status) != StatusStopped {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Only stopped machines can be started"})
+	}
 
 	fmt.Println("Starting VM ...")
 	if err := vm.machine.Start(vm.vmmCtx); err != nil {
@@ -44,25 +67,73 @@ func startMachine(c echo.Context) error {
 
 	updateMachineStatus(vm.vmmCtx, machineID, StatusRunning)
 
+	if vm.forwarder.Load() == nil {
+		if err := startMachinePortForwards(vm.vmmCtx, vm, info.machineConfig().Ports); err != nil {
+			log.WithError(err).Errorf("failed to restore port forwards of machine %s", machineID)
+		}
+	}
+
 	return c.JSON(http.StatusOK, "Machine restarted!")
 }
 
-// This would delete the vm deets
+// Tears down the VMM if it's still around and drops everything quest keeps for the machine
 func deleteMachine(c echo.Context) error {
-	// machineID := c.Param("machine_id")
-	// vm, _ := fcManager.GetVM(machineID)
+	machineID := c.Param("machine_id")
+	ctx := context.Background()
 
-	// memFilePath := "path/to/memory/file"
-	// snapshotPath := "path/to/snapshot/file"
+	machineInfo, err := fetchMachineInfo(ctx, machineID)
+	if err != nil {
+		if strings.Contains(err.Error(), "machine not found") {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Machine not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
 
-	// fmt.Println("Restarting VM from snapshot...")
+	fmt.Println("Deleting VM ...")
+	if vm, ok := fcManager.GetVM(machineID); ok {
+		// Unmanage first so the supervisor doesn't write the record back
+		fcManager.RemoveVM(machineID)
+		vm.requestStop()
+		if forwarder := vm.forwarder.Swap(nil); forwarder != nil {
+			forwarder.Close()
+		}
+		if err := vm.stopVMM(); err != nil {
+			log.WithError(err).Errorf("failed to stop VMM for machine %s", machineID)
+		}
+		vm.vmmCancel()
+	}
 
-	// err := vm.machine.StopVMM(vm.vmmCtx, memFilePath, snapshotPath)
-	// if err != nil {
-	// 	return fmt.Errorf("failed to create snapshot: %v", err)
-	// }
+	discardSuspendedState(machineID)
+	if machineInfo.CloneNetwork != nil {
+		teardownCloneNetwork(machineInfo.CloneNetwork)
+	}
+
+	if err := teardownNetwork(ctx, machineID); err != nil {
+		log.WithError(err).Errorf("failed to tear down network for machine %s", machineID)
+	}
+
+	for _, path := range []string{getRootFSPath(machineID), getLogPath(machineID), getMetricsPath(machineID), getVsockPath(machineID)} {
+		removeIfExists(path)
+	}
+	removeJail(ctx, machineID)
+	if cgroups != nil {
+		if err := cgroups.remove(machineID); err != nil {
+			log.WithError(err).Errorf("failed to remove cgroup of machine %s", machineID)
+		}
+	}
+
+	releaseMachine(ctx, machineID)
+	detachVolumes(ctx, machineID)
+
+	if err := deleteMachineInfo(ctx, machineID); err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to delete machine")
+	}
 
-	// updateMachineStatus(vm.vmmCtx, machineID, StatusStopped)
+	emitEvent(Event{
+		Type:      EventMachineDeleted,
+		MachineID: machineID,
+		App:       machineInfo.machineConfig().AppName,
+	})
 
 	return c.JSON(http.StatusOK, "Machine deleted!")
 }
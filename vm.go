@@ -5,9 +5,13 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
-	"github.com/rs/xid"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -17,6 +21,71 @@ type runningFirecracker struct {
 	vmmID     string
 	machine   *firecracker.Machine
 	ip        net.IP
+	mac       string
+	pid       int
+	startedAt time.Time
+
+	// forwarder is swapped by handlers, the supervisor and suspend/restore
+	forwarder atomic.Pointer[portForwarder]
+
+	// attached is set for VMMs adopted from a previous server process; the
+	// SDK only knows their API socket, not the process.
+	attached bool
+
+	// stopping tells the supervisor that an exit was asked for
+	stopping atomic.Bool
+
+	// stateMu serializes pausing and resuming
+	stateMu sync.Mutex
+	paused  atomic.Bool
+
+	// lastActive is when the machine last ran code or proxied traffic, in
+	// unix nanoseconds
+	lastActive atomic.Int64
+
+	// runs counts code runs waiting on the guest agent
+	runs atomic.Int64
+
+	// metrics sums up the metrics file of this VMM
+	metrics metricsTotals
+
+	// balloonMu serializes balloon changes, reclaimedMib is how much of the
+	// balloon was inflated by reclaimMemory on top of the configured amount
+	balloonMu    sync.Mutex
+	reclaimedMib int64
+}
+
+func (vm *runningFirecracker) requestStop() {
+	vm.stopping.Store(true)
+}
+
+func (vm *runningFirecracker) touch() {
+	vm.lastActive.Store(time.Now().UnixNano())
+}
+
+func (vm *runningFirecracker) idleFor() time.Duration {
+	if vm.runs.Load() > 0 {
+		return 0
+	}
+	if forwarder := vm.forwarder.Load(); forwarder != nil && forwarder.busy() {
+		return 0
+	}
+	return time.Since(time.Unix(0, vm.lastActive.Load()))
+}
+
+func (vm *runningFirecracker) stopRequested() bool {
+	return vm.stopping.Load()
+}
+
+// stopVMM terminates the firecracker process without going through the guest.
+func (vm *runningFirecracker) stopVMM() error {
+	if vm.attached {
+		if err := syscall.Kill(vm.pid, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+			return err
+		}
+		return nil
+	}
+	return vm.machine.StopVMM()
 }
 
 const (
@@ -39,11 +108,9 @@ func copy(src string, dst string) error {
 }
 
 // Create a VMM with a given set of options and start the VM
-func createAndStartVM(ctx context.Context, machineConfig *ApiMachineConfig) (*runningFirecracker, error) {
-	vmmID := xid.New().String()
-
+func createAndStartVM(ctx context.Context, vmmID string, machineConfig *ApiMachineConfig) (*runningFirecracker, error) {
 	rootFSPath := os.Getenv(RootFSPathEnvVar)
-	destRootFSPath := "/tmp/rootfs-" + vmmID + ".ext4"
+	destRootFSPath := getRootFSPath(vmmID)
 
 	err := copy(rootFSPath, destRootFSPath)
 
@@ -51,12 +118,84 @@ func createAndStartVM(ctx context.Context, machineConfig *ApiMachineConfig) (*ru
 		log.WithError(err).Errorf("failed to copy rootfs for VMM ID: %s", vmmID)
 		return nil, err
 	}
+	if diskSizeMb := machineConfig.MachineType.DiskSizeMb; diskSizeMb > 0 {
+		if err := growRootFS(destRootFSPath, diskSizeMb); err != nil {
+			log.WithError(err).Errorf("failed to grow rootfs for VMM ID: %s", vmmID)
+			return nil, err
+		}
+	}
+
+	iface, lease, err := setupNetworkInterface(ctx, vmmID)
+	if err != nil {
+		log.WithError(err).Errorf("failed to set up network for VMM ID: %s", vmmID)
+		return nil, err
+	}
 
-	fcCfg, err := getFirecrackerConfig(vmmID, machineConfig.MachineType.Cpus, machineConfig.MachineType.MemoryMb)
+	vm, err := bootVM(ctx, vmmID, machineConfig, iface, lease, nil)
+	if err != nil {
+		if teardownErr := teardownNetwork(ctx, vmmID); teardownErr != nil {
+			log.WithError(teardownErr).Errorf("failed to tear down network for VMM ID: %s", vmmID)
+		}
+		return nil, err
+	}
+
+	return vm, nil
+}
+
+// bootVM starts a VMM for a machine. With a snapshot the VMM loads it and
+// resumes the guest where it left off instead of booting the kernel.
+func bootVM(ctx context.Context, vmmID string, machineConfig *ApiMachineConfig, iface firecracker.NetworkInterface, lease *Lease, snapshot *MachineSnapshot) (*runningFirecracker, error) {
+	fcCfg, err := getFirecrackerConfig(vmmID, machineConfig.MachineType.Cpus, machineConfig.MachineType.MemoryMb, iface, machineConfig.Volumes)
 	if err != nil {
 		log.Errorf("Error: %s", err)
 		return nil, err
 	}
+
+	if jailer != nil {
+		if err := jailer.prepareJail(ctx, vmmID, &fcCfg); err != nil {
+			return nil, fmt.Errorf("failed to prepare jail: %v", err)
+		}
+	}
+
+	var snapshotOpt firecracker.Opt
+	// A snapshot of another machine comes up paused so the drive can be
+	// switched to this machine's rootfs before the guest touches it
+	foreignRootFS := snapshot != nil && snapshot.RootFSPath != "" && snapshot.RootFSPath != getRootFSPath(vmmID)
+	if snapshot != nil {
+		memPath, statePath := snapshot.MemFilePath, snapshot.StatePath
+		if jailer != nil {
+			memPath, statePath, err = jailer.linkSnapshot(vmmID, &fcCfg, snapshot)
+			if err != nil {
+				return nil, fmt.Errorf("failed to link snapshot into the jail: %v", err)
+			}
+		} else if foreignRootFS {
+			release, err := lendRootFS(vmmID, snapshot.RootFSPath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to provide the snapshot's rootfs: %v", err)
+			}
+			defer release()
+		}
+		if snapshot.NetNS != "" {
+			fcCfg.NetNS = snapshot.NetNS
+		}
+		snapshotOpt = firecracker.WithSnapshot(memPath, statePath, func(cfg *firecracker.SnapshotConfig) {
+			cfg.ResumeVM = !foreignRootFS
+		})
+	}
+
+	if usesVsockProbe(machineConfig) {
+		removeIfExists(getVsockPath(vmmID))
+		// A snapshot brings its vsock device along, firecracker recreates
+		// the socket at the path it had
+		if snapshot == nil {
+			fcCfg.VsockDevices = []firecracker.VsockDevice{{
+				ID:   "vsock0",
+				Path: getVsockPath(vmmID),
+				CID:  vsockGuestCID,
+			}}
+		}
+	}
+
 	logger := log.New()
 
 	if false { // TODO
@@ -84,8 +223,16 @@ func createAndStartVM(ctx context.Context, machineConfig *ApiMachineConfig) (*ru
 		return nil, fmt.Errorf("binary, %q, is not executable. Check permissions of binary", firecrackerBinary)
 	}
 
-	// if the jailer is used, the final command will be built in NewMachine()
-	if fcCfg.JailerCfg == nil {
+	// if the jailer is used without cgroup limits, the final command will be
+	// built in NewMachine()
+	vmmCtx, vmmCancel := context.WithCancel(ctx)
+	if fcCfg.JailerCfg != nil {
+		if cgroups != nil {
+			if args := cgroups.jailerArgs(machineConfig.MachineType); len(args) > 0 {
+				machineOpts = append(machineOpts, firecracker.WithProcessRunner(jailer.command(vmmCtx, &fcCfg, args)))
+			}
+		}
+	} else {
 		cmd := firecracker.VMCommandBuilder{}.
 			WithBin(firecrackerBinary).
 			WithSocketPath(fcCfg.SocketPath).
@@ -97,7 +244,14 @@ func createAndStartVM(ctx context.Context, machineConfig *ApiMachineConfig) (*ru
 		machineOpts = append(machineOpts, firecracker.WithProcessRunner(cmd))
 	}
 
-	vmmCtx, vmmCancel := context.WithCancel(ctx)
+	if snapshotOpt != nil {
+		machineOpts = append(machineOpts, snapshotOpt)
+	}
+
+	if err := createMetricsFile(vmmID); err != nil {
+		vmmCancel()
+		return nil, fmt.Errorf("failed to create metrics file: %v", err)
+	}
 
 	m, err := firecracker.NewMachine(vmmCtx, fcCfg, machineOpts...)
 	if err != nil {
@@ -105,18 +259,120 @@ func createAndStartVM(ctx context.Context, machineConfig *ApiMachineConfig) (*ru
 		return nil, fmt.Errorf("failed creating machine: %s", err)
 	}
 
+	switch {
+	case snapshot != nil && jailer != nil:
+		// WithSnapshot replaced the handlers the jailer set up
+		m.Handlers.FcInit = m.Handlers.FcInit.AppendAfter(firecracker.CreateLogFilesHandlerName, jailPathsHandler)
+	case snapshot == nil && machineConfig.Balloon != nil:
+		m.Handlers.FcInit = m.Handlers.FcInit.AppendAfter(firecracker.CreateMachineHandlerName, balloonHandler(machineConfig.Balloon))
+	}
+	if cgroups != nil {
+		m.Handlers.FcInit = m.Handlers.FcInit.AppendAfter(firecracker.StartVMMHandlerName, placeHandler(vmmID, machineConfig.MachineType))
+	}
+
+	startedAt := time.Now()
 	if err := m.Start(vmmCtx); err != nil {
 		vmmCancel()
 		return nil, fmt.Errorf("failed to start machine: %v", err)
 	}
+	if foreignRootFS {
+		if err := switchRootFS(vmmCtx, m, vmmID); err != nil {
+			m.StopVMM()
+			vmmCancel()
+			return nil, fmt.Errorf("failed to switch drive to the machine's rootfs: %v", err)
+		}
+	}
+	if snapshot == nil {
+		observeSince(machineBootDuration.WithLabelValues(imageLabel(machineConfig.Image), machineTypeLabel(machineConfig.MachineType)), startedAt)
+	}
+
+	staticConfig := m.Cfg.NetworkInterfaces[0].StaticConfiguration
+	ip := staticConfig.IPConfiguration.IPAddr.IP
+	log.WithField("ip", ip).Info("machine started")
+
+	if lease == nil {
+		// CNI picked the address, make sure the lease table agrees with it
+		lease, err = ipam.Reserve(ctx, vmmID, ip, staticConfig.MacAddress)
+		if err != nil {
+			log.WithError(err).Warnf("failed to record lease for machine %s", vmmID)
+			lease = &Lease{IP: ip, MAC: staticConfig.MacAddress}
+		}
+	}
+
+	pid, err := m.PID()
+	if err != nil {
+		log.WithError(err).Warnf("failed to get PID of machine %s", vmmID)
+	}
 
-	log.WithField("ip", m.Cfg.NetworkInterfaces[0].StaticConfiguration.IPConfiguration.IPAddr.IP).Info("machine started")
+	err = updateMachineInfo(ctx, vmmID, func(info *MachineInfo) {
+		info.IP = lease.IP.String()
+		info.MAC = lease.MAC
+		info.PID = pid
+		// the jailer moves the socket into the chroot
+		info.SocketPath = m.Cfg.SocketPath
+	})
+	if err != nil {
+		log.WithError(err).Errorf("failed to store network info for machine %s", vmmID)
+	}
 
-	return &runningFirecracker{
+	vm := &runningFirecracker{
 		vmmCtx:    vmmCtx,
 		vmmCancel: vmmCancel,
 		vmmID:     vmmID,
 		machine:   m,
-		ip:        m.Cfg.NetworkInterfaces[0].StaticConfiguration.IPConfiguration.IPAddr.IP,
-	}, nil
+		ip:        lease.IP,
+		mac:       lease.MAC,
+		pid:       pid,
+	}
+	vm.touch()
+
+	if snapshot != nil {
+		return vm, nil
+	}
+	vm.startedAt = startedAt
+
+	emitEvent(Event{
+		Type:      EventMachineBooted,
+		MachineID: vmmID,
+		App:       machineConfig.AppName,
+		Data: map[string]interface{}{
+			"ip":      lease.IP.String(),
+			"pid":     pid,
+			"boot_ms": time.Since(startedAt).Milliseconds(),
+		},
+	})
+
+	return vm, nil
+}
+
+// lendRootFS puts this machine's rootfs where a snapshot taken elsewhere
+// expects its drive, if nothing is there, for as long as the snapshot loads.
+// The source machine may be gone or have lived on another host. Only paths
+// next to the machine's own rootfs are lent to.
+func lendRootFS(vmmID, path string) (func(), error) {
+	if filepath.Dir(path) != filepath.Dir(getRootFSPath(vmmID)) {
+		return nil, fmt.Errorf("snapshot refers to a rootfs outside of %s", filepath.Dir(getRootFSPath(vmmID)))
+	}
+	if _, err := os.Lstat(path); err == nil {
+		return func() {}, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := os.Symlink(getRootFSPath(vmmID), path); err != nil {
+		return nil, err
+	}
+	return func() { removeIfExists(path) }, nil
+}
+
+// switchRootFS points the drive of a VMM restored from another machine's
+// snapshot at the machine's own rootfs and lets the guest run.
+func switchRootFS(ctx context.Context, m *firecracker.Machine, vmmID string) error {
+	path := getRootFSPath(vmmID)
+	if jailer != nil {
+		path = "/" + filepath.Base(path)
+	}
+	if err := m.UpdateGuestDrive(ctx, rootDriveID, path); err != nil {
+		return err
+	}
+	return m.ResumeVM(ctx)
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -10,43 +11,47 @@ import (
 	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
 )
 
-func getFirecrackerConfig(vmmID string, vCPUCount, memorySize int64) (firecracker.Config, error) {
+// rootDriveID is the ID the rootfs drive is attached under
+const rootDriveID = "1"
+
+func getFirecrackerConfig(vmmID string, vCPUCount, memorySize int64, iface firecracker.NetworkInterface, volumes []VolumeMount) (firecracker.Config, error) {
 	socket := getSocketPath(vmmID)
-	logFilePath := "/tmp/firecracker-" + vmmID + ".log"
+	logFilePath := getLogPath(vmmID)
 
 	kernelImagePath := os.Getenv("KERNEL_IMAGE_PATH")
 
+	drives := []models.Drive{{
+		DriveID:      firecracker.String(rootDriveID),
+		PathOnHost:   firecracker.String(getRootFSPath(vmmID)),
+		IsRootDevice: firecracker.Bool(true),
+		IsReadOnly:   firecracker.Bool(false),
+		RateLimiter:  driveRateLimiter(),
+	}}
+	for i, volume := range volumes {
+		drives = append(drives, models.Drive{
+			DriveID:      firecracker.String(fmt.Sprintf("volume%d", i)),
+			PathOnHost:   firecracker.String(getVolumePath(volume.VolumeID)),
+			IsRootDevice: firecracker.Bool(false),
+			IsReadOnly:   firecracker.Bool(volume.ReadOnly),
+			RateLimiter:  driveRateLimiter(),
+		})
+	}
+
+	var kernelArgs string
+	if len(volumes) > 0 {
+		kernelArgs = "quest.volumes=" + volumesKernelArg(volumes)
+	}
+
 	return firecracker.Config{
 		SocketPath:      socket,
 		KernelImagePath: kernelImagePath,
+		KernelArgs:      kernelArgs,
 		// KernelImagePath: "../agent/hello-vmlinux.bin",
 		// LogPath:         fmt.Sprintf("%s.log", socket),
-		LogPath: logFilePath,
-		Drives: []models.Drive{{
-			DriveID:      firecracker.String("1"),
-			PathOnHost:   firecracker.String("/tmp/rootfs-" + vmmID + ".ext4"),
-			IsRootDevice: firecracker.Bool(true),
-			IsReadOnly:   firecracker.Bool(false),
-			RateLimiter: firecracker.NewRateLimiter(
-				// bytes/s
-				models.TokenBucket{
-					OneTimeBurst: firecracker.Int64(1024 * 1024), // 1 MiB/s
-					RefillTime:   firecracker.Int64(500),         // 0.5s
-					Size:         firecracker.Int64(1024 * 1024),
-				},
-				// ops/s
-				models.TokenBucket{
-					OneTimeBurst: firecracker.Int64(100),  // 100 iops
-					RefillTime:   firecracker.Int64(1000), // 1s
-					Size:         firecracker.Int64(100),
-				}),
-		}},
-		NetworkInterfaces: []firecracker.NetworkInterface{{
-			CNIConfiguration: &firecracker.CNIConfiguration{
-				NetworkName: "fcnet",
-				IfName:      "veth0",
-			},
-		}},
+		LogPath:           logFilePath,
+		MetricsPath:       getMetricsPath(vmmID),
+		Drives:            drives,
+		NetworkInterfaces: []firecracker.NetworkInterface{iface},
 		MachineCfg: models.MachineConfiguration{
 			VcpuCount:  firecracker.Int64(vCPUCount),
 			MemSizeMib: firecracker.Int64(memorySize),
@@ -54,6 +59,22 @@ func getFirecrackerConfig(vmmID string, vCPUCount, memorySize int64) (firecracke
 	}, nil
 }
 
+func driveRateLimiter() *models.RateLimiter {
+	return firecracker.NewRateLimiter(
+		// bytes/s
+		models.TokenBucket{
+			OneTimeBurst: firecracker.Int64(1024 * 1024), // 1 MiB/s
+			RefillTime:   firecracker.Int64(500),         // 0.5s
+			Size:         firecracker.Int64(1024 * 1024),
+		},
+		// ops/s
+		models.TokenBucket{
+			OneTimeBurst: firecracker.Int64(100),  // 100 iops
+			RefillTime:   firecracker.Int64(1000), // 1s
+			Size:         firecracker.Int64(100),
+		})
+}
+
 func getSocketPath(vmmID string) string {
 	filename := strings.Join([]string{
 		".firecracker.sock",
@@ -66,3 +87,33 @@ func getSocketPath(vmmID string) string {
 
 	return filepath.Join(dir, filename)
 }
+
+// getRootFSPath is the VM's copy of the rootfs. Under the jailer it sits next
+// to the chroots so it can be hard-linked into one.
+func getRootFSPath(vmmID string) string {
+	if jailer != nil {
+		return filepath.Join(jailer.ChrootBaseDir, "rootfs-"+vmmID+".ext4")
+	}
+	return "/tmp/rootfs-" + vmmID + ".ext4"
+}
+
+func getVsockPath(vmmID string) string {
+	if jailer != nil {
+		return filepath.Join(jailer.rootDir(vmmID), jailVsockName)
+	}
+	return "/tmp/firecracker-" + vmmID + ".vsock"
+}
+
+func getMetricsPath(vmmID string) string {
+	if jailer != nil {
+		return filepath.Join(jailer.rootDir(vmmID), jailMetricsName)
+	}
+	return "/tmp/firecracker-" + vmmID + ".metrics"
+}
+
+func getLogPath(vmmID string) string {
+	if jailer != nil {
+		return filepath.Join(jailer.rootDir(vmmID), jailLogName)
+	}
+	return "/tmp/firecracker-" + vmmID + ".log"
+}
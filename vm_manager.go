@@ -31,3 +31,26 @@ func (manager *FirecrackerManager) GetVM(id string) (*runningFirecracker, bool)
 	vm, exists := manager.vms[id]
 	return vm, exists
 }
+
+// IsCurrent reports whether vm is the VMM currently managed for its machine.
+func (manager *FirecrackerManager) IsCurrent(vm *runningFirecracker) bool {
+	manager.Lock()
+	defer manager.Unlock()
+	return manager.vms[vm.vmmID] == vm
+}
+
+func (manager *FirecrackerManager) List() []*runningFirecracker {
+	manager.Lock()
+	defer manager.Unlock()
+	vms := make([]*runningFirecracker, 0, len(manager.vms))
+	for _, vm := range manager.vms {
+		vms = append(vms, vm)
+	}
+	return vms
+}
+
+func (manager *FirecrackerManager) Count() int {
+	manager.Lock()
+	defer manager.Unlock()
+	return len(manager.vms)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+// metricsGroups are the sections of firecracker's metrics that get reported.
+var metricsGroups = []string{"vcpu", "block", "net", "balloon"}
+
+type MachineStats struct {
+	MachineID   string                       `json:"machine_id"`
+	CollectedAt time.Time                    `json:"collected_at"`
+	Metrics     map[string]map[string]uint64 `json:"metrics"`
+	Balloon     *models.BalloonStats         `json:"balloon,omitempty"`
+	Cgroup      *CgroupStats                 `json:"cgroup,omitempty"`
+}
+
+// createMetricsFile makes sure the metrics file exists and is empty before
+// firecracker is pointed at it, so the totals of a VMM start from zero.
+func createMetricsFile(vmmID string) error {
+	f, err := os.OpenFile(getMetricsPath(vmmID), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func validateBalloon(balloon *BalloonConfig, memoryMb int64) error {
+	if balloon == nil {
+		return nil
+	}
+	if balloon.AmountMib < 0 || balloon.AmountMib >= memoryMb {
+		return fmt.Errorf("balloon amount_mib must be between 0 and the machine's memory (%d MiB)", memoryMb)
+	}
+	if balloon.StatsIntervalSeconds < 0 {
+		return fmt.Errorf("balloon stats_interval_seconds must not be negative")
+	}
+	return nil
+}
+
+// balloonHandler adds the balloon device before boot, which is the only time
+// its statistics can be turned on.
+func balloonHandler(balloon *BalloonConfig) firecracker.Handler {
+	return firecracker.NewCreateBalloonHandler(balloon.AmountMib, balloon.DeflateOnOom, balloon.StatsIntervalSeconds)
+}
+
+// flushMetrics asks firecracker to write out its current metrics instead of
+// waiting for the periodic flush.
+func flushMetrics(ctx context.Context, vm *runningFirecracker) error {
+	fcClient := firecracker.NewClient(vm.machine.Cfg.SocketPath, log.NewEntry(log.New()), false)
+	_, err := fcClient.CreateSyncAction(ctx, &models.InstanceActionInfo{
+		ActionType: firecracker.String(models.InstanceActionInfoActionTypeFlushMetrics),
+	})
+	return err
+}
+
+// metricsTotals are the sums of a VMM's metrics file so far and how much of
+// the file they cover. Firecracker only appends to it, so each read picks up
+// where the last one stopped.
+type metricsTotals struct {
+	mu     sync.Mutex
+	offset int64
+	totals map[string]map[string]uint64
+}
+
+// readMetrics adds the lines firecracker wrote since the last read to the
+// totals of a machine. Firecracker's counters reset on every flush, so each
+// line only holds the delta since the last one.
+func (vm *runningFirecracker) readMetrics() (map[string]map[string]uint64, error) {
+	m := &vm.metrics
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.totals == nil {
+		m.totals = make(map[string]map[string]uint64, len(metricsGroups))
+		for _, group := range metricsGroups {
+			m.totals[group] = make(map[string]uint64)
+		}
+	}
+
+	f, err := os.Open(getMetricsPath(vm.vmmID))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(m.offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReaderSize(f, 64*1024)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// A line still being written is read once it's complete
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		m.offset += int64(len(line))
+
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		var flush map[string]map[string]json.RawMessage
+		if err := json.Unmarshal(line, &flush); err != nil {
+			log.WithError(err).Debugf("skipping unreadable metrics line of machine %s", vm.vmmID)
+			continue
+		}
+
+		for _, group := range metricsGroups {
+			for name, raw := range flush[group] {
+				// Latency metrics are objects, only plain counters are summed
+				var value uint64
+				if err := json.Unmarshal(raw, &value); err == nil {
+					m.totals[group][name] += value
+				}
+			}
+		}
+	}
+
+	totals := make(map[string]map[string]uint64, len(m.totals))
+	for group, counters := range m.totals {
+		totals[group] = make(map[string]uint64, len(counters))
+		for name, value := range counters {
+			totals[group][name] = value
+		}
+	}
+	return totals, nil
+}
+
+func getMachineStats(c echo.Context) error {
+	machineID := c.Param("machine_id")
+	ctx := context.Background()
+
+	machineInfo, err := fetchMachineInfo(ctx, machineID)
+	if err != nil {
+		if strings.Contains(err.Error(), "machine not found") {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Machine not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+
+	vm, ok := fcManager.GetVM(machineID)
+	if !ok {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Machine is not running"})
+	}
+
+	if err := flushMetrics(ctx, vm); err != nil {
+		log.WithError(err).Warnf("failed to flush metrics of machine %s", machineID)
+	}
+
+	metrics, err := vm.readMetrics()
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to read machine metrics")
+	}
+
+	stats := MachineStats{
+		MachineID:   machineID,
+		CollectedAt: time.Now().UTC(),
+		Metrics:     metrics,
+	}
+
+	machineConfig := machineInfo.machineConfig()
+	if machineConfig.Balloon != nil && machineConfig.Balloon.StatsIntervalSeconds > 0 {
+		balloonStats, err := vm.machine.GetBalloonStats(ctx)
+		if err != nil {
+			log.WithError(err).Warnf("failed to get balloon stats of machine %s", machineID)
+		} else {
+			stats.Balloon = &balloonStats
+		}
+	}
+
+	if cgroups != nil {
+		cgroupStats, err := cgroups.stats(machineID)
+		if err != nil {
+			log.WithError(err).Warnf("failed to read cgroup stats of machine %s", machineID)
+		} else {
+			stats.Cgroup = cgroupStats
+		}
+	}
+
+	return c.JSON(http.StatusOK, stats)
+}
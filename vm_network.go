@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	NetworkModeEnvVar = "NETWORK_MODE"
+	BridgeNameEnvVar  = "BRIDGE_NAME"
+	DNSServersEnvVar  = "DNS_SERVERS"
+
+	NetworkModeCNI = "cni"
+	NetworkModeTap = "tap"
+
+	defaultBridgeName = "questbr0"
+	tapPrefix         = "qtap"
+	guestIfName       = "eth0"
+)
+
+func networkMode() string {
+	if strings.ToLower(os.Getenv(NetworkModeEnvVar)) == NetworkModeTap {
+		return NetworkModeTap
+	}
+	return NetworkModeCNI
+}
+
+func bridgeName() string {
+	if name := os.Getenv(BridgeNameEnvVar); name != "" {
+		return name
+	}
+	return defaultBridgeName
+}
+
+// tapName is derived from the leased address so a tap can always be traced
+// back to its lease, and stays within the 15 character interface name limit.
+func tapName(ip net.IP) string {
+	return fmt.Sprintf("%s%08x", tapPrefix, ipToUint32(ip))
+}
+
+func tapIP(name string) (net.IP, bool) {
+	var n uint32
+	if _, err := fmt.Sscanf(strings.TrimPrefix(name, tapPrefix), "%08x", &n); err != nil {
+		return nil, false
+	}
+	return ipAdd(net.IPv4zero, n), true
+}
+
+// setupNetworkInterface returns the interface a new VM should boot with. In
+// tap mode it also allocates the lease and creates the tap device; in CNI mode
+// the lease is reconciled once CNI has run.
+func setupNetworkInterface(ctx context.Context, vmmID string) (firecracker.NetworkInterface, *Lease, error) {
+	if networkMode() != NetworkModeTap {
+		return firecracker.NetworkInterface{
+			CNIConfiguration: &firecracker.CNIConfiguration{
+				NetworkName: "fcnet",
+				IfName:      "veth0",
+			},
+		}, nil, nil
+	}
+
+	owner, err := tapOwner(ctx, vmmID)
+	if err != nil {
+		return firecracker.NetworkInterface{}, nil, err
+	}
+	lease, err := ipam.Allocate(ctx, vmmID)
+	if err != nil {
+		return firecracker.NetworkInterface{}, nil, err
+	}
+
+	tap := tapName(lease.IP)
+	if err := createTap(tap, owner); err != nil {
+		if releaseErr := ipam.Release(ctx, vmmID); releaseErr != nil {
+			log.WithError(releaseErr).Errorf("failed to release lease for machine %s", vmmID)
+		}
+		return firecracker.NetworkInterface{}, nil, err
+	}
+
+	var nameservers []string
+	if servers := os.Getenv(DNSServersEnvVar); servers != "" {
+		nameservers = strings.Split(servers, ",")
+	}
+
+	// The SDK turns IPConfiguration into an ip= kernel boot arg for the guest
+	return firecracker.NetworkInterface{
+		StaticConfiguration: &firecracker.StaticNetworkConfiguration{
+			MacAddress:  lease.MAC,
+			HostDevName: tap,
+			IPConfiguration: &firecracker.IPConfiguration{
+				IPAddr: net.IPNet{
+					IP:   lease.IP,
+					Mask: ipam.Subnet().Mask,
+				},
+				Gateway:     ipam.Gateway(),
+				Nameservers: nameservers,
+				IfName:      guestIfName,
+			},
+		},
+	}, lease, nil
+}
+
+// teardownNetwork removes the tap device of a machine (if any) and releases its lease.
+func teardownNetwork(ctx context.Context, machineID string) error {
+	lease, err := ipam.LeaseFor(ctx, machineID)
+	if err != nil {
+		return err
+	}
+	if lease == nil {
+		return nil
+	}
+
+	if err := deleteTap(tapName(lease.IP)); err != nil {
+		log.WithError(err).Errorf("failed to delete tap for machine %s", machineID)
+	}
+
+	return ipam.Release(ctx, machineID)
+}
+
+// setupBridge makes sure the managed bridge exists, carries the gateway
+// address and NATs guest traffic out of the host.
+func setupBridge() error {
+	name := bridgeName()
+
+	link, err := netlink.LinkByName(name)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		attrs := netlink.NewLinkAttrs()
+		attrs.Name = name
+		if err := netlink.LinkAdd(&netlink.Bridge{LinkAttrs: attrs}); err != nil {
+			return fmt.Errorf("failed to create bridge %s: %v", name, err)
+		}
+		link, err = netlink.LinkByName(name)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to look up bridge %s: %v", name, err)
+	}
+
+	gatewayAddr := &netlink.Addr{IPNet: &net.IPNet{IP: ipam.Gateway(), Mask: ipam.Subnet().Mask}}
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("failed to list addresses of bridge %s: %v", name, err)
+	}
+
+	hasGateway := false
+	for _, addr := range addrs {
+		if addr.IP.Equal(ipam.Gateway()) {
+			hasGateway = true
+			break
+		}
+	}
+	if !hasGateway {
+		if err := netlink.AddrAdd(link, gatewayAddr); err != nil {
+			return fmt.Errorf("failed to add %s to bridge %s: %v", gatewayAddr, name, err)
+		}
+	}
+
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("failed to bring up bridge %s: %v", name, err)
+	}
+
+	if err := os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644); err != nil {
+		return fmt.Errorf("failed to enable ip forwarding: %v", err)
+	}
+
+	subnet := ipam.Subnet().String()
+	rules := [][]string{
+		{"-t", "nat", "POSTROUTING", "-s", subnet, "!", "-o", name, "-j", "MASQUERADE"},
+		{"-t", "filter", "FORWARD", "-i", name, "-j", "ACCEPT"},
+		{"-t", "filter", "FORWARD", "-o", name, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+	}
+	for _, rule := range rules {
+		if err := ensureIptablesRule(rule...); err != nil {
+			return err
+		}
+	}
+
+	log.WithField("bridge", name).Info("Bridge network ready")
+	return nil
+}
+
+// ensureIptablesRule appends a rule unless it's already present. rule is
+// "-t <table> <chain> <match...>".
+func ensureIptablesRule(rule ...string) error {
+	table, chain, spec := rule[:2], rule[2], rule[3:]
+
+	check := append(append(append([]string{}, table...), "-C", chain), spec...)
+	if err := exec.Command("iptables", check...).Run(); err == nil {
+		return nil
+	}
+
+	add := append(append(append([]string{}, table...), "-A", chain), spec...)
+	if out, err := exec.Command("iptables", add...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to add iptables rule %v: %v: %s", rule, err, out)
+	}
+	return nil
+}
+
+// tapOwner is the uid the VMM of a machine runs as, which has to own its tap
+// to attach to it. Under the jailer that's the machine's uid, allocated here
+// if it hasn't been yet, otherwise firecracker runs as root.
+func tapOwner(ctx context.Context, vmmID string) (uint32, error) {
+	if jailer == nil {
+		return 0, nil
+	}
+	uid, err := jailer.allocateUID(ctx, vmmID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to allocate uid: %v", err)
+	}
+	return uint32(uid), nil
+}
+
+func createTap(name string, owner uint32) error {
+	bridge, err := netlink.LinkByName(bridgeName())
+	if err != nil {
+		return fmt.Errorf("failed to look up bridge %s: %v", bridgeName(), err)
+	}
+
+	// A restarted VMM keeps its lease, and with it its tap, unless the tap
+	// belongs to a uid the VMM no longer runs as
+	if existing, err := netlink.LinkByName(name); err == nil {
+		if tap, ok := existing.(*netlink.Tuntap); ok && tap.Owner == owner && tap.Group == owner {
+			if err := netlink.LinkSetMaster(existing, bridge); err != nil {
+				return fmt.Errorf("failed to attach tap %s to bridge: %v", name, err)
+			}
+			return netlink.LinkSetUp(existing)
+		}
+		if err := netlink.LinkDel(existing); err != nil {
+			return fmt.Errorf("failed to replace tap %s: %v", name, err)
+		}
+	}
+
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = name
+	attrs.MasterIndex = bridge.Attrs().Index
+
+	tap := &netlink.Tuntap{
+		LinkAttrs: attrs,
+		Mode:      netlink.TUNTAP_MODE_TAP,
+		Owner:     owner,
+		Group:     owner,
+	}
+	if err := netlink.LinkAdd(tap); err != nil {
+		return fmt.Errorf("failed to create tap %s: %v", name, err)
+	}
+
+	// The tap is persistent, firecracker opens it again on its own
+	for _, fd := range tap.Fds {
+		fd.Close()
+	}
+
+	if err := netlink.LinkSetUp(tap); err != nil {
+		return fmt.Errorf("failed to bring up tap %s: %v", name, err)
+	}
+	return nil
+}
+
+func deleteTap(name string) error {
+	link, err := netlink.LinkByName(name)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return netlink.LinkDel(link)
+}
+
+// cleanupOrphanedTaps deletes managed taps whose address is no longer leased,
+// e.g. left behind when the server died between creating a tap and a delete.
+func cleanupOrphanedTaps(ctx context.Context) error {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return err
+	}
+
+	leases, err := ipam.Leases(ctx)
+	if err != nil {
+		return err
+	}
+	leased := make(map[string]bool, len(leases))
+	for _, lease := range leases {
+		leased[tapName(lease.IP)] = true
+	}
+
+	for _, link := range links {
+		name := link.Attrs().Name
+		if _, isTap := link.(*netlink.Tuntap); !isTap || !strings.HasPrefix(name, tapPrefix) {
+			continue
+		}
+		if _, ok := tapIP(name); !ok || leased[name] {
+			continue
+		}
+
+		if err := netlink.LinkDel(link); err != nil {
+			log.WithError(err).Errorf("failed to delete orphaned tap %s", name)
+			continue
+		}
+		log.Infof("Deleted orphaned tap %s", name)
+	}
+
+	return nil
+}
@@ -3,34 +3,160 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"net"
-	"net/http"
-	"time"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
 
 	log "github.com/sirupsen/logrus"
 )
 
 type MachineInfo struct {
-	Status string `json:"status"`
-	IP     string `json:"ip,omitempty"`
+	Status string            `json:"status"`
+	IP     string            `json:"ip,omitempty"`
+	MAC    string            `json:"mac,omitempty"`
+	Ports  []PortMapping     `json:"ports,omitempty"`
+	Config *ApiMachineConfig `json:"config,omitempty"`
+
+	PID        int    `json:"pid,omitempty"`
+	SocketPath string `json:"socket_path,omitempty"`
+
+	Reservation *Reservation `json:"reservation,omitempty"`
+
+	// Snapshot is set while the machine is scaled to zero
+	Snapshot *MachineSnapshot `json:"snapshot,omitempty"`
+
+	ClonedFrom   string        `json:"cloned_from,omitempty"`
+	CloneNetwork *CloneNetwork `json:"clone_network,omitempty"`
+
+	ExitCode     *int   `json:"exit_code,omitempty"`
+	ExitReason   string `json:"exit_reason,omitempty"`
+	RestartCount int    `json:"restart_count,omitempty"`
 }
 
-func updateMachineStatus(ctx context.Context, machineID string, newStatus MachineStatusType, ip ...net.IP) {
-	info := MachineInfo{
-		Status: string(newStatus),
+// machineConfig returns the config the machine was created with, records
+// written before configs were stored fall back to the defaults.
+func (info *MachineInfo) machineConfig() ApiMachineConfig {
+	if info.Config != nil {
+		return *info.Config
+	}
+	return *defaultMachineConfig()
+}
+
+// machineInfoMu serializes read-modify-write cycles on machine records within
+// this process. Other servers sharing the store are caught by the WATCH in
+// storeMachineInfo, which retries when the record changed underneath it.
+var machineInfoMu sync.Mutex
+
+// Machine records live under their app, machineAppsKey maps machine IDs to
+// apps so a machine can still be found by its ID alone.
+const machineAppsKey = "machine-apps"
+
+// machineInfoMaxRetries bounds how often storeMachineInfo retries when
+// another server wrote the record concurrently
+const machineInfoMaxRetries = 10
+
+func machineKey(app, machineID string) string {
+	return appKey(app) + ":machine:" + machineID
+}
+
+// machineRecordKey looks up where the record of machineID is stored.
+func machineRecordKey(ctx context.Context, machineID string) (string, error) {
+	app, err := machineApp(ctx, machineID)
+	if err != nil {
+		return "", err
 	}
+	return machineKey(app, machineID), nil
+}
 
-	if len(ip) > 0 {
-		info.IP = ip[0].String()
+func machineApp(ctx context.Context, machineID string) (string, error) {
+	app, err := rdb.HGet(ctx, machineAppsKey, machineID).Result()
+	if err == redis.Nil {
+		return "", fmt.Errorf("machine not found")
 	}
+	return app, err
+}
 
-	data, err := json.Marshal(info)
+// registerMachine assigns a new machine to app, it has to happen before the
+// first record of the machine is written.
+func registerMachine(ctx context.Context, machineID, app string) error {
+	return rdb.HSet(ctx, machineAppsKey, machineID, app).Err()
+}
+
+// updateMachineInfo loads the record of machineID (or starts an empty one),
+// applies update and writes the result back. Status changes are recorded as
+// events once the record is stored.
+func updateMachineInfo(ctx context.Context, machineID string, update func(info *MachineInfo)) error {
+	previous, info, err := storeMachineInfo(ctx, machineID, update)
 	if err != nil {
-		log.WithError(err).Error("failed to marshal machine info")
-		return
+		return err
+	}
+
+	if info.Status != previous {
+		emitStatusEvent(machineID, previous, info)
 	}
+	return nil
+}
 
-	err = rdb.Set(ctx, "machine:"+machineID, data, 0).Err()
+func storeMachineInfo(ctx context.Context, machineID string, update func(info *MachineInfo)) (string, *MachineInfo, error) {
+	machineInfoMu.Lock()
+	defer machineInfoMu.Unlock()
+
+	key, err := machineRecordKey(ctx, machineID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var previous string
+	var info MachineInfo
+	// update may run more than once, each time on the freshest record
+	txf := func(tx *redis.Tx) error {
+		info = MachineInfo{}
+		data, err := tx.Get(ctx, key).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if err == nil {
+			if err := json.Unmarshal([]byte(data), &info); err != nil {
+				return err
+			}
+		}
+
+		previous = info.Status
+		update(&info)
+
+		newData, err := json.Marshal(info)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, newData, 0)
+			return nil
+		})
+		return err
+	}
+
+	for attempt := 0; attempt < machineInfoMaxRetries; attempt++ {
+		err = rdb.Watch(ctx, txf, key)
+		if err != redis.TxFailedErr {
+			break
+		}
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return previous, &info, nil
+}
+
+func updateMachineStatus(ctx context.Context, machineID string, newStatus MachineStatusType, ip ...net.IP) {
+	err := updateMachineInfo(ctx, machineID, func(info *MachineInfo) {
+		info.Status = string(newStatus)
+		if len(ip) > 0 {
+			info.IP = ip[0].String()
+		}
+	})
 
 	if err != nil {
 		log.WithError(err).Error("failed to update machine status in Redis")
@@ -39,29 +165,51 @@ func updateMachineStatus(ctx context.Context, machineID string, newStatus Machin
 	}
 }
 
-func healthCheckMachine(ctx context.Context, machineIP net.IP, machineID string) {
-	url := "http://" + machineIP.String() + ":8081/health"
+// listMachineInfos returns the machine records of app, or of every app if
+// app is empty, keyed by machine ID. Records that can't be read are logged
+// and skipped.
+func listMachineInfos(ctx context.Context, app string) (map[string]*MachineInfo, error) {
+	if app == "" {
+		app = "*"
+	}
 
-	for i := 0; i < HealthCheckMaxRetries; i++ {
-		resp, err := http.Get(url)
+	keys, err := rdb.Keys(ctx, machineKey(app, "*")).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	machines := make(map[string]*MachineInfo, len(keys))
+	for _, key := range keys {
+		data, err := rdb.Get(ctx, key).Result()
 		if err != nil {
-			log.Errorf("Health check failed for machine %s: %v", machineID, err)
-			time.Sleep(HealthCheckInterval)
+			log.WithError(err).Errorf("failed to fetch machine info for key %s", key)
 			continue
 		}
 
-		defer resp.Body.Close()
-
-		if resp.StatusCode == http.StatusOK {
-			log.Infof("Machine %s is healthy", machineID)
-			updateMachineStatus(ctx, machineID, StatusRunning, machineIP)
-			return
+		var machineInfo MachineInfo
+		if err := json.Unmarshal([]byte(data), &machineInfo); err != nil {
+			log.WithError(err).Errorf("failed to unmarshal machine info for key %s", key)
+			continue
 		}
 
-		log.Warnf("Machine %s is not ready, retrying...", machineID)
-		time.Sleep(HealthCheckInterval)
+		machines[key[strings.LastIndex(key, ":")+1:]] = &machineInfo
+	}
+
+	return machines, nil
+}
+
+func deleteMachineInfo(ctx context.Context, machineID string) error {
+	machineInfoMu.Lock()
+	defer machineInfoMu.Unlock()
+
+	key, err := machineRecordKey(ctx, machineID)
+	if err != nil {
+		return err
 	}
 
-	log.Errorf("Machine %s failed to become healthy after retries", machineID)
-	updateMachineStatus(ctx, machineID, StatusFailed)
+	pipe := rdb.TxPipeline()
+	pipe.Del(ctx, key, healthKey(machineID))
+	pipe.HDel(ctx, machineAppsKey, machineID)
+	_, err = pipe.Exec(ctx)
+	return err
 }
@@ -0,0 +1,562 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/xid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	VolumeDirEnvVar = "VOLUME_DIR"
+
+	defaultVolumeDir = "/var/lib/quest/volumes"
+
+	// volumesKey is a hash of volume ID to volume, volumeAttachmentsKey one
+	// of volume ID to the machine it's attached to
+	volumesKey           = "volumes"
+	volumeAttachmentsKey = "volumes:attachments"
+
+	maxVolumeSizeMB   = 1024 * 1024
+	maxMachineVolumes = 8
+
+	// volumeTxMaxRetries bounds how often a change to volumes is retried
+	// when another server changed them in between
+	volumeTxMaxRetries = 10
+
+	// ext4 labels are at most 16 bytes
+	maxVolumeLabelLength = 16
+)
+
+var mountPathPattern = regexp.MustCompile(`^(/[A-Za-z0-9._-]+)+$`)
+
+// Volume is an ext4 filesystem that outlives the machines it's attached to.
+type Volume struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	App       string    `json:"app"`
+	SizeMB    int64     `json:"size_mb"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// Host is the server the volume's file lives on, only machines there
+	// can mount it
+	Host string `json:"host,omitempty"`
+
+	// MachineID is the machine the volume is attached to, if any
+	MachineID string `json:"machine_id,omitempty"`
+}
+
+type CreateVolumeRequest struct {
+	Name    string `json:"name"`
+	AppName string `json:"app_name"`
+	SizeMB  int64  `json:"size_mb"`
+}
+
+// volumeDir holds the volume files. Under the jailer it defaults to a
+// directory next to the chroots, volumes are hard-linked into them like the
+// rootfs.
+func volumeDir() string {
+	if dir := os.Getenv(VolumeDirEnvVar); dir != "" {
+		return dir
+	}
+	if jailer != nil {
+		return filepath.Join(jailer.ChrootBaseDir, "volumes")
+	}
+	return defaultVolumeDir
+}
+
+// host is where the volume lives. Volumes from before hosts were recorded
+// were all made here.
+func (volume *Volume) host() string {
+	if volume.Host == "" {
+		return currentHost()
+	}
+	return volume.Host
+}
+
+// volumeTx runs txf with the volumes and their attachments watched, so
+// checks it makes hold until it commits even with other servers around.
+func volumeTx(ctx context.Context, txf func(tx *redis.Tx) error) error {
+	var err error
+	for attempt := 0; attempt < volumeTxMaxRetries; attempt++ {
+		err = rdb.Watch(ctx, txf, volumesKey, volumeAttachmentsKey)
+		if err != redis.TxFailedErr {
+			break
+		}
+	}
+	return err
+}
+
+func getVolumePath(volumeID string) string {
+	return filepath.Join(volumeDir(), "volume-"+volumeID+".ext4")
+}
+
+// volumeDeviceName is the guest device of a machine's i-th volume. The
+// rootfs is always vda, firecracker attaches it first.
+func volumeDeviceName(i int) string {
+	return "vd" + string(rune('b'+i))
+}
+
+// volumesKernelArg tells the guest agent where to mount the volumes, as
+// device:path:mode entries, e.g. vdb:/data:rw,vdc:/cache:ro.
+func volumesKernelArg(mounts []VolumeMount) string {
+	entries := make([]string, len(mounts))
+	for i, mount := range mounts {
+		mode := "rw"
+		if mount.ReadOnly {
+			mode = "ro"
+		}
+		entries[i] = fmt.Sprintf("%s:%s:%s", volumeDeviceName(i), mount.MountPath, mode)
+	}
+	return strings.Join(entries, ",")
+}
+
+func validateVolumeMounts(mounts []VolumeMount) error {
+	if len(mounts) > maxMachineVolumes {
+		return fmt.Errorf("machines can have at most %d volumes", maxMachineVolumes)
+	}
+
+	volumes := make(map[string]bool)
+	paths := make(map[string]bool)
+	for _, mount := range mounts {
+		if mount.Volume == "" {
+			return fmt.Errorf("volume mounts need a volume")
+		}
+		if !mountPathPattern.MatchString(mount.MountPath) || filepath.Clean(mount.MountPath) != mount.MountPath {
+			return fmt.Errorf("invalid mount path %q for volume %s", mount.MountPath, mount.Volume)
+		}
+		if volumes[mount.Volume] {
+			return fmt.Errorf("volume %s is mounted twice", mount.Volume)
+		}
+		if paths[mount.MountPath] {
+			return fmt.Errorf("more than one volume is mounted at %s", mount.MountPath)
+		}
+		volumes[mount.Volume] = true
+		paths[mount.MountPath] = true
+	}
+	return nil
+}
+
+func listVolumes(ctx context.Context) ([]Volume, error) {
+	entries, err := rdb.HGetAll(ctx, volumesKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	attachments, err := rdb.HGetAll(ctx, volumeAttachmentsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	volumes := make([]Volume, 0, len(entries))
+	for id, data := range entries {
+		var volume Volume
+		if err := json.Unmarshal([]byte(data), &volume); err != nil {
+			log.WithError(err).Errorf("failed to unmarshal volume %s", id)
+			continue
+		}
+		volume.MachineID = attachments[id]
+		volumes = append(volumes, volume)
+	}
+
+	sort.Slice(volumes, func(i, j int) bool {
+		return volumes[i].CreatedAt.Before(volumes[j].CreatedAt)
+	})
+	return volumes, nil
+}
+
+func fetchVolume(ctx context.Context, volumeID string) (*Volume, error) {
+	data, err := rdb.HGet(ctx, volumesKey, volumeID).Result()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("volume not found")
+	} else if err != nil {
+		return nil, err
+	}
+
+	var volume Volume
+	if err := json.Unmarshal([]byte(data), &volume); err != nil {
+		return nil, err
+	}
+
+	machineID, err := rdb.HGet(ctx, volumeAttachmentsKey, volumeID).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	volume.MachineID = machineID
+	return &volume, nil
+}
+
+// attachVolumes claims the volumes a machine mounts and records which volume
+// each name resolved to. A volume is attached to one machine at a time, so
+// nothing else writes to the filesystem under the guest.
+func attachVolumes(ctx context.Context, machineID string, machineConfig *ApiMachineConfig) error {
+	if len(machineConfig.Volumes) == 0 {
+		return nil
+	}
+
+	volumes, err := listVolumes(ctx)
+	if err != nil {
+		return err
+	}
+	byName := make(map[string]Volume)
+	for _, volume := range volumes {
+		if volume.App == machineConfig.AppName {
+			byName[volume.Name] = volume
+		}
+	}
+
+	for i := range machineConfig.Volumes {
+		mount := &machineConfig.Volumes[i]
+		volume, ok := byName[mount.Volume]
+		if !ok {
+			detachVolumes(ctx, machineID)
+			return &AdmissionError{http.StatusNotFound, fmt.Sprintf("volume %s not found", mount.Volume)}
+		}
+		if host := volume.host(); host != currentHost() {
+			detachVolumes(ctx, machineID)
+			return &AdmissionError{http.StatusConflict, fmt.Sprintf("volume %s is on host %s", mount.Volume, host)}
+		}
+
+		if err := claimVolume(ctx, &volume, machineID); err != nil {
+			detachVolumes(ctx, machineID)
+			return err
+		}
+		mount.VolumeID = volume.ID
+	}
+	return nil
+}
+
+// claimVolume attaches a volume to a machine, unless it's been deleted or
+// attached elsewhere since it was looked up.
+func claimVolume(ctx context.Context, volume *Volume, machineID string) error {
+	var claimErr error
+	err := volumeTx(ctx, func(tx *redis.Tx) error {
+		claimErr = nil
+		exists, err := tx.HExists(ctx, volumesKey, volume.ID).Result()
+		if err != nil {
+			return err
+		}
+		if !exists {
+			claimErr = &AdmissionError{http.StatusNotFound, fmt.Sprintf("volume %s not found", volume.Name)}
+			return nil
+		}
+		owner, err := tx.HGet(ctx, volumeAttachmentsKey, volume.ID).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if owner != "" && owner != machineID {
+			claimErr = &AdmissionError{http.StatusConflict, fmt.Sprintf("volume %s is attached to another machine", volume.Name)}
+			return nil
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, volumeAttachmentsKey, volume.ID, machineID)
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return claimErr
+}
+
+// detachVolumes frees the volumes of a machine. The volumes and their data
+// stay.
+func detachVolumes(ctx context.Context, machineID string) {
+	attachments, err := rdb.HGetAll(ctx, volumeAttachmentsKey).Result()
+	if err != nil {
+		log.WithError(err).Errorf("failed to detach volumes of machine %s", machineID)
+		return
+	}
+	for volumeID, owner := range attachments {
+		if owner != machineID {
+			continue
+		}
+		if err := rdb.HDel(ctx, volumeAttachmentsKey, volumeID).Err(); err != nil {
+			log.WithError(err).Errorf("failed to detach volume %s from machine %s", volumeID, machineID)
+		}
+	}
+}
+
+// detachOrphanedVolumes frees volumes claimed by machines that never made it
+// into the store, or whose record is gone.
+func detachOrphanedVolumes(ctx context.Context, infos map[string]*MachineInfo) {
+	attachments, err := rdb.HGetAll(ctx, volumeAttachmentsKey).Result()
+	if err != nil {
+		log.WithError(err).Error("failed to list volume attachments")
+		return
+	}
+	for volumeID, machineID := range attachments {
+		if _, ok := infos[machineID]; ok {
+			continue
+		}
+		log.Infof("Detaching volume %s from missing machine %s", volumeID, machineID)
+		if err := rdb.HDel(ctx, volumeAttachmentsKey, volumeID).Err(); err != nil {
+			log.WithError(err).Errorf("failed to detach volume %s", volumeID)
+		}
+	}
+}
+
+// formatVolume creates a sparse file of the volume's size with an empty
+// ext4 filesystem on it.
+func formatVolume(path string, sizeMB int64, label string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(sizeMB << 20)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		removeIfExists(path)
+		return err
+	}
+
+	if len(label) > maxVolumeLabelLength {
+		label = label[:maxVolumeLabelLength]
+	}
+	out, err := exec.Command("mkfs.ext4", "-q", "-F", "-L", label, path).CombinedOutput()
+	if err != nil {
+		removeIfExists(path)
+		return fmt.Errorf("mkfs.ext4 failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// canAccessVolume applies the app scoping authorizeApp does for machines.
+func canAccessVolume(c echo.Context, volume *Volume) bool {
+	if app := c.Param("app_name"); app != "" && app != volume.App {
+		return false
+	}
+	return callerKey(c).canAccessApp(volume.App)
+}
+
+func createVolume(c echo.Context) error {
+	ctx := context.Background()
+
+	var req CreateVolumeRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	// The app in the path wins, it's already been checked by authorizeApp
+	if app := c.Param("app_name"); app != "" {
+		req.AppName = app
+	} else {
+		if !callerKey(c).canAccessApp(req.AppName) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "App not found"})
+		}
+		if _, err := fetchApp(ctx, req.AppName); err != nil {
+			if strings.Contains(err.Error(), "app not found") {
+				return c.JSON(http.StatusNotFound, map[string]string{"error": "App not found"})
+			}
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+		}
+	}
+	if !appNamePattern.MatchString(req.Name) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "volume name must be 1-63 lowercase letters, digits, '-' or '_', starting with a letter or digit"})
+	}
+	if req.SizeMB <= 0 || req.SizeMB > maxVolumeSizeMB {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("size_mb must be between 1 and %d", maxVolumeSizeMB)})
+	}
+
+	// Checked again when the volume is stored, this saves formatting one
+	// that can't be
+	existing, err := listVolumes(ctx)
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to fetch volumes")
+	}
+	if volumeNameTaken(existing, req.AppName, req.Name) {
+		return c.JSON(http.StatusConflict, map[string]string{"error": fmt.Sprintf("App already has a volume named %s", req.Name)})
+	}
+
+	volume := Volume{
+		ID:        xid.New().String(),
+		Name:      req.Name,
+		App:       req.AppName,
+		SizeMB:    req.SizeMB,
+		CreatedAt: time.Now().UTC(),
+		Host:      currentHost(),
+	}
+
+	// Volumes count against the app's disk quota like machine disks do
+	quota, err := appQuota(ctx, volume.App)
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to fetch quota")
+	}
+	checks := diskChecks(volume.App, quota, volume.Host, volume.SizeMB)
+	if err := reserve(ctx, checks); err != nil {
+		var admissionErr *AdmissionError
+		if errors.As(err, &admissionErr) {
+			return c.JSON(admissionErr.StatusCode, map[string]string{"error": admissionErr.Reason})
+		}
+		return handleError(c, err, http.StatusInternalServerError, "Failed to reserve disk")
+	}
+
+	if err := formatVolume(getVolumePath(volume.ID), volume.SizeMB, volume.Name); err != nil {
+		release(ctx, checks)
+		return handleError(c, err, http.StatusInternalServerError, "Failed to create volume")
+	}
+
+	taken, err := storeVolume(ctx, &volume)
+	if err != nil || taken {
+		removeIfExists(getVolumePath(volume.ID))
+		release(ctx, checks)
+	}
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to store volume")
+	}
+	if taken {
+		return c.JSON(http.StatusConflict, map[string]string{"error": fmt.Sprintf("App already has a volume named %s", req.Name)})
+	}
+
+	return c.JSON(http.StatusCreated, volume)
+}
+
+func volumeNameTaken(volumes []Volume, app, name string) bool {
+	for _, volume := range volumes {
+		if volume.App == app && volume.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// storeVolume adds a volume unless its app already has one of that name,
+// which it reports.
+func storeVolume(ctx context.Context, volume *Volume) (bool, error) {
+	data, err := json.Marshal(volume)
+	if err != nil {
+		return false, err
+	}
+
+	var taken bool
+	err = volumeTx(ctx, func(tx *redis.Tx) error {
+		entries, err := tx.HGetAll(ctx, volumesKey).Result()
+		if err != nil {
+			return err
+		}
+		existing := make([]Volume, 0, len(entries))
+		for _, entry := range entries {
+			var other Volume
+			if err := json.Unmarshal([]byte(entry), &other); err == nil {
+				existing = append(existing, other)
+			}
+		}
+		if taken = volumeNameTaken(existing, volume.App, volume.Name); taken {
+			return nil
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, volumesKey, volume.ID, data)
+			return nil
+		})
+		return err
+	})
+	return taken, err
+}
+
+func getVolumes(c echo.Context) error {
+	volumes, err := listVolumes(context.Background())
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to fetch volumes")
+	}
+
+	visible := make([]Volume, 0, len(volumes))
+	for i := range volumes {
+		if canAccessVolume(c, &volumes[i]) {
+			visible = append(visible, volumes[i])
+		}
+	}
+	return c.JSON(http.StatusOK, visible)
+}
+
+func getVolume(c echo.Context) error {
+	volume, err := fetchVolume(context.Background(), c.Param("volume_id"))
+	if err != nil {
+		if strings.Contains(err.Error(), "volume not found") {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Volume not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+	if !canAccessVolume(c, volume) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Volume not found"})
+	}
+
+	return c.JSON(http.StatusOK, volume)
+}
+
+// deleteVolume drops a volume and its data. Volumes attached to a machine
+// are refused, delete the machine first. Only the host the volume lives on
+// can delete it.
+func deleteVolume(c echo.Context) error {
+	volumeID := c.Param("volume_id")
+	ctx := context.Background()
+
+	volume, err := fetchVolume(ctx, volumeID)
+	if err != nil {
+		if strings.Contains(err.Error(), "volume not found") {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Volume not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+	if !canAccessVolume(c, volume) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Volume not found"})
+	}
+	if host := volume.host(); host != currentHost() {
+		return c.JSON(http.StatusConflict, map[string]string{"error": fmt.Sprintf("Volume is on host %s, delete it there", host)})
+	}
+
+	// The volume may be attached by another server up to the moment it's
+	// dropped, its file only goes once the record is gone
+	var attachedTo string
+	var deleted bool
+	err = volumeTx(ctx, func(tx *redis.Tx) error {
+		machineID, err := tx.HGet(ctx, volumeAttachmentsKey, volumeID).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if attachedTo = machineID; attachedTo != "" {
+			return nil
+		}
+
+		cmds, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HDel(ctx, volumesKey, volumeID)
+			return nil
+		})
+		if err == nil {
+			deleted = cmds[0].(*redis.IntCmd).Val() > 0
+		}
+		return err
+	})
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to delete volume")
+	}
+	if attachedTo != "" {
+		return c.JSON(http.StatusConflict, map[string]string{"error": fmt.Sprintf("Volume is attached to machine %s", attachedTo)})
+	}
+	if !deleted {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Volume not found"})
+	}
+	removeIfExists(getVolumePath(volumeID))
+	release(ctx, diskChecks(volume.App, AppQuota{}, volume.host(), volume.SizeMB))
+
+	return c.JSON(http.StatusOK, "Volume deleted!")
+}
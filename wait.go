@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultWaitTimeout = 30 * time.Second
+	maxWaitTimeout     = 5 * time.Minute
+
+	// Fallback for stores that don't deliver keyspace notifications
+	waitPollInterval = 2 * time.Second
+)
+
+// terminalStatuses end a wait early, the machine won't get to any other
+// state on its own from there.
+var terminalStatuses = map[MachineStatusType]bool{
+	StatusFailed:    true,
+	StatusCompleted: true,
+}
+
+// enableKeyspaceNotifications turns on the keyspace events waits rely on.
+// Flags already set are kept. Servers that don't allow CONFIG SET still work,
+// waits just fall back to polling.
+func enableKeyspaceNotifications(ctx context.Context) {
+	current, err := rdb.ConfigGet(ctx, "notify-keyspace-events").Result()
+	if err != nil {
+		log.WithError(err).Warn("failed to read keyspace notification settings, waits will poll")
+		return
+	}
+
+	flags := ""
+	if len(current) == 2 {
+		flags, _ = current[1].(string)
+	}
+
+	wanted := flags
+	for _, flag := range []string{"K", "$", "g"} {
+		if !strings.Contains(wanted, flag) && !(flag != "K" && strings.Contains(wanted, "A")) {
+			wanted += flag
+		}
+	}
+	if wanted == flags {
+		return
+	}
+
+	if err := rdb.ConfigSet(ctx, "notify-keyspace-events", wanted).Err(); err != nil {
+		log.WithError(err).Warn("failed to enable keyspace notifications, waits will poll")
+	}
+}
+
+func keyspaceChannel(key string) string {
+	return fmt.Sprintf("__keyspace@%d__:%s", rdb.Options().DB, key)
+}
+
+func validMachineStatus(status MachineStatusType) bool {
+	switch status {
+	case StatusPending, StatusRunning, StatusStopped, StatusFailed, StatusUnhealthy, StatusCompleted, StatusPaused, StatusSuspended:
+		return true
+	}
+	return false
+}
+
+// waitForMachineState blocks until the machine reaches ?state or ?timeout
+// runs out. Without a state it returns the current status right away.
+func waitForMachineState(c echo.Context) error {
+	machineID := c.Param("machine_id")
+	target := MachineStatusType(c.QueryParam("state"))
+
+	timeout := defaultWaitTimeout
+	if value := c.QueryParam("timeout"); value != "" {
+		var err error
+		if timeout, err = time.ParseDuration(value); err != nil || timeout <= 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "timeout must be a positive duration, e.g. 30s"})
+		}
+		if timeout > maxWaitTimeout {
+			timeout = maxWaitTimeout
+		}
+	}
+	if target != "" && !validMachineStatus(target) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("unknown state %q", target)})
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request().Context(), timeout)
+	defer cancel()
+
+	key, err := machineRecordKey(ctx, machineID)
+	if err != nil {
+		if strings.Contains(err.Error(), "machine not found") {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Machine not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+
+	// Subscribe before the first read so no change slips in between
+	sub := rdb.Subscribe(ctx, keyspaceChannel(key))
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err != nil {
+		log.WithError(err).Warnf("failed to subscribe to changes of machine %s", machineID)
+	}
+	changes := sub.Channel()
+
+	poll := time.NewTicker(waitPollInterval)
+	defer poll.Stop()
+
+	for {
+		machineInfo, err := fetchMachineInfo(ctx, machineID)
+		if err != nil {
+			if strings.Contains(err.Error(), "machine not found") {
+				return c.JSON(http.StatusNotFound, map[string]string{"error": "Machine not found"})
+			}
+			if ctx.Err() == nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+			}
+		} else {
+			status := MachineStatusType(machineInfo.Status)
+			if target == "" || status == target {
+				return c.JSON(http.StatusOK, MachineStatusResponse{
+					MachineID: machineID,
+					Status:    status,
+				})
+			}
+			if terminalStatuses[status] {
+				return c.JSON(http.StatusConflict, map[string]string{
+					"error":  fmt.Sprintf("machine is %s and won't become %s", status, target),
+					"status": string(status),
+				})
+			}
+		}
+
+		select {
+		case <-changes:
+		case <-poll.C:
+		case <-ctx.Done():
+			if c.Request().Context().Err() != nil {
+				// The client is gone
+				return nil
+			}
+			status := ""
+			if machineInfo != nil {
+				status = machineInfo.Status
+			}
+			return c.JSON(http.StatusRequestTimeout, map[string]string{
+				"error":  fmt.Sprintf("timed out after %s waiting for machine to be %s", timeout, target),
+				"status": status,
+			})
+		}
+	}
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/xid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	webhooksKey = "webhooks"
+
+	webhookMaxAttempts    = 6
+	webhookInitialBackoff = time.Second
+	webhookMaxBackoff     = time.Minute
+	webhookTimeout        = 10 * time.Second
+
+	webhookDeliveryLogLength = 100
+	webhookDeadLetterLength  = 1000
+	webhookLogMaxRetries     = 10
+
+	WebhookSignatureHeader = "X-Quest-Signature"
+	WebhookTimestampHeader = "X-Quest-Timestamp"
+	WebhookEventHeader     = "X-Quest-Event"
+	WebhookDeliveryHeader  = "X-Quest-Delivery"
+)
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// Webhook is a subscription to events. Events and App filter what gets
+// delivered, the same way as the filters of GET /events.
+type Webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events,omitempty"`
+	App       string    `json:"app,omitempty"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (webhook *Webhook) matches(event *Event) bool {
+	return EventFilter{App: webhook.App, Types: webhook.Events}.matches(event)
+}
+
+// WebhookDelivery is one attempt at delivering an event.
+type WebhookDelivery struct {
+	ID         string    `json:"id"`
+	EventID    string    `json:"event_id"`
+	EventType  string    `json:"event_type"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"duration_ms"`
+	Success    bool      `json:"success"`
+	AttemptAt  time.Time `json:"attempted_at"`
+}
+
+// DeadLetter is an event that could not be delivered within the retry
+// budget, kept for inspection.
+type DeadLetter struct {
+	DeliveryID string    `json:"delivery_id"`
+	Event      Event     `json:"event"`
+	Attempts   int       `json:"attempts"`
+	LastError  string    `json:"last_error"`
+	FailedAt   time.Time `json:"failed_at"`
+}
+
+func webhookDeliveriesKey(webhookID string) string {
+	return "webhook-deliveries:" + webhookID
+}
+
+func webhookDeadLettersKey(webhookID string) string {
+	return "webhook-dead-letters:" + webhookID
+}
+
+func validateWebhook(webhook *Webhook) error {
+	u, err := url.Parse(webhook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an absolute http or https URL")
+	}
+	return nil
+}
+
+func generateWebhookSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// signWebhook returns the signature receivers check: the hex HMAC-SHA256 of
+// "<timestamp>.<body>" keyed with the webhook secret. The timestamp is part
+// of it so old deliveries can't be replayed.
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func listWebhooks(ctx context.Context) ([]Webhook, error) {
+	entries, err := rdb.HGetAll(ctx, webhooksKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	webhooks := make([]Webhook, 0, len(entries))
+	for id, data := range entries {
+		var webhook Webhook
+		if err := json.Unmarshal([]byte(data), &webhook); err != nil {
+			log.WithError(err).Errorf("failed to unmarshal webhook %s", id)
+			continue
+		}
+		webhooks = append(webhooks, webhook)
+	}
+
+	sort.Slice(webhooks, func(i, j int) bool {
+		return webhooks[i].CreatedAt.Before(webhooks[j].CreatedAt)
+	})
+	return webhooks, nil
+}
+
+func fetchWebhook(ctx context.Context, webhookID string) (*Webhook, error) {
+	data, err := rdb.HGet(ctx, webhooksKey, webhookID).Result()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("webhook not found")
+	} else if err != nil {
+		return nil, err
+	}
+
+	var webhook Webhook
+	if err := json.Unmarshal([]byte(data), &webhook); err != nil {
+		return nil, err
+	}
+	return &webhook, nil
+}
+
+// dispatchWebhooks starts a delivery of event to every webhook subscribed
+// to it. Deliveries run in the background so emitting never waits on a
+// receiver.
+func dispatchWebhooks(event Event) {
+	webhooks, err := listWebhooks(context.Background())
+	if err != nil {
+		log.WithError(err).Errorf("failed to load webhooks for %s event", event.Type)
+		return
+	}
+
+	for i := range webhooks {
+		if webhooks[i].matches(&event) {
+			go deliverWebhook(webhooks[i], event)
+		}
+	}
+}
+
+// deliverWebhook posts event to the webhook, retrying with exponential
+// backoff. Every attempt goes to the delivery log; events that run out of
+// attempts end up in the dead-letter list.
+func deliverWebhook(webhook Webhook, event Event) {
+	ctx := context.Background()
+	deliveryID := xid.New().String()
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.WithError(err).Errorf("failed to marshal %s event for webhook %s", event.Type, webhook.ID)
+		return
+	}
+
+	backoff := webhookInitialBackoff
+	var lastErr string
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		// The webhook may have been deleted while we were backing off
+		if _, err := fetchWebhook(ctx, webhook.ID); err != nil {
+			if strings.Contains(err.Error(), "webhook not found") {
+				log.Infof("Dropping %s event %s, webhook %s was deleted", event.Type, event.ID, webhook.ID)
+				return
+			}
+			log.WithError(err).Errorf("failed to check webhook %s before delivering", webhook.ID)
+		}
+
+		delivery := postWebhook(ctx, webhook, deliveryID, event, body)
+		delivery.Attempt = attempt
+		recordWebhookDelivery(ctx, webhook.ID, delivery)
+
+		if delivery.Success {
+			return
+		}
+		lastErr = delivery.Error
+
+		if attempt < webhookMaxAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > webhookMaxBackoff {
+				backoff = webhookMaxBackoff
+			}
+		}
+	}
+
+	log.Warnf("Giving up on delivering %s event %s to webhook %s: %s", event.Type, event.ID, webhook.ID, lastErr)
+
+	data, err := json.Marshal(DeadLetter{
+		DeliveryID: deliveryID,
+		Event:      event,
+		Attempts:   webhookMaxAttempts,
+		LastError:  lastErr,
+		FailedAt:   time.Now().UTC(),
+	})
+	if err != nil {
+		log.WithError(err).Error("failed to marshal dead letter")
+		return
+	}
+
+	if err := appendWebhookLog(ctx, webhook.ID, webhookDeadLettersKey(webhook.ID), data, webhookDeadLetterLength); err != nil {
+		log.WithError(err).Errorf("failed to store dead letter for webhook %s", webhook.ID)
+	}
+}
+
+func postWebhook(ctx context.Context, webhook Webhook, deliveryID string, event Event, body []byte) WebhookDelivery {
+	delivery := WebhookDelivery{
+		ID:        deliveryID,
+		EventID:   event.ID,
+		EventType: event.Type,
+		AttemptAt: time.Now().UTC(),
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		delivery.Error = err.Error()
+		return delivery
+	}
+
+	timestamp := strconv.FormatInt(delivery.AttemptAt.Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, event.Type)
+	req.Header.Set(WebhookDeliveryHeader, deliveryID)
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, signWebhook(webhook.Secret, timestamp, body))
+
+	resp, err := webhookClient.Do(req)
+	delivery.DurationMs = time.Since(delivery.AttemptAt).Milliseconds()
+	if err != nil {
+		delivery.Error = err.Error()
+		return delivery
+	}
+	resp.Body.Close()
+
+	delivery.StatusCode = resp.StatusCode
+	delivery.Success = resp.StatusCode >= 200 && resp.StatusCode < 300
+	if !delivery.Success {
+		delivery.Error = fmt.Sprintf("receiver answered %s", resp.Status)
+	}
+	return delivery
+}
+
+func recordWebhookDelivery(ctx context.Context, webhookID string, delivery WebhookDelivery) {
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		log.WithError(err).Error("failed to marshal webhook delivery")
+		return
+	}
+
+	if err := appendWebhookLog(ctx, webhookID, webhookDeliveriesKey(webhookID), data, webhookDeliveryLogLength); err != nil {
+		log.WithError(err).Errorf("failed to record delivery for webhook %s", webhookID)
+	}
+}
+
+// appendWebhookLog pushes an entry onto a delivery log or dead-letter list,
+// keeping it at most length long. Nothing is written once the webhook is
+// gone, so a delivery in flight can't bring back the keys deleteWebhook
+// removed. The WATCH covers a delete between the check and the write.
+func appendWebhookLog(ctx context.Context, webhookID, key string, data []byte, length int64) error {
+	txf := func(tx *redis.Tx) error {
+		exists, err := tx.HExists(ctx, webhooksKey, webhookID).Result()
+		if err != nil || !exists {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.LPush(ctx, key, data)
+			pipe.LTrim(ctx, key, 0, length-1)
+			return nil
+		})
+		return err
+	}
+
+	var err error
+	for attempt := 0; attempt < webhookLogMaxRetries; attempt++ {
+		err = rdb.Watch(ctx, txf, webhooksKey)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return err
+}
+
+// readWebhookLog returns a newest-first delivery log or dead-letter list as
+// stored.
+func readWebhookLog(ctx context.Context, key string) ([]json.RawMessage, error) {
+	entries, err := rdb.LRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]json.RawMessage, 0, len(entries))
+	for _, entry := range entries {
+		items = append(items, json.RawMessage(entry))
+	}
+	return items, nil
+}
+
+func createWebhook(c echo.Context) error {
+	ctx := context.Background()
+
+	var webhook Webhook
+	if err := c.Bind(&webhook); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	if err := validateWebhook(&webhook); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	if webhook.Secret == "" {
+		secret, err := generateWebhookSecret()
+		if err != nil {
+			return handleError(c, err, http.StatusInternalServerError, "Failed to generate webhook secret")
+		}
+		webhook.Secret = secret
+	}
+	webhook.ID = xid.New().String()
+	webhook.CreatedAt = time.Now().UTC()
+
+	data, err := json.Marshal(webhook)
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to create webhook")
+	}
+	if err := rdb.HSet(ctx, webhooksKey, webhook.ID, data).Err(); err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to create webhook")
+	}
+
+	// The secret is only ever shown here
+	return c.JSON(http.StatusCreated, webhook)
+}
+
+func getWebhooks(c echo.Context) error {
+	webhooks, err := listWebhooks(context.Background())
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to fetch webhooks")
+	}
+
+	for i := range webhooks {
+		webhooks[i].Secret = ""
+	}
+	return c.JSON(http.StatusOK, webhooks)
+}
+
+func getWebhook(c echo.Context) error {
+	webhook, err := fetchWebhook(context.Background(), c.Param("webhook_id"))
+	if err != nil {
+		if strings.Contains(err.Error(), "webhook not found") {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Webhook not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+
+	webhook.Secret = ""
+	return c.JSON(http.StatusOK, webhook)
+}
+
+func deleteWebhook(c echo.Context) error {
+	webhookID := c.Param("webhook_id")
+	ctx := context.Background()
+
+	deleted, err := rdb.HDel(ctx, webhooksKey, webhookID).Result()
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to delete webhook")
+	}
+	if deleted == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Webhook not found"})
+	}
+
+	if err := rdb.Del(ctx, webhookDeliveriesKey(webhookID), webhookDeadLettersKey(webhookID)).Err(); err != nil {
+		log.WithError(err).Errorf("failed to delete delivery log of webhook %s", webhookID)
+	}
+
+	return c.JSON(http.StatusOK, "Webhook deleted!")
+}
+
+func getWebhookDeliveries(c echo.Context) error {
+	webhookID := c.Param("webhook_id")
+	ctx := context.Background()
+
+	if _, err := fetchWebhook(ctx, webhookID); err != nil {
+		if strings.Contains(err.Error(), "webhook not found") {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Webhook not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+
+	deliveries, err := readWebhookLog(ctx, webhookDeliveriesKey(webhookID))
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to fetch webhook deliveries")
+	}
+	return c.JSON(http.StatusOK, deliveries)
+}
+
+func getWebhookDeadLetters(c echo.Context) error {
+	webhookID := c.Param("webhook_id")
+	ctx := context.Background()
+
+	if _, err := fetchWebhook(ctx, webhookID); err != nil {
+		if strings.Contains(err.Error(), "webhook not found") {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Webhook not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+
+	deadLetters, err := readWebhookLog(ctx, webhookDeadLettersKey(webhookID))
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError, "Failed to fetch dead letters")
+	}
+	return c.JSON(http.StatusOK, deadLetters)
+}